@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Access rule actions
+const (
+	RuleAllow = "allow"
+	RuleDeny  = "deny"
+)
+
+// Firewall modes deciding how refused clients are answered
+const (
+	FirewallAccept = "ACCEPT" // Answer with 403 Forbidden
+	FirewallReject = "REJECT" // Answer with a rejection message
+	FirewallDrop   = "DROP"   // Don't answer at all
+)
+
+// AccessRule allows or denies the clients in a network
+// A rule may be scoped to HTTP routes and commands; an unscoped rule applies everywhere
+type AccessRule struct {
+	Action   string     `json:"action"` // "allow" or "deny"
+	Network  *net.IPNet `json:"-"`
+	CIDR     string     `json:"cidr"`                    // Network in CIDR notation, as reported by the admin endpoint
+	Routes   []string   `json:"routes,omitempty"`        // HTTP routes such as "/api/set", optionally limited to a method as in "POST:/api/set"
+	Commands []string   `json:"commands,omitempty"`      // Commands such as "SET", over any protocol
+	Mode     string     `json:"firewall_mode,omitempty"` // Firewall mode for clients this rule refuses (empty uses the global mode)
+}
+
+// String formats the rule as written in an access file
+func (r AccessRule) String() string {
+	parts := append([]string{r.Action, r.CIDR}, r.Routes...)
+	parts = append(parts, r.Commands...)
+	if r.Mode != "" {
+		parts = append(parts, "mode="+r.Mode)
+	}
+	return strings.Join(parts, " ")
+}
+
+// scoped reports whether the rule only applies to some routes or commands
+func (r AccessRule) scoped() bool {
+	return len(r.Routes) > 0 || len(r.Commands) > 0
+}
+
+// accessScope identifies what a client is trying to reach
+// The zero value is a new connection, to which only unscoped rules apply
+type accessScope struct {
+	method  string // HTTP method
+	route   string // HTTP route
+	command string // Command, upper case, whatever the protocol it is sent over
+}
+
+// routeCommands maps HTTP routes to the command they run, so command rules apply to them too
+// The commands of /api/txn and /api/ws depend on the request and are checked by their handlers
+var routeCommands = map[string]string{
+	"/api/ping":   "PING",
+	"/api/status": "STATUS",
+	"/api/get":    "GET",
+	"/api/set":    "SET",
+	"/api/delete": "DEL",
+	"/api/incr":   "INCR",
+	"/api/mget":   "MGET",
+	"/api/mset":   "MSET",
+	"/api/keys":   "KEYS",
+	"/api/watch":  "SUBSCRIBE",
+}
+
+// dispatchRoutes are the routes whose handlers check each command they run
+var dispatchRoutes = map[string]bool{"/api/txn": true, "/api/ws": true}
+
+// sessionCommands manage a connection rather than touch keys, so they stay open when no allow rule covers them
+var sessionCommands = map[string]bool{
+	"AUTH": true, "QUIT": true, "VERSION": true, "UNSUBSCRIBE": true,
+	"HELLO": true, "CLIENT": true, "SELECT": true, "COMMAND": true,
+}
+
+// dispatches reports whether the scope is checked again for each command run within it
+// This holds for new connections and for the routes that dispatch several commands
+func (s accessScope) dispatches() bool {
+	return s.command == "" && (s.route == "" || dispatchRoutes[s.route])
+}
+
+// commandAliases lists the commands whose rules also apply to a command, because it performs
+// the same operation under another name, on several keys or in another protocol
+var commandAliases = map[string][]string{
+	"DELETE":  {"DEL"},
+	"MGET":    {"GET"},
+	"MSET":    {"SET"},
+	"INCRBY":  {"INCR"},
+	"DECR":    {"INCR"},
+	"DECRBY":  {"INCR"},
+	"SCAN":    {"KEYS"},
+	"EXISTS":  {"GET"},    // Redis
+	"INFO":    {"STATUS"}, // Redis
+	"GETS":    {"GET"},    // memcached
+	"ADD":     {"SET"},    // memcached
+	"REPLACE": {"SET"},    // memcached
+	"CAS":     {"SET"},    // memcached
+	"STATS":   {"STATUS"}, // memcached
+}
+
+// appliesTo reports whether the rule is scoped to s
+func (r AccessRule) appliesTo(s accessScope) bool {
+	for _, route := range r.Routes {
+		method, path, hasMethod := strings.Cut(route, ":")
+		if !hasMethod {
+			method, path = "", route
+		}
+		if s.route != "" && path == s.route && (method == "" || method == s.method) {
+			return true
+		}
+	}
+	for _, command := range r.Commands {
+		if s.command != "" && (command == s.command || slices.Contains(commandAliases[s.command], command)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAccessRule parses the network of a rule, either in CIDR notation or as a single IPv4 or IPv6 address
+func parseAccessRule(action, s string) (AccessRule, error) {
+	network, err := parseNetwork(s)
+	if err != nil {
+		return AccessRule{}, fmt.Errorf("invalid %s rule: %w", action, err)
+	}
+	return AccessRule{Action: action, Network: network, CIDR: network.String()}, nil
+}
+
+// parseNetwork parses a network in CIDR notation or a single IPv4 or IPv6 address
+func parseNetwork(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("'%s' is not a CIDR range or an IP address", s)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		s = fmt.Sprintf("%s/%d", ip, bits)
+	}
+
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("'%s' is not a CIDR range or an IP address", s)
+	}
+	return network, nil
+}
+
+// ruleFlag is a repeatable command line flag that appends access rules in the order they are given
+type ruleFlag struct {
+	action string
+	rules  *[]AccessRule
+}
+
+// String returns the rules added by the flag
+func (f ruleFlag) String() string {
+	if f.rules == nil {
+		return ""
+	}
+	var cidrs []string
+	for _, r := range *f.rules {
+		if r.Action == f.action {
+			cidrs = append(cidrs, r.CIDR)
+		}
+	}
+	return strings.Join(cidrs, ",")
+}
+
+// Set adds the comma-separated networks of one flag occurrence
+func (f ruleFlag) Set(s string) error {
+	for _, cidr := range strings.Split(s, ",") {
+		rule, err := parseAccessRule(f.action, cidr)
+		if err != nil {
+			return err
+		}
+		*f.rules = append(*f.rules, rule)
+	}
+	return nil
+}
+
+// parseAccessLine parses a rule written as "<allow|deny> <cidr> [route|command...] [mode=DROP|REJECT|ACCEPT]"
+// Routes start with "/" or with a method as in "POST:/api/set"; anything else names a command
+func parseAccessLine(line string) (AccessRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return AccessRule{}, fmt.Errorf("expected '<allow|deny> <cidr> [routes and commands] [mode=...]', got '%s'", line)
+	}
+	action := strings.ToLower(fields[0])
+	if action != RuleAllow && action != RuleDeny {
+		return AccessRule{}, fmt.Errorf("invalid action '%s': must be allow or deny", fields[0])
+	}
+
+	rule, err := parseAccessRule(action, fields[1])
+	if err != nil {
+		return AccessRule{}, err
+	}
+
+	for _, field := range fields[2:] {
+		if name, value, ok := strings.Cut(field, "="); ok && strings.EqualFold(name, "mode") {
+			rule.Mode, err = parseFirewallMode(value)
+			if err != nil {
+				return AccessRule{}, err
+			}
+			continue
+		}
+
+		method, path, hasMethod := strings.Cut(field, ":")
+		switch {
+		case strings.HasPrefix(field, "/"):
+			rule.Routes = append(rule.Routes, field)
+		case hasMethod && strings.HasPrefix(path, "/"):
+			rule.Routes = append(rule.Routes, strings.ToUpper(method)+":"+path)
+		case strings.IndexFunc(field, func(c rune) bool { return !unicode.IsLetter(c) }) < 0:
+			rule.Commands = append(rule.Commands, strings.ToUpper(field))
+		default:
+			return AccessRule{}, fmt.Errorf("invalid scope '%s': must be a route such as /api/set or POST:/api/set, or a command such as SET", field)
+		}
+	}
+
+	return rule, nil
+}
+
+// parseFirewallMode parses the firewall mode of a rule; 403 is accepted as another name for ACCEPT
+func parseFirewallMode(s string) (string, error) {
+	switch mode := strings.ToUpper(s); mode {
+	case FirewallDrop, FirewallReject, FirewallAccept:
+		return mode, nil
+	case "403":
+		return FirewallAccept, nil
+	default:
+		return "", fmt.Errorf("invalid firewall mode '%s': must be DROP, REJECT or ACCEPT (403)", s)
+	}
+}
+
+// lineRuleFlag is a repeatable command line flag that appends one rule in access file syntax
+type lineRuleFlag struct {
+	rules *[]AccessRule
+}
+
+// String returns the rules added so far
+func (f lineRuleFlag) String() string {
+	if f.rules == nil {
+		return ""
+	}
+	lines := make([]string, len(*f.rules))
+	for i, r := range *f.rules {
+		lines[i] = r.String()
+	}
+	return strings.Join(lines, "; ")
+}
+
+// Set adds the rule of one flag occurrence
+func (f lineRuleFlag) Set(s string) error {
+	rule, err := parseAccessLine(s)
+	if err != nil {
+		return err
+	}
+	*f.rules = append(*f.rules, rule)
+	return nil
+}
+
+// loadAccessFile reads access rules from a file with one rule per line, as parsed by parseAccessLine
+// Empty lines and lines starting with # are ignored
+func loadAccessFile(path string) ([]AccessRule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open access file: %w", err)
+	}
+	defer file.Close()
+
+	var rules []AccessRule
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parseAccessLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read access file: %w", err)
+	}
+
+	return rules, nil
+}
+
+// Restricted reports whether any access rule is configured
+func (ac *AccessControl) Restricted() bool {
+	return len(ac.Rules) > 0
+}
+
+// CheckIP evaluates the access rules for a client IP reaching scope
+// Unscoped rules and rules scoped to scope apply. A matching deny rule always wins. Otherwise the IP must
+// match an allow rule: the scoped ones if there are any, as they replace the unscoped allow rules for their scope
+// Once any allow rule exists, a route or command that no allow rule covers is refused to every IP
+// Returns an empty string if the IP is allowed, or the reason it is refused and the firewall mode to refuse it with
+func (ac *AccessControl) CheckIP(ip net.IP, scope accessScope) (reason, mode string) {
+	var globalAllow, scopedAllow []AccessRule
+	hasAllow := false
+	for _, rule := range ac.Rules {
+		if rule.Action == RuleAllow {
+			hasAllow = true
+		}
+		if rule.scoped() && !rule.appliesTo(scope) {
+			continue
+		}
+		switch rule.Action {
+		case RuleDeny:
+			if rule.Network.Contains(ip) {
+				return fmt.Sprintf("IP matches rule '%s'", rule), ac.modeOf(rule)
+			}
+		case RuleAllow:
+			if rule.scoped() {
+				scopedAllow = append(scopedAllow, rule)
+			} else {
+				globalAllow = append(globalAllow, rule)
+			}
+		}
+	}
+
+	allow := globalAllow
+	if len(scopedAllow) > 0 {
+		allow = scopedAllow
+	}
+	if len(allow) == 0 {
+		if !hasAllow || scope.dispatches() || sessionCommands[scope.command] {
+			return "", ""
+		}
+		return fmt.Sprintf("no allow rule covers %s", scope), ac.FirewallMode
+	}
+	for _, rule := range allow {
+		if rule.Network.Contains(ip) {
+			return "", ""
+		}
+	}
+
+	// An IP matching none of the allow rules is refused with the mode of the first of them
+	if len(scopedAllow) > 0 {
+		return fmt.Sprintf("IP not in allowed CIDR for %s", scope), ac.modeOf(allow[0])
+	}
+	return "IP not in allowed CIDR", ac.modeOf(allow[0])
+}
+
+// modeOf returns the firewall mode used for clients refused by rule
+func (ac *AccessControl) modeOf(rule AccessRule) string {
+	if rule.Mode != "" {
+		return rule.Mode
+	}
+	return ac.FirewallMode
+}
+
+// String describes the scope for logging
+func (s accessScope) String() string {
+	if s.route != "" {
+		return s.method + " " + s.route
+	}
+	return s.command
+}
+
+// CheckCommand applies the access rules for a command to a client of a connection-based protocol
+// Returns whether the command is refused and the message to answer it with, empty in DROP mode
+// A nil ip, as for Unix socket clients, isn't subject to the rules
+func (ac *AccessControl) CheckCommand(protocol string, ip net.IP, ipStr, command string) (refused bool, message string) {
+	if ip == nil || !ac.Restricted() {
+		return false, ""
+	}
+
+	command = strings.ToUpper(command)
+	reason, mode := ac.CheckIP(ip, accessScope{command: command})
+	if reason == "" {
+		return false, ""
+	}
+	return true, refusalMessage(protocol, command, ipStr, reason, mode)
+}
+
+// refusalMessage logs a client refused by the access rules and returns the message to answer it with
+// Returns an empty string in DROP mode, where the client gets no answer at all
+func refusalMessage(method, path, ipStr, reason, mode string) string {
+	switch mode {
+	case FirewallDrop:
+		logMessage(method, path, ipStr, "DROPPED (fw-drop mode) - "+reason, true, 0)
+		return ""
+	case FirewallReject:
+		logMessage(method, path, ipStr, "REJECTED (fw-reject mode) - "+reason, true, http.StatusForbidden)
+		return "Connection rejected by firewall: Your IP is not in the allowed range"
+	default: // "ACCEPT" or any other value
+		logMessage(method, path, ipStr, "Access denied ("+reason+")", true, http.StatusForbidden)
+		return "Access denied: Your IP is not in the allowed range"
+	}
+}
+
+// AccessInfo describes the effective access rules, as returned by the access endpoint
+type AccessInfo struct {
+	FirewallMode string       `json:"firewall_mode"`
+	Rules        []AccessRule `json:"rules"`
+}
+
+// Info returns the effective access rules
+func (ac *AccessControl) Info() AccessInfo {
+	rules := ac.Rules
+	if rules == nil {
+		rules = []AccessRule{}
+	}
+	return AccessInfo{FirewallMode: ac.FirewallMode, Rules: rules}
+}
+
+// udpCommandName returns the upper case name of a UDP command, skipping its SIG and AUTH prefixes
+// The prefixes are only skipped here, not verified, so that the rules for the command can be applied first
+func udpCommandName(datagram string) string {
+	fields := strings.Fields(datagram)
+	if len(fields) > 4 && fields[0] == "SIG" {
+		fields = fields[4:]
+	}
+	if len(fields) > 2 && strings.EqualFold(fields[0], "AUTH") {
+		fields = fields[2:]
+	}
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToUpper(fields[0])
+}
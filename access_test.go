@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// TestCheckIPCommandScopes checks that a command rule applies to the command under every name and route it is sent with,
+// and that scopes no allow rule covers are closed once only scoped allow rules exist
+func TestCheckIPCommandScopes(t *testing.T) {
+	type scopeCase struct {
+		scope   accessScope
+		subnet  bool // 10.1.2.3 may reach it
+		network bool // 10.5.5.5 may reach it
+	}
+
+	tests := []struct {
+		name   string
+		rules  []string
+		scopes []scopeCase
+	}{
+		{
+			name:  "scoped rule within a global one",
+			rules: []string{"allow 10.0.0.0/8", "allow 10.1.2.0/24 SET /api/set"},
+			scopes: []scopeCase{
+				{accessScope{}, true, true},
+				{accessScope{command: "GET"}, true, true},
+				{accessScope{command: "SET"}, true, false},
+				{accessScope{command: "MSET"}, true, false},
+				{accessScope{command: "ADD"}, true, false},
+				{accessScope{method: "POST", route: "/api/set", command: "SET"}, true, false},
+				{accessScope{method: "POST", route: "/api/mset", command: "MSET"}, true, false},
+				{accessScope{method: "POST", route: "/api/txn", command: "SET"}, true, false},
+				{accessScope{method: "GET", route: "/api/ws"}, true, true},
+			},
+		},
+		{
+			name:  "only scoped rules",
+			rules: []string{"allow 10.0.0.0/8 GET", "allow 10.1.2.0/24 SET"},
+			scopes: []scopeCase{
+				{accessScope{}, true, true},
+				{accessScope{command: "GET"}, true, true},
+				{accessScope{command: "SET"}, true, false},
+				{accessScope{command: "DEL"}, false, false},
+				{accessScope{command: "PING"}, false, false},
+				{accessScope{command: "AUTH"}, true, true},
+				{accessScope{command: "QUIT"}, true, true},
+				{accessScope{method: "GET", route: "/api/get", command: "GET"}, true, true},
+				{accessScope{method: "POST", route: "/api/delete", command: "DEL"}, false, false},
+				{accessScope{method: "GET", route: "/api/access"}, false, false},
+				{accessScope{method: "POST", route: "/api/txn"}, true, true},
+				{accessScope{method: "POST", route: "/api/txn", command: "DEL"}, false, false},
+				{accessScope{method: "GET", route: "/api/ws"}, true, true},
+			},
+		},
+		{
+			name:  "only deny rules",
+			rules: []string{"deny 10.5.0.0/16"},
+			scopes: []scopeCase{
+				{accessScope{}, true, false},
+				{accessScope{command: "DEL"}, true, false},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rules []AccessRule
+			for _, line := range tt.rules {
+				rule, err := parseAccessLine(line)
+				if err != nil {
+					t.Fatalf("parseAccessLine(%q): %v", line, err)
+				}
+				rules = append(rules, rule)
+			}
+			ac := &AccessControl{Rules: rules, FirewallMode: FirewallAccept}
+
+			for _, s := range tt.scopes {
+				for ip, allowed := range map[string]bool{"10.1.2.3": s.subnet, "10.5.5.5": s.network} {
+					reason, _ := ac.CheckIP(net.ParseIP(ip), s.scope)
+					if refused := reason != ""; refused == allowed {
+						t.Errorf("%+v: %s refused = %v (%s), want %v", s.scope, ip, refused, reason, !allowed)
+					}
+				}
+			}
+		})
+	}
+}
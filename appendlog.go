@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fsync policies for the append-only log
+const (
+	FsyncAlways   = "always"   // fsync after every record
+	FsyncEverySec = "everysec" // fsync once per second in the background
+	FsyncNever    = "never"    // leave flushing to the operating system
+)
+
+// Append-only log record operations
+const (
+	OpSet    = "set"
+	OpDelete = "del"
+	OpClear  = "clear" // Removes all keys; written at the start of every compacted log
+	OpBatch  = "batch" // Applies the nested records together, so a torn write never leaves half a batch
+)
+
+// appendLogHeaderSize is the size of the per-record header: payload length and CRC32 checksum
+const appendLogHeaderSize = 8
+
+// logRecord is a single mutation stored in the append-only log
+type logRecord struct {
+	Op        string      `json:"op"`
+	Key       string      `json:"key,omitempty"`
+	Value     string      `json:"value,omitempty"`
+	ExpiresAt *time.Time  `json:"expires_at,omitempty"`
+	Version   uint64      `json:"version,omitempty"` // Store revision of the mutation
+	Flags     uint32      `json:"flags,omitempty"`   // Opaque client flags of a set
+	Records   []logRecord `json:"records,omitempty"` // Nested records of a batch
+}
+
+// appendLog is an append-only log of store mutations
+// Each record is framed as a 4-byte big-endian payload length, a 4-byte CRC32
+// of the payload and the JSON encoded payload itself
+type appendLog struct {
+	path        string
+	fsyncPolicy string
+	maxSize     int64 // Size in bytes after which the log is compacted (0 disables compaction)
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	baseSize int64 // Size right after the last compaction
+	dirty    bool  // Records were written since the last fsync
+
+	compactCh chan struct{}
+}
+
+// parseFsyncPolicy validates an fsync policy name
+func parseFsyncPolicy(s string) (string, error) {
+	policy := strings.ToLower(s)
+	switch policy {
+	case FsyncAlways, FsyncEverySec, FsyncNever:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid fsync policy '%s': must be one of always, everysec, never", s)
+	}
+}
+
+// openAppendLog replays the log at path into the store and opens it for appending
+// A torn record at the end of the file is truncated; a corrupted record anywhere else is an error
+// Returns the log and the number of records replayed
+func openAppendLog(path, fsyncPolicy string, maxSize int64, kvs *KeyValueStore) (*appendLog, int, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open append-only log: %w", err)
+	}
+
+	replayed, validSize, err := replayAppendLog(file, kvs)
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("failed to stat append-only log: %w", err)
+	}
+
+	// Drop a torn tail left behind by a crash in the middle of a write
+	if info.Size() > validSize {
+		logMessage("SYSTEM", "aof", "local", fmt.Sprintf("Truncating %d bytes of torn records at the end of %s", info.Size()-validSize, path), false, http.StatusInternalServerError)
+		if err := file.Truncate(validSize); err != nil {
+			file.Close()
+			return nil, 0, fmt.Errorf("failed to truncate append-only log: %w", err)
+		}
+	}
+
+	if _, err := file.Seek(validSize, io.SeekStart); err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("failed to seek append-only log: %w", err)
+	}
+
+	l := &appendLog{
+		path:        path,
+		fsyncPolicy: fsyncPolicy,
+		maxSize:     maxSize,
+		file:        file,
+		size:        validSize,
+		compactCh:   make(chan struct{}, 1),
+	}
+
+	return l, replayed, nil
+}
+
+// replayAppendLog applies every valid record in r to the store
+// A record cut short by the end of the log, or a last record that fails its checksum, is a torn write
+// and ends the replay. A bad record followed by more data means the log is corrupted, which is an error
+// so that the records after it aren't silently dropped
+// Returns the number of records applied and the offset just past the last valid record
+func replayAppendLog(r io.Reader, kvs *KeyValueStore) (int, int64, error) {
+	reader := bufio.NewReader(r)
+	header := make([]byte, appendLogHeaderSize)
+	now := time.Now()
+
+	// JSON escaping can grow a string up to six times its size and a batch holds
+	// at most MaxBatchSize records; any larger payload length can only come from
+	// a torn or corrupted header
+	limits := kvs.Limits()
+	maxRecordSize := (int64(limits.MaxKeySize+limits.MaxValueSize)*6 + 1024) * MaxBatchSize
+
+	var offset int64
+	count := 0
+
+	// badRecord ends the replay at a record that can't be applied: at the end of the log it is
+	// a torn write, otherwise the log is corrupted
+	badRecord := func(problem string) (int, int64, error) {
+		if _, err := reader.Peek(1); errors.Is(err, io.EOF) {
+			return count, offset, nil
+		}
+		return count, offset, fmt.Errorf("append-only log is corrupted at offset %d: %s", offset, problem)
+	}
+
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return count, offset, nil
+			}
+			return count, offset, fmt.Errorf("failed to read append-only log: %w", err)
+		}
+
+		length := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		if int64(length) > maxRecordSize {
+			return badRecord(fmt.Sprintf("record length %d exceeds the maximum of %d bytes", length, maxRecordSize))
+		}
+
+		// Read incrementally rather than allocating the announced length up front,
+		// so a corrupted length at the end of the file can't exhaust memory
+		payload, err := io.ReadAll(io.LimitReader(reader, int64(length)))
+		if err != nil {
+			return count, offset, fmt.Errorf("failed to read append-only log: %w", err)
+		}
+		if len(payload) < int(length) {
+			return count, offset, nil
+		}
+
+		if crc32.ChecksumIEEE(payload) != checksum {
+			return badRecord("checksum mismatch")
+		}
+
+		var rec logRecord
+		if err := json.Unmarshal(payload, &rec); err != nil {
+			return badRecord(fmt.Sprintf("invalid record: %v", err))
+		}
+
+		kvs.applyRecordLocked(rec, now)
+		offset += appendLogHeaderSize + int64(length)
+		count++
+	}
+}
+
+// encodeLogRecord frames a record for writing to the log
+func encodeLogRecord(rec logRecord) ([]byte, error) {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode log record: %w", err)
+	}
+
+	buf := make([]byte, appendLogHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[appendLogHeaderSize:], payload)
+	return buf, nil
+}
+
+// Append writes a record to the log, honouring the configured fsync policy
+func (l *appendLog) Append(rec logRecord) error {
+	data, err := encodeLogRecord(rec)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.file.Write(data); err != nil {
+		return fmt.Errorf("failed to write to append-only log: %w", err)
+	}
+	l.size += int64(len(data))
+
+	if l.fsyncPolicy == FsyncAlways {
+		if err := l.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync append-only log: %w", err)
+		}
+	} else {
+		l.dirty = true
+	}
+
+	// Ask the background worker to compact the log once it grows too large
+	// Requiring it to have doubled since the last compaction avoids rewriting
+	// it on every write when the live data alone exceeds the limit
+	if l.maxSize > 0 && l.size > l.maxSize && l.size >= 2*l.baseSize {
+		select {
+		case l.compactCh <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Sync flushes any pending records to disk
+func (l *appendLog) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.dirty {
+		return nil
+	}
+	l.dirty = false
+	return l.file.Sync()
+}
+
+// Size returns the current size of the log in bytes
+func (l *appendLog) Size() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.size
+}
+
+// Rewrite atomically replaces the log with a compacted log holding only the given entries
+// revision is the current store revision, preserved so versions keep increasing after a restart
+func (l *appendLog) Rewrite(entries []snapshotEntry, revision uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary log file: %w", err)
+	}
+	tmpName := tmp.Name()
+
+	// Remove the temporary file if anything goes wrong before the rename
+	success := false
+	defer func() {
+		if !success {
+			tmp.Close()
+			os.Remove(tmpName)
+		}
+	}()
+
+	writer := bufio.NewWriter(tmp)
+	var size int64
+
+	records := make([]logRecord, 0, len(entries)+1)
+	records = append(records, logRecord{Op: OpClear, Version: revision})
+	for _, se := range entries {
+		records = append(records, logRecord{Op: OpSet, Key: se.Key, Value: se.Value, ExpiresAt: se.ExpiresAt, Version: se.Version, Flags: se.Flags})
+	}
+
+	for _, rec := range records {
+		data, err := encodeLogRecord(rec)
+		if err != nil {
+			return err
+		}
+		if _, err := writer.Write(data); err != nil {
+			return fmt.Errorf("failed to write compacted log: %w", err)
+		}
+		size += int64(len(data))
+	}
+
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write compacted log: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("failed to sync compacted log: %w", err)
+	}
+	if err := os.Rename(tmpName, l.path); err != nil {
+		return fmt.Errorf("failed to replace append-only log: %w", err)
+	}
+	success = true
+
+	// Sync the directory so the rename itself is durable
+	if dir, err := os.Open(filepath.Dir(l.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	// Continue appending to the compacted file
+	l.file.Close()
+	l.file = tmp
+	l.size = size
+	l.baseSize = size
+	l.dirty = false
+
+	return nil
+}
+
+// Close flushes and closes the log
+func (l *appendLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.file.Sync(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// startAppendLogWorker runs the background fsync and compaction tasks for the log
+func startAppendLogWorker(l *appendLog, kvs *KeyValueStore) {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if l.fsyncPolicy != FsyncEverySec {
+					continue
+				}
+				if err := l.Sync(); err != nil {
+					logMessage("SYSTEM", "aof", "local", fmt.Sprintf("Error syncing append-only log: %v", err), false, http.StatusInternalServerError)
+				}
+			case <-l.compactCh:
+				before := l.Size()
+				if err := kvs.CompactAppendLog(); err != nil {
+					logMessage("SYSTEM", "aof", "local", fmt.Sprintf("Error compacting append-only log: %v", err), false, http.StatusInternalServerError)
+					continue
+				}
+				logMessage("SYSTEM", "aof", "local", fmt.Sprintf("Compacted append-only log from %d to %d bytes", before, l.Size()), false, http.StatusOK)
+			}
+		}
+	}()
+}
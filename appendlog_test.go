@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// encodeLog frames records as they are written to the log
+func encodeLog(t *testing.T, records ...logRecord) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, rec := range records {
+		data, err := encodeLogRecord(rec)
+		if err != nil {
+			t.Fatalf("encodeLogRecord: %v", err)
+		}
+		buf.Write(data)
+	}
+	return buf.Bytes()
+}
+
+// TestReplayAppendLog checks that encoded records replay into the same state and that only torn tails are tolerated
+func TestReplayAppendLog(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	valid := encodeLog(t,
+		logRecord{Op: OpSet, Key: "a", Value: "1", Version: 1},
+		logRecord{Op: OpSet, Key: "b", Value: "2", ExpiresAt: &expiresAt, Version: 2, Flags: 7},
+		logRecord{Op: OpBatch, Version: 3, Records: []logRecord{
+			{Op: OpSet, Key: "c", Value: "3", Version: 3},
+			{Op: OpDelete, Key: "a", Version: 3},
+		}},
+	)
+	next := encodeLog(t, logRecord{Op: OpSet, Key: "d", Value: "4", Version: 4})
+
+	// A record with a flipped payload byte fails its checksum
+	corrupt := append([]byte(nil), next...)
+	corrupt[len(corrupt)-2] ^= 0x01
+
+	// A record whose length is one byte short leaves the rest of its payload in front of the next record
+	shortLength := append([]byte(nil), next...)
+	binary.BigEndian.PutUint32(shortLength[0:4], uint32(len(next)-appendLogHeaderSize-1))
+
+	tests := []struct {
+		name      string
+		log       []byte
+		records   int
+		offset    int64
+		corrupted bool
+	}{
+		{"round trip", valid, 3, int64(len(valid)), false},
+		{"empty log", nil, 0, 0, false},
+		{"torn header", append(append([]byte(nil), valid...), next[:5]...), 3, int64(len(valid)), false},
+		{"torn payload", append(append([]byte(nil), valid...), next[:len(next)-3]...), 3, int64(len(valid)), false},
+		{"checksum mismatch at the end", append(append([]byte(nil), valid...), corrupt...), 3, int64(len(valid)), false},
+		{"checksum mismatch in the middle", append(append(append([]byte(nil), valid...), corrupt...), next...), 3, int64(len(valid)), true},
+		{"bad length in the middle", append(append(append([]byte(nil), valid...), shortLength...), next...), 3, int64(len(valid)), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kvs := NewKeyValueStore(DefaultLimits())
+			records, offset, err := replayAppendLog(bytes.NewReader(tt.log), kvs)
+
+			if tt.corrupted {
+				if err == nil || !strings.Contains(err.Error(), "offset") {
+					t.Fatalf("expected a corruption error with the offset, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("replayAppendLog: %v", err)
+			}
+			if records != tt.records || offset != tt.offset {
+				t.Fatalf("replayed %d records up to offset %d, want %d up to %d", records, offset, tt.records, tt.offset)
+			}
+			if tt.records == 0 {
+				return
+			}
+
+			if _, exists := kvs.Get("a"); exists {
+				t.Errorf("key 'a' deleted by the batch still exists")
+			}
+			b, exists := kvs.GetItem("b")
+			if !exists || b.Value != "2" || b.Flags != 7 || b.Version != 2 || b.TTL <= 0 {
+				t.Errorf("key 'b' = %+v, %v", b, exists)
+			}
+			if c, _ := kvs.GetItem("c"); c.Version != 3 {
+				t.Errorf("key 'c' has version %d, want 3", c.Version)
+			}
+		})
+	}
+}
+
+// TestOpenAppendLogCorruption checks that a torn tail is truncated on disk but a corrupted record in the middle is refused
+func TestOpenAppendLogCorruption(t *testing.T) {
+	first := encodeLog(t, logRecord{Op: OpSet, Key: "a", Value: "1", Version: 1})
+	second := encodeLog(t, logRecord{Op: OpSet, Key: "b", Value: "2", Version: 2})
+
+	t.Run("torn tail", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "kvapi.aof")
+		if err := os.WriteFile(path, append(append([]byte(nil), first...), second[:len(second)-1]...), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		l, records, err := openAppendLog(path, FsyncNever, 0, NewKeyValueStore(DefaultLimits()))
+		if err != nil {
+			t.Fatalf("openAppendLog: %v", err)
+		}
+		l.Close()
+
+		info, _ := os.Stat(path)
+		if records != 1 || info.Size() != int64(len(first)) {
+			t.Fatalf("replayed %d records and left %d bytes, want 1 record and %d bytes", records, info.Size(), len(first))
+		}
+	})
+
+	t.Run("corrupted middle", func(t *testing.T) {
+		corrupt := append([]byte(nil), first...)
+		corrupt[appendLogHeaderSize] ^= 0x01
+		data := append(corrupt, second...)
+
+		path := filepath.Join(t.TempDir(), "kvapi.aof")
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := openAppendLog(path, FsyncNever, 0, NewKeyValueStore(DefaultLimits())); err == nil || !strings.Contains(err.Error(), "offset 0") {
+			t.Fatalf("expected a corruption error at offset 0, got %v", err)
+		}
+		if info, _ := os.Stat(path); info.Size() != int64(len(data)) {
+			t.Fatalf("corrupted log was truncated to %d bytes", info.Size())
+		}
+	})
+}
+
+// TestCompactAppendLog checks that a compacted log keeps the TTL, flags and version of every key
+func TestCompactAppendLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvapi.aof")
+
+	kvs := NewKeyValueStore(DefaultLimits())
+	l, _, err := openAppendLog(path, FsyncAlways, 0, kvs)
+	if err != nil {
+		t.Fatalf("openAppendLog: %v", err)
+	}
+	kvs.SetAppendLog(l)
+
+	if _, err := kvs.SetWithFlags("session", "abc", 42, time.Hour, SetCondition{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvs.Set("gone", "x", 0); err != nil {
+		t.Fatal(err)
+	}
+	kvs.Delete("gone")
+	if err := kvs.CompactAppendLog(); err != nil {
+		t.Fatalf("CompactAppendLog: %v", err)
+	}
+	l.Close()
+
+	restored := NewKeyValueStore(DefaultLimits())
+	l, _, err = openAppendLog(path, FsyncAlways, 0, restored)
+	if err != nil {
+		t.Fatalf("openAppendLog after compaction: %v", err)
+	}
+	defer l.Close()
+
+	item, exists := restored.GetItem("session")
+	if !exists || item.Value != "abc" || item.Flags != 42 || item.Version != 1 {
+		t.Fatalf("restored key = %+v, %v", item, exists)
+	}
+	if item.TTL <= 59*time.Minute || item.TTL > time.Hour {
+		t.Fatalf("restored TTL = %s, want about an hour", item.TTL)
+	}
+	if _, exists := restored.Get("gone"); exists {
+		t.Fatalf("deleted key was restored")
+	}
+}
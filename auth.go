@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Token roles, from least to most privileged
+const (
+	RoleRead  = "read"  // Read and list keys
+	RoleWrite = "write" // Also set, increment and delete keys
+	RoleAdmin = "admin" // Also query the server status and access rules
+)
+
+// roleLevels orders the roles; a token may do everything its role or a lesser one allows
+var roleLevels = map[string]int{RoleRead: 1, RoleWrite: 2, RoleAdmin: 3}
+
+// Authentication errors
+var (
+	ErrUnauthenticated = errors.New("authentication required")
+	ErrForbidden       = errors.New("permission denied")
+)
+
+// Token is an API token and the permissions it grants
+type Token struct {
+	Name     string   `json:"name"`
+	Token    string   `json:"token"`
+	Role     string   `json:"role"`               // "read", "write" or "admin"
+	Prefixes []string `json:"prefixes,omitempty"` // Key prefixes the token is limited to (empty means every key)
+}
+
+// tokenFile is the JSON format of the token file
+type tokenFile struct {
+	Tokens []Token `json:"tokens"`
+}
+
+// Authenticator validates API tokens
+type Authenticator struct {
+	// Tokens are indexed by their hash so that looking one up doesn't compare secrets byte by byte
+	tokens map[[sha256.Size]byte]*Token
+}
+
+// loadTokenFile reads the tokens and their permissions from a JSON file
+func loadTokenFile(path string) (*Authenticator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token file: %w", err)
+	}
+
+	var file tokenFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse token file: %w", err)
+	}
+	if len(file.Tokens) == 0 {
+		return nil, fmt.Errorf("token file %s holds no tokens", path)
+	}
+
+	auth := &Authenticator{tokens: make(map[[sha256.Size]byte]*Token, len(file.Tokens))}
+	for i := range file.Tokens {
+		t := &file.Tokens[i]
+		if t.Name == "" {
+			t.Name = fmt.Sprintf("token-%d", i+1)
+		}
+		if t.Token == "" {
+			return nil, fmt.Errorf("token '%s' has an empty secret", t.Name)
+		}
+		if _, ok := roleLevels[t.Role]; !ok {
+			return nil, fmt.Errorf("token '%s' has invalid role '%s': must be read, write or admin", t.Name, t.Role)
+		}
+
+		hash := sha256.Sum256([]byte(t.Token))
+		if _, exists := auth.tokens[hash]; exists {
+			return nil, fmt.Errorf("token '%s' duplicates the secret of another token", t.Name)
+		}
+		auth.tokens[hash] = t
+	}
+
+	return auth, nil
+}
+
+// Count returns the number of configured tokens
+func (a *Authenticator) Count() int {
+	return len(a.tokens)
+}
+
+// Authenticate returns the token matching secret
+func (a *Authenticator) Authenticate(secret string) (*Token, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("%w: missing token", ErrUnauthenticated)
+	}
+	t, ok := a.tokens[sha256.Sum256([]byte(secret))]
+	if !ok {
+		return nil, fmt.Errorf("%w: invalid token", ErrUnauthenticated)
+	}
+	return t, nil
+}
+
+// permission describes what an operation requires from a token
+type permission struct {
+	role    string   // Minimum role, empty if the operation is open to everyone
+	keys    []string // Keys the operation reads or writes
+	listing bool     // Whether the operation lists keys selected by prefix and match
+	prefix  string
+	match   string
+}
+
+// Authorize checks that the token grants the permission
+func (t *Token) Authorize(p permission) error {
+	if p.role == "" {
+		return nil
+	}
+	if roleLevels[t.Role] < roleLevels[p.role] {
+		return fmt.Errorf("%w: token '%s' has role %s, but %s is required", ErrForbidden, t.Name, t.Role, p.role)
+	}
+	for _, key := range p.keys {
+		if !t.allowsPrefix(key) {
+			return fmt.Errorf("%w: token '%s' may not access key '%s'", ErrForbidden, t.Name, key)
+		}
+	}
+	// A listing is in scope if its prefix, or the literal start of its pattern, is
+	if p.listing && !t.allowsPrefix(p.prefix) && !t.allowsPrefix(literalPrefix(p.match)) {
+		return fmt.Errorf("%w: token '%s' may only list keys starting with %s", ErrForbidden, t.Name, strings.Join(t.Prefixes, ", "))
+	}
+	return nil
+}
+
+// allowsPrefix reports whether every key starting with prefix is within the scope of the token
+func (t *Token) allowsPrefix(prefix string) bool {
+	if len(t.Prefixes) == 0 {
+		return true
+	}
+	for _, scope := range t.Prefixes {
+		if strings.HasPrefix(prefix, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// literalPrefix returns the part of a glob pattern before its first special character
+func literalPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// commandPermission returns the permission needed by a text command as sent over UDP, WebSocket or RESP
+func commandPermission(parts []string) permission {
+	if len(parts) == 0 {
+		return permission{}
+	}
+
+	args := parts[1:]
+	switch strings.ToUpper(parts[0]) {
+	case "PING", "QUIT", "HELLO", "CLIENT", "SELECT", "COMMAND":
+		return permission{}
+	case "STATUS", "INFO":
+		return permission{role: RoleAdmin}
+	case "GET", "MGET", "EXISTS":
+		return permission{role: RoleRead, keys: args}
+	case "SET", "INCR", "DECR", "INCRBY", "DECRBY":
+		return permission{role: RoleWrite, keys: args[:min(len(args), 1)]}
+	case "DEL", "DELETE":
+		return permission{role: RoleWrite, keys: args}
+	case "MSET":
+		var keys []string
+		for i := 0; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+		return permission{role: RoleWrite, keys: keys}
+	case "KEYS":
+		p := permission{role: RoleRead, listing: true}
+		if len(args) > 0 {
+			p.match = args[0]
+		}
+		return p
+	case "SCAN":
+		// SCAN <cursor> [MATCH <pattern>] [PREFIX <prefix>] [COUNT <n>]
+		p := permission{role: RoleRead, listing: true}
+		for i := 1; i+1 < len(args); i += 2 {
+			switch strings.ToUpper(args[i]) {
+			case "MATCH":
+				p.match = args[i+1]
+			case "PREFIX":
+				p.prefix = args[i+1]
+			}
+		}
+		return p
+	default:
+		return permission{role: RoleRead}
+	}
+}
+
+// txnPermission returns the permission needed by a transaction
+// Compared keys are read; a transaction that may write needs the write role
+func txnPermission(t TxnRequest) permission {
+	p := permission{role: RoleRead}
+	for _, c := range t.Compare {
+		p.keys = append(p.keys, c.Key)
+	}
+	for _, ops := range [][]TxnOp{t.Success, t.Failure} {
+		for _, op := range ops {
+			p.keys = append(p.keys, op.Key)
+			if op.Op != TxnOpGet {
+				p.role = RoleWrite
+			}
+		}
+	}
+	return p
+}
+
+// parseAuthCommand splits an "AUTH <token> <command>" text command and authorizes the command
+// Returns the command without the AUTH prefix
+func parseAuthCommand(auth *Authenticator, command string) (string, *Token, error) {
+	parts := strings.SplitN(strings.TrimSpace(command), " ", 3)
+	if len(parts) < 3 || !strings.EqualFold(parts[0], "AUTH") {
+		return "", nil, fmt.Errorf("%w: send commands as AUTH <token> <command>", ErrUnauthenticated)
+	}
+
+	token, err := auth.Authenticate(parts[1])
+	if err != nil {
+		return "", nil, err
+	}
+	rest := strings.TrimSpace(parts[2])
+	if err := token.Authorize(commandPermission(strings.Fields(rest))); err != nil {
+		return "", nil, err
+	}
+	return rest, token, nil
+}
+
+// authStatus returns the HTTP status for an authentication or authorization error
+func authStatus(err error) int {
+	if errors.Is(err, ErrUnauthenticated) {
+		return http.StatusUnauthorized
+	}
+	return http.StatusForbidden
+}
+
+// tokenKey is the context key under which authenticated requests store their token
+type tokenKey struct{}
+
+// tokenFromRequest returns the token a request was authenticated with, or nil if authentication is disabled
+func tokenFromRequest(r *http.Request) *Token {
+	t, _ := r.Context().Value(tokenKey{}).(*Token)
+	return t
+}
+
+// bearerToken extracts the token from the Authorization header
+// On /api/ws the access_token query parameter is accepted as well, as browser WebSockets can't set headers
+// Other routes ignore it, so tokens don't end up in URLs logged by proxies
+func bearerToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, _ := strings.Cut(header, " ")
+		if strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+	if r.URL.Path == "/api/ws" {
+		return r.URL.Query().Get("access_token")
+	}
+	return ""
+}
+
+// authMiddleware requires a valid bearer token with at least the given role
+// If auth is nil authentication is disabled and every request passes
+func authMiddleware(auth *Authenticator, role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if auth == nil {
+			next(w, r)
+			return
+		}
+
+		token, err := auth.Authenticate(bearerToken(r))
+		if err == nil {
+			err = token.Authorize(permission{role: role})
+		}
+		if err != nil {
+			status := authStatus(err)
+			if status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="kvapi"`)
+			}
+			logMessage(r.Method, r.URL.Path, clientIdentity(r), err.Error(), true, status)
+			sendJSONResponse(w, status, err.Error(), "", "", nil)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), tokenKey{}, token)))
+	}
+}
+
+// authorizeRequest checks that the token of an authenticated request grants p
+// Writes a 403 response and returns false if it doesn't
+func authorizeRequest(w http.ResponseWriter, r *http.Request, ipStr string, p permission) bool {
+	token := tokenFromRequest(r)
+	if token == nil {
+		return true
+	}
+	if err := token.Authorize(p); err != nil {
+		logMessage(r.Method, r.URL.Path, ipStr, err.Error(), true, http.StatusForbidden)
+		sendJSONResponse(w, http.StatusForbidden, err.Error(), "", "", nil)
+		return false
+	}
+	return true
+}
+
+// watchPermission returns the permission needed to watch the keys selected by filter
+func watchPermission(filter WatchFilter) permission {
+	if filter.Key != "" {
+		return permission{role: RoleRead, keys: []string{filter.Key}}
+	}
+	return permission{role: RoleRead, listing: true, prefix: filter.Prefix}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestTokenAuthorize checks the role and key prefix enforcement of tokens
+func TestTokenAuthorize(t *testing.T) {
+	reader := &Token{Name: "reader", Role: RoleRead}
+	writer := &Token{Name: "writer", Role: RoleWrite, Prefixes: []string{"app/", "cache/"}}
+	admin := &Token{Name: "admin", Role: RoleAdmin}
+
+	tests := []struct {
+		name    string
+		token   *Token
+		command string
+		allowed bool
+	}{
+		{"open command", reader, "PING", true},
+		{"read with read role", reader, "GET app/a", true},
+		{"write with read role", reader, "SET app/a 1", false},
+		{"status with write role", writer, "STATUS", false},
+		{"status with admin role", admin, "STATUS", true},
+		{"write inside prefix", writer, "SET app/a 1", true},
+		{"write outside prefix", writer, "SET other/a 1", false},
+		{"read inside prefix", writer, "GET cache/x", true},
+		{"one key outside prefix", writer, "MGET app/a other/b", false},
+		{"mset values are not keys", writer, "MSET app/a other/b cache/c 1", true},
+		{"mset key outside prefix", writer, "MSET app/a 1 other/b 2", false},
+		{"delete outside prefix", writer, "DEL app/a other/b", false},
+		{"list everything without prefixes", reader, "KEYS *", true},
+		{"list everything with prefixes", writer, "KEYS *", false},
+		{"list within prefix", writer, "KEYS app/*", true},
+		{"list pattern escaping the prefix", writer, "KEYS app*", false},
+		{"list pattern with a class before the prefix", writer, "KEYS [a]pp/*", false},
+		{"scan with prefix", writer, "SCAN 0 PREFIX cache/ COUNT 10", true},
+		{"scan with match", writer, "SCAN 0 MATCH app/?", true},
+		{"scan outside prefix", writer, "SCAN 0 MATCH other/*", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.token.Authorize(commandPermission(strings.Fields(tt.command)))
+			if tt.allowed {
+				if err != nil {
+					t.Fatalf("%s refused to %s: %v", tt.command, tt.token.Name, err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrForbidden) {
+				t.Fatalf("%s allowed to %s, want ErrForbidden", tt.command, tt.token.Name)
+			}
+		})
+	}
+}
+
+// TestLiteralPrefix checks the part of a listing pattern that is matched literally
+func TestLiteralPrefix(t *testing.T) {
+	tests := []struct {
+		pattern string
+		prefix  string
+	}{
+		{"", ""},
+		{"app/key", "app/key"},
+		{"app/*", "app/"},
+		{"app/?x", "app/"},
+		{"app/[ab]*", "app/"},
+		{`app/\*`, "app/"},
+		{"*app", ""},
+	}
+
+	for _, tt := range tests {
+		if got := literalPrefix(tt.pattern); got != tt.prefix {
+			t.Errorf("literalPrefix(%q) = %q, want %q", tt.pattern, got, tt.prefix)
+		}
+	}
+}
+
+// TestBearerToken checks where a request may carry its token
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		url    string
+		header string
+		token  string
+	}{
+		{"bearer header", "/api/get?key=a", "Bearer secret", "secret"},
+		{"other scheme", "/api/get?key=a", "Basic c2VjcmV0", ""},
+		{"query parameter on a WebSocket", "/api/ws?access_token=secret", "", "secret"},
+		{"query parameter elsewhere", "/api/get?key=a&access_token=secret", "", ""},
+		{"header wins over query parameter", "/api/ws?access_token=other", "Bearer secret", "secret"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			if got := bearerToken(r); got != tt.token {
+				t.Fatalf("bearerToken = %q, want %q", got, tt.token)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Batch limits
+const (
+	MaxBatchSize     = 1000     // Maximum number of keys in a single MGET or MSET
+	MaxBatchBodySize = 64 << 20 // Maximum size of a JSON batch request body in bytes
+)
+
+// BatchItem is a single key of an MSET request
+type BatchItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	TTL   int64  `json:"ttl,omitempty"` // Time to live in seconds (0 means the key never expires)
+}
+
+// BatchValue is a single key of an MGET response
+type BatchValue struct {
+	Value   string `json:"value"`
+	Version uint64 `json:"version"`
+	TTL     int64  `json:"ttl_remaining,omitempty"`
+}
+
+// MGetResult is the result of an MGET
+type MGetResult struct {
+	Items   map[string]BatchValue `json:"items"`
+	Missing []string              `json:"missing"` // Requested keys that don't exist
+}
+
+// MSetResult is the result of an MSET
+type MSetResult struct {
+	Count   int    `json:"count"`
+	Version uint64 `json:"version"` // Version shared by every key written by the batch
+}
+
+// MGet retrieves several keys at once under a single lock
+func (kvs *KeyValueStore) MGet(keys []string) (MGetResult, error) {
+	if len(keys) == 0 {
+		return MGetResult{}, fmt.Errorf("no keys given")
+	}
+	if len(keys) > MaxBatchSize {
+		return MGetResult{}, fmt.Errorf("too many keys: a batch may hold at most %d keys", MaxBatchSize)
+	}
+
+	now := time.Now()
+	result := MGetResult{Items: make(map[string]BatchValue), Missing: []string{}}
+
+	// LRU and LFU eviction record every access, which needs the write lock
+	tracksAccess := kvs.tracksAccess()
+	if tracksAccess {
+		kvs.mu.Lock()
+		defer kvs.mu.Unlock()
+	} else {
+		kvs.mu.RLock()
+		defer kvs.mu.RUnlock()
+	}
+
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		entry, exists := kvs.store[key]
+		if !exists || entry.expired(now) {
+			result.Missing = append(result.Missing, key)
+			continue
+		}
+
+		if tracksAccess {
+			kvs.touchLocked(key, entry, now)
+		}
+		result.Items[key] = BatchValue{Value: entry.value, Version: entry.version, TTL: ttlSeconds(entry.ttlRemaining(now))}
+	}
+
+	return result, nil
+}
+
+// MSet stores several keys at once
+// Either every key is written or, if any key is invalid or the batch doesn't fit
+// the limits, none of them is; all keys share the version of the batch
+// Existing keys keep their memcached flags
+func (kvs *KeyValueStore) MSet(items []BatchItem) (MSetResult, error) {
+	if len(items) == 0 {
+		return MSetResult{}, fmt.Errorf("no items given")
+	}
+	if len(items) > MaxBatchSize {
+		return MSetResult{}, fmt.Errorf("too many items: a batch may hold at most %d keys", MaxBatchSize)
+	}
+
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+
+	now := time.Now()
+	entries := make(map[string]storeEntry, len(items))
+	var order []string
+
+	// Validate the whole batch before touching the store
+	for _, item := range items {
+		if err := kvs.validateItemLocked(item); err != nil {
+			return MSetResult{}, err
+		}
+
+		entry := storeEntry{value: item.Value, lastAccess: now, hits: 1}
+		if item.TTL > 0 {
+			entry.expiresAt = now.Add(time.Duration(item.TTL) * time.Second)
+		}
+		if current, exists := kvs.store[item.Key]; exists && !current.expired(now) {
+			entry.hits = current.hits + 1
+			entry.flags = current.flags
+		}
+
+		// A later item for the same key wins
+		if _, seen := entries[item.Key]; !seen {
+			order = append(order, item.Key)
+		}
+		entries[item.Key] = entry
+	}
+
+	if err := kvs.batchLimitErrorLocked(entries, nil); err != nil {
+		kvs.removeExpiredLocked(now)
+		if kvs.eviction == EvictionNone {
+			err = kvs.batchLimitErrorLocked(entries, nil)
+		} else {
+			err = kvs.evictBatchLocked(entries, nil)
+		}
+		if err != nil {
+			return MSetResult{}, err
+		}
+	}
+
+	// The batch is logged as a single record so it is replayed all or nothing
+	version := kvs.revision + 1
+	records := make([]logRecord, 0, len(order))
+	for _, key := range order {
+		entry := entries[key]
+		entry.version = version
+		entries[key] = entry
+		records = append(records, setRecord(key, entry))
+	}
+	if err := kvs.logMutationLocked(logRecord{Op: OpBatch, Version: version, Records: records}); err != nil {
+		return MSetResult{}, err
+	}
+
+	kvs.revision = version
+	events := make([]WatchEvent, 0, len(order))
+	for _, key := range order {
+		kvs.putLocked(key, entries[key])
+		events = append(events, setEvent(key, entries[key], now))
+	}
+	kvs.publishLocked(events...)
+
+	return MSetResult{Count: len(order), Version: version}, nil
+}
+
+// validateItemLocked checks a batch item against the key and value size limits
+// The caller must hold at least the read lock
+func (kvs *KeyValueStore) validateItemLocked(item BatchItem) error {
+	if item.Key == "" {
+		return fmt.Errorf("missing key in batch")
+	}
+	if len([]byte(item.Key)) > kvs.limits.MaxKeySize {
+		return fmt.Errorf("key '%s' exceeds maximum size of %d bytes", item.Key, kvs.limits.MaxKeySize)
+	}
+	if len([]byte(item.Value)) > kvs.limits.MaxValueSize {
+		return fmt.Errorf("value of key '%s' exceeds maximum size of %d bytes", item.Key, kvs.limits.MaxValueSize)
+	}
+	if item.TTL < 0 {
+		return fmt.Errorf("ttl of key '%s' must not be negative", item.Key)
+	}
+	if item.TTL > MaxTTLSeconds {
+		return fmt.Errorf("ttl of key '%s' is too large: must be at most %d seconds", item.Key, MaxTTLSeconds)
+	}
+	return nil
+}
+
+// batchLimitErrorLocked returns the limit that storing all entries would exceed, if any
+// Keys in without are treated as already removed from the store
+// The caller must hold at least the read lock
+func (kvs *KeyValueStore) batchLimitErrorLocked(entries map[string]storeEntry, without map[string]bool) error {
+	count := len(kvs.store)
+	used := kvs.used
+	added := 0
+	for k := range without {
+		if current, exists := kvs.store[k]; exists {
+			count--
+			used -= current.size(k)
+		}
+	}
+
+	for k, entry := range entries {
+		if current, exists := kvs.store[k]; exists && !without[k] {
+			used -= current.size(k)
+		} else {
+			added++
+		}
+		used += entry.size(k)
+	}
+
+	if added > 0 && count+added > kvs.limits.MaxKeyCount {
+		return fmt.Errorf("maximum number of keys (%d) reached", kvs.limits.MaxKeyCount)
+	}
+	if kvs.limits.MaxMemory > 0 && used > kvs.limits.MaxMemory {
+		return fmt.Errorf("memory limit of %d bytes reached", kvs.limits.MaxMemory)
+	}
+	return nil
+}
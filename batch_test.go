@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestMSetKeepsFlags checks that a batch keeps the memcached flags of existing keys
+func TestMSetKeepsFlags(t *testing.T) {
+	kvs := NewKeyValueStore(DefaultLimits())
+	if _, err := kvs.SetWithFlags("flagged", "old", 42, time.Hour, SetCondition{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := kvs.MSet([]BatchItem{{Key: "flagged", Value: "new"}, {Key: "fresh", Value: "1"}}); err != nil {
+		t.Fatalf("MSet: %v", err)
+	}
+
+	tests := []struct {
+		key   string
+		value string
+		flags uint32
+	}{
+		{"flagged", "new", 42},
+		{"fresh", "1", 0},
+	}
+	for _, tt := range tests {
+		item, exists := kvs.GetItem(tt.key)
+		if !exists || item.Value != tt.value || item.Flags != tt.flags {
+			t.Errorf("key '%s' = %+v, %v; want value %q with flags %d", tt.key, item, exists, tt.value, tt.flags)
+		}
+	}
+}
@@ -3,14 +3,23 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -28,16 +37,32 @@ type Response struct {
 	Message   string                 `json:"message"`
 	Key       string                 `json:"key,omitempty"`
 	Value     string                 `json:"value,omitempty"`
+	Version   uint64                 `json:"version,omitempty"`
+	TTL       int64                  `json:"ttl_remaining,omitempty"`
 	Data      map[string]interface{} `json:"data,omitempty"`
 	Timestamp string                 `json:"timestamp"`
 }
 
 // Options holds the client configuration
 type Options struct {
-	Host     string
-	Port     int
-	Protocol string
-	Timeout  time.Duration
+	Host      string
+	Port      int
+	Socket    string // Unix socket path; when set, HTTP requests go over it instead of TCP
+	TLS       bool   // Use HTTPS
+	CAFile    string // CA bundle used to verify the server instead of the system roots
+	CertFile  string // Client certificate for mutual TLS
+	KeyFile   string
+	Token     string // API token sent as a bearer token over HTTP or as an AUTH prefix over UDP
+	Secret    string // Shared secret used to sign UDP datagrams
+	Protocol  string
+	Timeout   time.Duration
+	TTL       int
+	IfVersion uint64
+	NX        bool
+	XX        bool
+	Prefix    string
+	Limit     int
+	Cursor    string
 }
 
 func main() {
@@ -45,7 +70,21 @@ func main() {
 	protocol := flag.String("protocol", "http", "Protocol to use (http or udp)")
 	host := flag.String("host", "localhost", "Server hostname or IP address")
 	port := flag.Int("port", 8080, "Server port")
+	useTLS := flag.Bool("tls", false, "Connect over HTTPS")
+	caFile := flag.String("ca", "", "Path of a PEM CA bundle used to verify the server certificate (default: system roots)")
+	certFile := flag.String("cert", "", "Path of a PEM client certificate for mutual TLS")
+	keyFile := flag.String("key", "", "Path of the PEM private key for -cert")
+	token := flag.String("token", "", "API token for servers started with --token-file (env: KVAPI_TOKEN)")
+	secret := flag.String("secret", "", "Shared secret for servers started with --udp-secret; UDP datagrams are signed with it (env: KVAPI_UDP_SECRET)")
+	socket := flag.String("socket", "", "Path of the server's Unix socket; if set, HTTP requests are sent over it instead of -host and -port")
 	timeout := flag.Float64("timeout", 2.0, "Timeout in seconds")
+	ttl := flag.Int("ttl", 0, "Time to live in seconds for SET and MSET (0 means the key never expires)")
+	ifVersion := flag.Uint64("if-version", 0, "Only SET if the key currently has this version (0 disables the check)")
+	nx := flag.Bool("nx", false, "Only SET if the key does not exist yet")
+	xx := flag.Bool("xx", false, "Only SET if the key already exists")
+	prefix := flag.String("prefix", "", "Only list keys starting with this prefix (KEYS)")
+	limit := flag.Int("limit", 0, "Maximum number of keys to list per page, 0 for the server default (KEYS)")
+	cursor := flag.String("cursor", "", "Cursor returned by a previous KEYS call to fetch the next page (KEYS)")
 	showVersion := flag.Bool("version", false, "Show version information and exit")
 
 	flag.Usage = func() {
@@ -58,11 +97,31 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  STATUS                      Get server status information\n")
 		fmt.Fprintf(os.Stderr, "  GET <key>                   Retrieve a value by key\n")
 		fmt.Fprintf(os.Stderr, "  SET <key> <value>           Set a key-value pair\n")
+		fmt.Fprintf(os.Stderr, "  DEL <key>                   Delete a key\n")
+		fmt.Fprintf(os.Stderr, "  INCR <key> [amount]         Atomically increment an integer value (default 1)\n")
+		fmt.Fprintf(os.Stderr, "  DECR <key> [amount]         Atomically decrement an integer value (default 1)\n")
+		fmt.Fprintf(os.Stderr, "  INCRBY <key> <amount>       Atomically add an amount to an integer value\n")
+		fmt.Fprintf(os.Stderr, "  MGET <key> [key...]         Retrieve several keys at once\n")
+		fmt.Fprintf(os.Stderr, "  MSET <key> <value> [...]    Set several key-value pairs at once, all or nothing\n")
+		fmt.Fprintf(os.Stderr, "  KEYS [pattern]              List keys, optionally matching a glob pattern\n")
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
 		fmt.Fprintf(os.Stderr, "  kvclient PING\n")
 		fmt.Fprintf(os.Stderr, "  kvclient -protocol=udp -port=4000 STATUS\n")
+		fmt.Fprintf(os.Stderr, "  kvclient -socket=/run/kvapi.sock GET mykey\n")
+		fmt.Fprintf(os.Stderr, "  kvclient -tls -ca=ca.pem -cert=client.pem -key=client-key.pem GET mykey\n")
+		fmt.Fprintf(os.Stderr, "  kvclient -token=s3cr3t SET mykey myvalue\n")
+		fmt.Fprintf(os.Stderr, "  kvclient -protocol=udp -port=4000 -secret=sharedkey GET mykey\n")
 		fmt.Fprintf(os.Stderr, "  kvclient GET mykey\n")
 		fmt.Fprintf(os.Stderr, "  kvclient SET greeting \"Hello, World!\"\n")
+		fmt.Fprintf(os.Stderr, "  kvclient -ttl=60 SET session abc123\n")
+		fmt.Fprintf(os.Stderr, "  kvclient -if-version=7 SET counter 42\n")
+		fmt.Fprintf(os.Stderr, "  kvclient DEL greeting\n")
+		fmt.Fprintf(os.Stderr, "  kvclient INCR visits\n")
+		fmt.Fprintf(os.Stderr, "  kvclient DECR stock 5\n")
+		fmt.Fprintf(os.Stderr, "  kvclient MSET host db1 port 5432\n")
+		fmt.Fprintf(os.Stderr, "  kvclient MGET host port\n")
+		fmt.Fprintf(os.Stderr, "  kvclient -prefix=user: -limit=50 KEYS\n")
+		fmt.Fprintf(os.Stderr, "  kvclient KEYS \"session:*\"\n")
 		fmt.Fprintf(os.Stderr, "\nBuild time: %s\n", BuildTime)
 	}
 	flag.Parse()
@@ -82,6 +141,45 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Validate socket
+	if *socket != "" && *protocol != "http" {
+		fmt.Fprintf(os.Stderr, "Error: -socket can only be used with the http protocol\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Validate TLS options
+	if *useTLS && (*protocol != "http" || *socket != "") {
+		fmt.Fprintf(os.Stderr, "Error: -tls can only be used with the http protocol over TCP\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if !*useTLS && (*caFile != "" || *certFile != "" || *keyFile != "") {
+		fmt.Fprintf(os.Stderr, "Error: -ca, -cert and -key require -tls\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if (*certFile == "") != (*keyFile == "") {
+		fmt.Fprintf(os.Stderr, "Error: -cert and -key must be set together\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Fall back to the token from the environment, which keeps it out of the process list
+	if *token == "" {
+		*token = os.Getenv("KVAPI_TOKEN")
+	}
+
+	// Validate secret
+	if *secret == "" {
+		*secret = os.Getenv("KVAPI_UDP_SECRET")
+	}
+	if *secret != "" && *protocol != "udp" {
+		fmt.Fprintf(os.Stderr, "Error: -secret can only be used with the udp protocol\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
 	// Validate port
 	if *port < 1 || *port > 65535 {
 		fmt.Fprintf(os.Stderr, "Error: Port must be between 1 and 65535\n")
@@ -89,12 +187,47 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Validate TTL
+	if *ttl < 0 {
+		fmt.Fprintf(os.Stderr, "Error: TTL must not be negative\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Validate write conditions
+	if *nx && (*xx || *ifVersion != 0) {
+		fmt.Fprintf(os.Stderr, "Error: -nx cannot be combined with -xx or -if-version\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Validate limit
+	if *limit < 0 {
+		fmt.Fprintf(os.Stderr, "Error: Limit must not be negative\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
 	// Set up client options
 	opts := Options{
-		Host:     *host,
-		Port:     *port,
-		Protocol: *protocol,
-		Timeout:  time.Duration(*timeout * float64(time.Second)),
+		Host:      strings.TrimSuffix(strings.TrimPrefix(*host, "["), "]"), // Accept IPv6 literals with or without brackets
+		Port:      *port,
+		Socket:    *socket,
+		TLS:       *useTLS,
+		CAFile:    *caFile,
+		CertFile:  *certFile,
+		KeyFile:   *keyFile,
+		Token:     *token,
+		Secret:    *secret,
+		Protocol:  *protocol,
+		Timeout:   time.Duration(*timeout * float64(time.Second)),
+		TTL:       *ttl,
+		IfVersion: *ifVersion,
+		NX:        *nx,
+		XX:        *xx,
+		Prefix:    *prefix,
+		Limit:     *limit,
+		Cursor:    *cursor,
 	}
 
 	// Parse command
@@ -112,8 +245,16 @@ func main() {
 	var response *Response
 	var err error
 
-	fmt.Printf("🔌 Key-Value Client v%s connecting to %s server at %s:%d...\n",
-		Version, strings.ToUpper(*protocol), *host, *port)
+	serverProtocol := strings.ToUpper(*protocol)
+	if *useTLS {
+		serverProtocol = "HTTPS"
+	}
+	serverAddr := net.JoinHostPort(*host, strconv.Itoa(*port))
+	if *socket != "" {
+		serverAddr = *socket
+	}
+	fmt.Printf("🔌 Key-Value Client v%s connecting to %s server at %s...\n",
+		Version, serverProtocol, serverAddr)
 
 	switch command {
 	case "PING":
@@ -135,6 +276,64 @@ func main() {
 		}
 		value := strings.Join(cmdArgs[1:], " ")
 		response, err = set(opts, cmdArgs[0], value)
+	case "DEL", "DELETE":
+		if len(cmdArgs) < 1 {
+			fmt.Fprintf(os.Stderr, "Error: DEL command requires a key\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		response, err = del(opts, cmdArgs[0])
+	case "INCR", "DECR", "INCRBY":
+		if len(cmdArgs) < 1 {
+			fmt.Fprintf(os.Stderr, "Error: %s command requires a key\n", command)
+			flag.Usage()
+			os.Exit(1)
+		}
+		if command == "INCRBY" && len(cmdArgs) < 2 {
+			fmt.Fprintf(os.Stderr, "Error: INCRBY command requires a key and an amount\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		delta := int64(1)
+		if len(cmdArgs) > 1 {
+			delta, err = strconv.ParseInt(cmdArgs[1], 10, 64)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: Amount must be a 64-bit integer\n")
+				os.Exit(1)
+			}
+		}
+		if command == "DECR" {
+			if delta == math.MinInt64 {
+				fmt.Fprintf(os.Stderr, "Error: Amount is out of range\n")
+				os.Exit(1)
+			}
+			delta = -delta
+		}
+		response, err = incr(opts, cmdArgs[0], delta)
+	case "MGET":
+		if len(cmdArgs) < 1 {
+			fmt.Fprintf(os.Stderr, "Error: MGET command requires at least one key\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		response, err = mget(opts, cmdArgs)
+	case "MSET":
+		if len(cmdArgs) < 2 || len(cmdArgs)%2 != 0 {
+			fmt.Fprintf(os.Stderr, "Error: MSET command requires key value pairs\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if opts.Protocol == "udp" && opts.TTL > 0 {
+			fmt.Fprintf(os.Stderr, "Error: -ttl is not supported for MSET over UDP\n")
+			os.Exit(1)
+		}
+		response, err = mset(opts, cmdArgs)
+	case "KEYS":
+		pattern := ""
+		if len(cmdArgs) > 0 {
+			pattern = cmdArgs[0]
+		}
+		response, err = keys(opts, pattern)
 	default:
 		fmt.Fprintf(os.Stderr, "Error: Unknown command: %s\n", command)
 		flag.Usage()
@@ -180,21 +379,146 @@ func get(opts Options, key string) (*Response, error) {
 // set sets a key-value pair
 func set(opts Options, key, value string) (*Response, error) {
 	if opts.Protocol == "udp" {
-		return sendUDPCommand(opts, fmt.Sprintf("SET %s %s", key, value))
+		// Options go before the value, and "--" keeps a value starting with an option name from being read as one
+		command := fmt.Sprintf("SET %s", key)
+		if opts.TTL > 0 {
+			command += fmt.Sprintf(" EX %d", opts.TTL)
+		}
+		if opts.IfVersion > 0 {
+			command += fmt.Sprintf(" VERSION %d", opts.IfVersion)
+		}
+		if opts.NX {
+			command += " NX"
+		}
+		if opts.XX {
+			command += " XX"
+		}
+		command += " -- " + value
+		return sendUDPCommand(opts, command)
 	}
 
 	params := url.Values{}
 	params.Set("k", key)
 	params.Set("v", value)
+	if opts.TTL > 0 {
+		params.Set("ttl", strconv.Itoa(opts.TTL))
+	}
+	if opts.IfVersion > 0 {
+		params.Set("version", strconv.FormatUint(opts.IfVersion, 10))
+	}
+	if opts.NX {
+		params.Set("nx", "true")
+	}
+	if opts.XX {
+		params.Set("xx", "true")
+	}
 	return sendHTTPRequest(opts, "set", "POST", params)
 }
 
+// del deletes a key
+func del(opts Options, key string) (*Response, error) {
+	if opts.Protocol == "udp" {
+		return sendUDPCommand(opts, fmt.Sprintf("DEL %s", key))
+	}
+
+	params := url.Values{}
+	params.Set("k", key)
+	return sendHTTPRequest(opts, "delete", "DELETE", params)
+}
+
+// incr atomically adds delta to an integer value
+func incr(opts Options, key string, delta int64) (*Response, error) {
+	if opts.Protocol == "udp" {
+		return sendUDPCommand(opts, fmt.Sprintf("INCRBY %s %d", key, delta))
+	}
+
+	params := url.Values{}
+	params.Set("k", key)
+	params.Set("by", strconv.FormatInt(delta, 10))
+	return sendHTTPRequest(opts, "incr", "POST", params)
+}
+
+// mget retrieves several keys at once
+func mget(opts Options, keys []string) (*Response, error) {
+	if opts.Protocol == "udp" {
+		return sendUDPCommand(opts, "MGET "+strings.Join(keys, " "))
+	}
+
+	return sendHTTPJSONRequest(opts, "mget", "POST", map[string][]string{"keys": keys})
+}
+
+// mset sets several key-value pairs at once, all or nothing
+func mset(opts Options, pairs []string) (*Response, error) {
+	if opts.Protocol == "udp" {
+		return sendUDPCommand(opts, "MSET "+strings.Join(pairs, " "))
+	}
+
+	type item struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		TTL   int    `json:"ttl,omitempty"`
+	}
+	items := make([]item, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		items = append(items, item{Key: pairs[i], Value: pairs[i+1], TTL: opts.TTL})
+	}
+	return sendHTTPJSONRequest(opts, "mset", "POST", map[string]interface{}{"items": items})
+}
+
+// keys lists keys, optionally filtered by prefix and glob pattern
+func keys(opts Options, pattern string) (*Response, error) {
+	if opts.Protocol == "udp" {
+		cursor := opts.Cursor
+		if cursor == "" {
+			cursor = "0"
+		}
+		command := fmt.Sprintf("SCAN %s", cursor)
+		if pattern != "" {
+			command += fmt.Sprintf(" MATCH %s", pattern)
+		}
+		if opts.Prefix != "" {
+			command += fmt.Sprintf(" PREFIX %s", opts.Prefix)
+		}
+		if opts.Limit > 0 {
+			command += fmt.Sprintf(" COUNT %d", opts.Limit)
+		}
+		return sendUDPCommand(opts, command)
+	}
+
+	params := url.Values{}
+	if pattern != "" {
+		params.Set("match", pattern)
+	}
+	if opts.Prefix != "" {
+		params.Set("prefix", opts.Prefix)
+	}
+	if opts.Limit > 0 {
+		params.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Cursor != "" {
+		params.Set("cursor", opts.Cursor)
+	}
+	return sendHTTPRequest(opts, "keys", "GET", params)
+}
+
 // sendUDPCommand sends a command to the UDP server
 func sendUDPCommand(opts Options, command string) (*Response, error) {
 	fmt.Printf("📤 Sending UDP command: %s\n", command)
 
+	// The token is only added now so that it isn't printed
+	if opts.Token != "" {
+		command = fmt.Sprintf("AUTH %s %s", opts.Token, command)
+	}
+	if opts.Secret != "" {
+		signed, err := signCommand(opts.Secret, command)
+		if err != nil {
+			return nil, err
+		}
+		command = signed
+	}
+
 	// Create UDP address
-	addr := fmt.Sprintf("%s:%d", opts.Host, opts.Port)
+	addr := net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port))
 	udpAddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to resolve address: %w", err)
@@ -217,7 +541,8 @@ func sendUDPCommand(opts Options, command string) (*Response, error) {
 	}
 
 	// Receive response
-	buffer := make([]byte, 8192)
+	// Replies can be as large as a UDP datagram
+	buffer := make([]byte, 64*1024)
 	n, _, err := conn.ReadFromUDP(buffer)
 	if err != nil {
 		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
@@ -236,18 +561,33 @@ func sendUDPCommand(opts Options, command string) (*Response, error) {
 	return &response, nil
 }
 
+// signCommand wraps a UDP command as "SIG <timestamp> <nonce> <signature> <command>"
+// The signature is the HMAC-SHA256 of "<timestamp> <nonce> <command>" with the shared secret
+func signCommand(secret, command string) (string, error) {
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+	timestamp := time.Now().Unix()
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d %s %s", timestamp, nonce, command)
+	return fmt.Sprintf("SIG %d %s %s %s", timestamp, nonce, hex.EncodeToString(mac.Sum(nil)), command), nil
+}
+
 // sendHTTPRequest sends a request to the HTTP server
 func sendHTTPRequest(opts Options, endpoint string, method string, params url.Values) (*Response, error) {
 	// Create base URL
-	baseURL := fmt.Sprintf("http://%s:%d/api/%s", opts.Host, opts.Port, endpoint)
+	baseURL := apiURL(opts, endpoint)
 
 	// Create request
 	var req *http.Request
 	var err error
 
 	if params != nil {
-		if method == "GET" {
-			// For GET, append parameters to URL
+		if method == "GET" || method == "DELETE" {
+			// For GET and DELETE, append parameters to URL
 			reqURL := fmt.Sprintf("%s?%s", baseURL, params.Encode())
 			fmt.Printf("📤 Sending HTTP %s request: %s\n", method, reqURL)
 			req, err = http.NewRequest(method, reqURL, nil)
@@ -266,11 +606,96 @@ func sendHTTPRequest(opts Options, endpoint string, method string, params url.Va
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
+	return doHTTPRequest(opts, req)
+}
+
+// sendHTTPJSONRequest sends a request with a JSON body to the HTTP server
+func sendHTTPJSONRequest(opts Options, endpoint string, method string, body interface{}) (*Response, error) {
+	reqURL := apiURL(opts, endpoint)
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	fmt.Printf("📤 Sending HTTP %s request to %s with body: %s\n", method, reqURL, data)
+	req, err := http.NewRequest(method, reqURL, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return doHTTPRequest(opts, req)
+}
+
+// apiURL returns the URL of an API endpoint
+// Over a Unix socket the host part is only a placeholder, as the socket path selects the server
+func apiURL(opts Options, endpoint string) string {
+	if opts.Socket != "" {
+		return fmt.Sprintf("http://unix/api/%s", endpoint)
+	}
+	scheme := "http"
+	if opts.TLS {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/api/%s", scheme, net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port)), endpoint)
+}
+
+// tlsConfig builds the client TLS configuration from the -ca, -cert and -key options
+func tlsConfig(opts Options) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", opts.CAFile)
+		}
+	}
+
+	if opts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// doHTTPRequest sends a prepared request and parses the JSON response
+func doHTTPRequest(opts Options, req *http.Request) (*Response, error) {
+	if opts.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+opts.Token)
+	}
+
 	// Create HTTP client with timeout
 	client := &http.Client{
 		Timeout: opts.Timeout,
 	}
 
+	if opts.TLS {
+		cfg, err := tlsConfig(opts)
+		if err != nil {
+			return nil, err
+		}
+		client.Transport = &http.Transport{TLSClientConfig: cfg}
+	}
+
+	// Connect to the Unix socket instead of resolving the placeholder host
+	if opts.Socket != "" {
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", opts.Socket)
+			},
+		}
+	}
+
 	// Send request
 	resp, err := client.Do(req)
 	if err != nil {
@@ -335,6 +760,12 @@ func printResponse(resp *Response) {
 	if resp.Value != "" {
 		fmt.Printf("Value: %s\n", resp.Value)
 	}
+	if resp.Version > 0 {
+		fmt.Printf("Version: %d\n", resp.Version)
+	}
+	if resp.TTL > 0 {
+		fmt.Printf("TTL remaining: %ds\n", resp.TTL)
+	}
 
 	// Print data if present
 	if resp.Data != nil && len(resp.Data) > 0 {
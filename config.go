@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Default resource limits used when nothing else is configured
+const (
+	DefaultMaxKeySize   = 255     // Maximum key size in bytes
+	DefaultMaxValueSize = 1048576 // Maximum value size in bytes (1MB)
+	DefaultMaxKeyCount  = 100     // Maximum number of keys allowed
+	DefaultMaxMemory    = 0       // Maximum total size of keys and values in bytes (0 means unlimited)
+)
+
+// Limits holds the resource limits enforced by the store
+type Limits struct {
+	MaxKeySize   int   `json:"max_key_size"`
+	MaxValueSize int   `json:"max_value_size"`
+	MaxKeyCount  int   `json:"max_keys"`
+	MaxMemory    int64 `json:"max_memory_bytes"`
+}
+
+// DefaultLimits returns the built-in resource limits
+func DefaultLimits() Limits {
+	return Limits{
+		MaxKeySize:   DefaultMaxKeySize,
+		MaxValueSize: DefaultMaxValueSize,
+		MaxKeyCount:  DefaultMaxKeyCount,
+		MaxMemory:    DefaultMaxMemory,
+	}
+}
+
+// Validate checks that the limits are usable
+func (l Limits) Validate() error {
+	if l.MaxKeySize <= 0 {
+		return fmt.Errorf("maximum key size must be positive")
+	}
+	if l.MaxValueSize <= 0 {
+		return fmt.Errorf("maximum value size must be positive")
+	}
+	if l.MaxKeyCount <= 0 {
+		return fmt.Errorf("maximum number of keys must be positive")
+	}
+	if l.MaxMemory < 0 {
+		return fmt.Errorf("maximum memory must not be negative")
+	}
+	return nil
+}
+
+// Config holds the settings that can be provided through a config file
+// Fields missing from the file keep their previous values
+type Config struct {
+	Limits
+	Eviction string `json:"eviction"` // Eviction policy applied when the store is full
+}
+
+// loadConfigFile reads a JSON config file on top of cfg
+func loadConfigFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	return nil
+}
+
+// applyEnvConfig overrides cfg with any KVAPI_* environment variables that are set
+func applyEnvConfig(cfg *Config) error {
+	intVars := map[string]*int{
+		"KVAPI_MAX_KEYS":       &cfg.MaxKeyCount,
+		"KVAPI_MAX_KEY_SIZE":   &cfg.MaxKeySize,
+		"KVAPI_MAX_VALUE_SIZE": &cfg.MaxValueSize,
+	}
+	for name, target := range intVars {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid value '%s' for %s: must be an integer", value, name)
+		}
+		*target = n
+	}
+
+	if value, ok := os.LookupEnv("KVAPI_MAX_MEMORY"); ok {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid value '%s' for KVAPI_MAX_MEMORY: must be an integer", value)
+		}
+		cfg.MaxMemory = n
+	}
+
+	if value, ok := os.LookupEnv("KVAPI_EVICTION"); ok {
+		cfg.Eviction = value
+	}
+
+	return nil
+}
+
+// flagWasSet reports whether the named command line flag was given explicitly
+func flagWasSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// Options holds the command line flags
+type Options struct {
+	Listen            string        // --listen
+	AllowedCIDR       string        // --allowed-cidr
+	Rules             []AccessRule  // --allow, --deny and --rule in command line order
+	AccessFile        string        // --access-file
+	FwDrop            bool          // --fw-drop
+	FwReject          bool          // --fw-reject
+	UDPMode           bool          // --udp
+	HTTPListen        string        // --http-listen
+	UnixSocket        string        // --unix-socket
+	UnixSocketMode    string        // --unix-socket-mode
+	UnixSocketOwner   string        // --unix-socket-owner
+	UnixSocketUsers   string        // --unix-socket-users
+	TLSCert           string        // --tls-cert
+	TLSKey            string        // --tls-key
+	TLSClientCA       string        // --tls-client-ca
+	TLSAllowedClients string        // --tls-allowed-clients
+	TokenFile         string        // --token-file
+	TrustedProxies    string        // --trusted-proxies
+	ProxyProtocol     bool          // --proxy-protocol
+	WSAllowedOrigins  string        // --ws-allowed-origins
+	UDPSecret         string        // --udp-secret
+	UDPListen         string        // --udp-listen
+	MemcacheListen    string        // --memcache-listen
+	RESPListen        string        // --resp-listen
+	SweepInterval     time.Duration // --sweep-interval
+	DataFile          string        // --data-file
+	SnapshotInterval  time.Duration // --snapshot-interval
+	AOFFile           string        // --aof-file
+	AOFFsync          string        // --aof-fsync
+	AOFMaxSize        int64         // --aof-max-size
+	ConfigFile        string        // --config
+	MaxKeys           int           // --max-keys
+	MaxKeySize        int           // --max-key-size
+	MaxValueSize      int           // --max-value-size
+	MaxMemory         int64         // --max-memory
+	Eviction          string        // --eviction
+	ShowVersion       bool          // --version
+	SimulateFirewall  bool          // --simulate-firewall
+}
+
+// registerFlags registers the command line flags and the usage message; the values are set by flag.Parse
+func registerFlags() *Options {
+	opts := &Options{}
+	flag.StringVar(&opts.Listen, "listen", ":8080", "Address and port to listen on (format: addr:port)")
+	flag.StringVar(&opts.AllowedCIDR, "allowed-cidr", "", "CIDR range for allowed IPs (e.g., 192.168.1.0/24). If not set, all IPs are allowed (same as a single --allow)")
+	flag.Var(ruleFlag{RuleAllow, &opts.Rules}, "allow", "Allow clients in this CIDR range or IP, IPv4 or IPv6 (repeatable, comma-separated). If any allow rule is set, other IPs are refused")
+	flag.Var(ruleFlag{RuleDeny, &opts.Rules}, "deny", "Deny clients in this CIDR range or IP, IPv4 or IPv6 (repeatable, comma-separated). Deny rules win over allow rules")
+	flag.Var(lineRuleFlag{&opts.Rules}, "rule", "Access rule in access file syntax, e.g. 'allow 10.1.2.0/24 /api/set SET mode=REJECT' to scope it to routes and commands (repeatable)")
+	flag.StringVar(&opts.AccessFile, "access-file", "", "Path of a file with one '<allow|deny> <cidr> [routes and commands] [mode=...]' rule per line, applied before --allow, --deny and --rule")
+	flag.BoolVar(&opts.FwDrop, "fw-drop", false, "If set, silently drops requests from non-allowed IPs (like a firewall DROP policy, with timeout)")
+	flag.BoolVar(&opts.FwReject, "fw-reject", false, "If set, actively rejects connections from non-allowed IPs (like a firewall REJECT policy)")
+	flag.BoolVar(&opts.UDPMode, "udp", false, "Serve UDP instead of HTTP on --listen (kept for compatibility, use --udp-listen to run both)")
+	flag.StringVar(&opts.HTTPListen, "http-listen", "", "Address and port of the HTTP listener. Defaults to --listen; set to an empty string to disable HTTP")
+	flag.StringVar(&opts.UnixSocket, "unix-socket", "", "Path of a Unix socket serving the HTTP API to local processes. If not set, it is disabled")
+	flag.StringVar(&opts.UnixSocketMode, "unix-socket-mode", "0660", "File mode of the Unix socket (octal)")
+	flag.StringVar(&opts.UnixSocketOwner, "unix-socket-owner", "", "Owner of the Unix socket as user[:group], by name or numeric id. If not set, the owner is not changed")
+	flag.StringVar(&opts.UnixSocketUsers, "unix-socket-users", "", "Comma-separated users (names or uids) allowed on the Unix socket. If not set, every user permitted by the file mode is allowed")
+	flag.StringVar(&opts.TLSCert, "tls-cert", "", "Path of the PEM certificate for serving HTTPS. Requires --tls-key; reloaded on SIGHUP")
+	flag.StringVar(&opts.TLSKey, "tls-key", "", "Path of the PEM private key for --tls-cert")
+	flag.StringVar(&opts.TLSClientCA, "tls-client-ca", "", "Path of a PEM CA bundle; if set, clients must present a certificate signed by it (mutual TLS)")
+	flag.StringVar(&opts.TLSAllowedClients, "tls-allowed-clients", "", "Comma-separated client certificate common names allowed with --tls-client-ca. If not set, every verified client is allowed")
+	flag.StringVar(&opts.TokenFile, "token-file", "", "Path of a JSON file listing API tokens with their roles and key prefixes. If not set, no authentication is required")
+	flag.StringVar(&opts.TrustedProxies, "trusted-proxies", "", "Comma-separated CIDR ranges or IPs of proxies whose X-Forwarded-For and Forwarded headers are trusted for the client IP")
+	flag.BoolVar(&opts.ProxyProtocol, "proxy-protocol", false, "Accept HAProxy PROXY protocol v1 and v2 headers from --trusted-proxies on the HTTP listener")
+	flag.StringVar(&opts.WSAllowedOrigins, "ws-allowed-origins", "", "Comma-separated origins (e.g., https://app.example.com) whose pages may open WebSockets without a token, besides the server's own; * allows any")
+	flag.StringVar(&opts.UDPSecret, "udp-secret", "", "Shared secret for HMAC-signed UDP datagrams; if set, unsigned, stale and replayed datagrams are rejected (env: KVAPI_UDP_SECRET)")
+	flag.StringVar(&opts.UDPListen, "udp-listen", "", "Address and port of an additional UDP listener (e.g., :4000). If not set, it is disabled")
+	flag.StringVar(&opts.MemcacheListen, "memcache-listen", "", "Address and port of an additional listener speaking the memcached ASCII protocol (e.g., :11211). If not set, it is disabled")
+	flag.StringVar(&opts.RESPListen, "resp-listen", "", "Address and port of an additional listener speaking the Redis RESP2 protocol (e.g., :6379). If not set, it is disabled")
+	flag.DurationVar(&opts.SweepInterval, "sweep-interval", time.Second, "Interval between background sweeps that remove expired keys")
+	flag.StringVar(&opts.DataFile, "data-file", "", "Path of the snapshot file used to persist data across restarts. If not set, data is kept in memory only")
+	flag.DurationVar(&opts.SnapshotInterval, "snapshot-interval", time.Minute, "Interval between periodic snapshots when --data-file is set")
+	flag.StringVar(&opts.AOFFile, "aof-file", "", "Path of the append-only log that records every write. If not set, writes are not logged")
+	flag.StringVar(&opts.AOFFsync, "aof-fsync", FsyncEverySec, "Fsync policy for the append-only log (always, everysec or never)")
+	flag.Int64Var(&opts.AOFMaxSize, "aof-max-size", 64*1024*1024, "Size in bytes after which the append-only log is compacted (0 disables compaction)")
+	flag.StringVar(&opts.ConfigFile, "config", "", "Path of a JSON config file with resource limits (overridden by KVAPI_* environment variables and flags)")
+	flag.IntVar(&opts.MaxKeys, "max-keys", DefaultMaxKeyCount, "Maximum number of keys allowed (env: KVAPI_MAX_KEYS)")
+	flag.IntVar(&opts.MaxKeySize, "max-key-size", DefaultMaxKeySize, "Maximum key size in bytes (env: KVAPI_MAX_KEY_SIZE)")
+	flag.IntVar(&opts.MaxValueSize, "max-value-size", DefaultMaxValueSize, "Maximum value size in bytes (env: KVAPI_MAX_VALUE_SIZE)")
+	flag.Int64Var(&opts.MaxMemory, "max-memory", DefaultMaxMemory, "Maximum total size of all keys and values in bytes, 0 means unlimited (env: KVAPI_MAX_MEMORY)")
+	flag.StringVar(&opts.Eviction, "eviction", EvictionNone, "Eviction policy when the store is full: noeviction, lru, lfu, random or volatile-ttl (env: KVAPI_EVICTION)")
+	flag.BoolVar(&opts.ShowVersion, "version", false, "Show version information and exit")
+
+	// For backward compatibility - to be deprecated
+	flag.BoolVar(&opts.SimulateFirewall, "simulate-firewall", false, "Deprecated: Please use --fw-drop instead")
+
+	// Override the default usage message
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Key-Value API Server version %s (%s)\n\n", Version, GitCommit)
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nBuild time: %s\n", BuildTime)
+	}
+
+	return opts
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// etagEpoch sets the entity tags of this process apart from those of earlier ones
+// Versions restart or roll back when writes are lost on restart, so a tag from before
+// could otherwise match a different value; it is cleared when every write is durable
+var etagEpoch = newETagEpoch()
+
+// newETagEpoch returns a random epoch
+func newETagEpoch() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// formatETag returns the strong entity tag for a key version
+func formatETag(version uint64) string {
+	if etagEpoch == "" {
+		return fmt.Sprintf(`"v%d"`, version)
+	}
+	return fmt.Sprintf(`"v%d-%s"`, version, etagEpoch)
+}
+
+// parseETagVersion extracts the key version from a strong entity tag of this epoch
+func parseETagVersion(etag string) (uint64, bool) {
+	if !strings.HasPrefix(etag, `"v`) || !strings.HasSuffix(etag, `"`) || len(etag) < 4 {
+		return 0, false
+	}
+
+	versionStr, epoch, _ := strings.Cut(etag[2:len(etag)-1], "-")
+	if epoch != etagEpoch {
+		return 0, false
+	}
+	version, err := strconv.ParseUint(versionStr, 10, 64)
+	if err != nil || version == 0 {
+		return 0, false
+	}
+	return version, true
+}
+
+// parseETagHeader splits an If-Match or If-None-Match header into its entity tags
+// Returns true as the second value if the header is the "*" wildcard
+func parseETagHeader(header string) ([]string, bool) {
+	var tags []string
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return nil, true
+		}
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, false
+}
+
+// etagMatchesWeak reports whether etag is in tags using the weak comparison of If-None-Match
+func etagMatchesWeak(tags []string, etag string) bool {
+	for _, tag := range tags {
+		if strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified reports whether a GET with the given If-None-Match header can be answered with 304 Not Modified
+func notModified(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+
+	tags, wildcard := parseETagHeader(header)
+	return wildcard || etagMatchesWeak(tags, etag)
+}
+
+// preconditionFromHeaders adds the If-Match and If-None-Match headers of a write request to cond
+// If-Match: "<etag>" expects that version, If-Match: * expects the key to exist and
+// If-None-Match: * expects it to be absent. currentVersion returns the version of the key
+// (0 if it doesn't exist) and is only called to pick the tag of an If-Match list that matches
+// Returns true as the second value if any precondition header was present
+// An If-Match that can never match fails with ErrConflict, to be answered with 412 Precondition Failed
+func preconditionFromHeaders(r *http.Request, cond SetCondition, currentVersion func() uint64) (SetCondition, bool, error) {
+	present := false
+
+	if header := r.Header.Get("If-Match"); header != "" {
+		present = true
+		tags, wildcard := parseETagHeader(header)
+		if wildcard {
+			cond.IfPresent = true
+		} else {
+			// If-Match uses strong comparison, so weak and unknown tags never match
+			var versions []uint64
+			for _, tag := range tags {
+				if version, ok := parseETagVersion(tag); ok && !slices.Contains(versions, version) {
+					versions = append(versions, version)
+				}
+			}
+
+			switch {
+			case cond.IfVersion != 0:
+				if !slices.Contains(versions, cond.IfVersion) {
+					return cond, present, fmt.Errorf("If-Match contradicts the version parameter")
+				}
+			case len(versions) == 0:
+				return cond, present, fmt.Errorf("%w: no entity tag in If-Match matches the key", ErrConflict)
+			case len(versions) == 1:
+				cond.IfVersion = versions[0]
+			default:
+				// Only the current version can match; the write still fails if the key changes in the meantime
+				current := currentVersion()
+				if !slices.Contains(versions, current) {
+					return cond, present, fmt.Errorf("%w: no entity tag in If-Match matches the key", ErrConflict)
+				}
+				cond.IfVersion = current
+			}
+		}
+	}
+
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		present = true
+		if _, wildcard := parseETagHeader(header); !wildcard {
+			return cond, present, fmt.Errorf("only If-None-Match: * is supported for writes")
+		}
+		cond.IfAbsent = true
+	}
+
+	return cond, present, cond.Validate()
+}
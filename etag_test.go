@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestParseETagVersion checks that only strong tags of the current epoch carry a version
+func TestParseETagVersion(t *testing.T) {
+	epoch := etagEpoch
+	defer func() { etagEpoch = epoch }()
+
+	tests := []struct {
+		epoch   string
+		etag    string
+		version uint64
+	}{
+		{"1f3a9c2e", `"v9-1f3a9c2e"`, 9},
+		{"1f3a9c2e", `"v9-00000000"`, 0},
+		{"1f3a9c2e", `"v9"`, 0},
+		{"1f3a9c2e", `W/"v9-1f3a9c2e"`, 0},
+		{"", `"v9"`, 9},
+		{"", `"v9-1f3a9c2e"`, 0},
+		{"", `"v0"`, 0},
+		{"", `"vx"`, 0},
+	}
+
+	for _, tt := range tests {
+		etagEpoch = tt.epoch
+		version, ok := parseETagVersion(tt.etag)
+		if ok != (tt.version != 0) || version != tt.version {
+			t.Errorf("epoch %q: parseETagVersion(%s) = %d, %v; want %d", tt.epoch, tt.etag, version, ok, tt.version)
+		}
+		if tt.version != 0 && formatETag(tt.version) != tt.etag {
+			t.Errorf("epoch %q: formatETag(%d) = %s, want %s", tt.epoch, tt.version, formatETag(tt.version), tt.etag)
+		}
+	}
+}
+
+// TestPreconditionFromHeaders checks the version expected by If-Match tags and lists
+func TestPreconditionFromHeaders(t *testing.T) {
+	const current = 5
+
+	tests := []struct {
+		name     string
+		ifMatch  string
+		cond     SetCondition
+		version  uint64 // Expected version of the condition
+		failed   bool   // The precondition can never hold (412)
+		invalid  bool   // The request is malformed (400)
+		lookedUp bool   // The current version had to be looked up
+	}{
+		{name: "single tag", ifMatch: formatETag(3), version: 3},
+		{name: "repeated tag", ifMatch: formatETag(3) + ", " + formatETag(3), version: 3},
+		{name: "list with the current version", ifMatch: formatETag(3) + ", " + formatETag(current), version: current, lookedUp: true},
+		{name: "list without the current version", ifMatch: formatETag(3) + ", " + formatETag(4), failed: true, lookedUp: true},
+		{name: "list with unknown and weak tags", ifMatch: `"other", W/` + formatETag(current) + ", " + formatETag(3), version: 3},
+		{name: "only unknown tags", ifMatch: `"other", W/` + formatETag(current), failed: true},
+		{name: "tag of an earlier process", ifMatch: `"v5-00000000"`, failed: true},
+		{name: "wildcard", ifMatch: "*"},
+		{name: "list with the version parameter", ifMatch: formatETag(3) + ", " + formatETag(4), cond: SetCondition{IfVersion: 4}, version: 4},
+		{name: "list contradicting the version parameter", ifMatch: formatETag(3), cond: SetCondition{IfVersion: 4}, invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/set?k=a&v=b", nil)
+			r.Header.Set("If-Match", tt.ifMatch)
+
+			lookedUp := false
+			cond, present, err := preconditionFromHeaders(r, tt.cond, func() uint64 {
+				lookedUp = true
+				return current
+			})
+
+			if !present {
+				t.Errorf("If-Match header not reported as present")
+			}
+			if lookedUp != tt.lookedUp {
+				t.Errorf("current version looked up = %v, want %v", lookedUp, tt.lookedUp)
+			}
+			switch {
+			case tt.failed:
+				if !errors.Is(err, ErrConflict) {
+					t.Fatalf("expected ErrConflict, got %+v, %v", cond, err)
+				}
+			case tt.invalid:
+				if err == nil || errors.Is(err, ErrConflict) {
+					t.Fatalf("expected a request error, got %+v, %v", cond, err)
+				}
+			case err != nil:
+				t.Fatalf("preconditionFromHeaders: %v", err)
+			case cond.IfVersion != tt.version:
+				t.Fatalf("expected version %d, got %d", tt.version, cond.IfVersion)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Eviction policies applied when a write would exceed the key count or memory limit
+const (
+	EvictionNone        = "noeviction"   // Reject the write
+	EvictionLRU         = "lru"          // Evict the least recently used key
+	EvictionLFU         = "lfu"          // Evict the least frequently used key
+	EvictionRandom      = "random"       // Evict a random key
+	EvictionVolatileTTL = "volatile-ttl" // Evict the key with a TTL that expires soonest
+)
+
+// parseEvictionPolicy validates an eviction policy name
+func parseEvictionPolicy(s string) (string, error) {
+	policy := strings.ToLower(s)
+	switch policy {
+	case EvictionNone, EvictionLRU, EvictionLFU, EvictionRandom, EvictionVolatileTTL:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid eviction policy '%s': must be one of noeviction, lru, lfu, random, volatile-ttl", s)
+	}
+}
+
+// SetEvictionPolicy sets the policy used to make room when the store is full
+func (kvs *KeyValueStore) SetEvictionPolicy(policy string) {
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+	kvs.eviction = policy
+}
+
+// tracksAccess reports whether the eviction policy needs per-key access statistics
+func (kvs *KeyValueStore) tracksAccess() bool {
+	return kvs.eviction == EvictionLRU || kvs.eviction == EvictionLFU
+}
+
+// selectVictimLocked picks the key to evict according to the eviction policy
+// Keys being written, for which exclude returns true, are never selected
+// Returns false if no key can be evicted
+// The caller must hold at least the read lock
+func (kvs *KeyValueStore) selectVictimLocked(exclude func(key string) bool) (string, bool) {
+	var victim string
+	var victimEntry storeEntry
+	found := false
+	candidates := 0
+
+	for k, entry := range kvs.store {
+		if exclude(k) {
+			continue
+		}
+
+		switch kvs.eviction {
+		case EvictionLRU:
+			if !found || entry.lastAccess.Before(victimEntry.lastAccess) {
+				victim, victimEntry, found = k, entry, true
+			}
+		case EvictionLFU:
+			if !found || entry.hits < victimEntry.hits ||
+				(entry.hits == victimEntry.hits && entry.lastAccess.Before(victimEntry.lastAccess)) {
+				victim, victimEntry, found = k, entry, true
+			}
+		case EvictionRandom:
+			// Reservoir sampling gives every key the same chance of being picked
+			candidates++
+			if rand.Intn(candidates) == 0 {
+				victim, found = k, true
+			}
+		case EvictionVolatileTTL:
+			if entry.expiresAt.IsZero() {
+				continue
+			}
+			if !found || entry.expiresAt.Before(victimEntry.expiresAt) {
+				victim, victimEntry, found = k, entry, true
+			}
+		default:
+			return "", false
+		}
+	}
+
+	return victim, found
+}
+
+// evictLocked removes keys according to the eviction policy until storing entry under key fits the limits
+// It is checked like a batch of one, so a write that doesn't fit even after eviction evicts nothing
+// The caller must hold the write lock
+func (kvs *KeyValueStore) evictLocked(key string, entry storeEntry) error {
+	return kvs.evictBatchLocked(map[string]storeEntry{key: entry}, nil)
+}
+
+// evictBatchLocked removes keys according to the eviction policy until storing all entries,
+// and removing the keys in without, fits the limits
+// Nothing is evicted unless evicting every eligible key would make enough room
+// The caller must hold the write lock
+func (kvs *KeyValueStore) evictBatchLocked(entries map[string]storeEntry, without map[string]bool) error {
+	limitErr := kvs.batchLimitErrorLocked(entries, without)
+	if limitErr == nil {
+		return nil
+	}
+
+	// Check up front that the batch fits once every eligible key is gone, so a
+	// batch that is rejected anyway doesn't evict anything
+	evictable := make(map[string]bool)
+	for k := range without {
+		evictable[k] = true
+	}
+	for k, entry := range kvs.store {
+		if _, inBatch := entries[k]; inBatch || without[k] {
+			continue
+		}
+		if kvs.eviction == EvictionVolatileTTL && entry.expiresAt.IsZero() {
+			continue
+		}
+		evictable[k] = true
+	}
+	if kvs.batchLimitErrorLocked(entries, evictable) != nil {
+		return limitErr
+	}
+
+	inBatch := func(k string) bool {
+		_, ok := entries[k]
+		return ok || without[k]
+	}
+	for kvs.batchLimitErrorLocked(entries, without) != nil {
+		victim, ok := kvs.selectVictimLocked(inBatch)
+		if !ok {
+			return limitErr
+		}
+		if err := kvs.evictKeyLocked(victim); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evictKeyLocked removes victim and records the eviction
+// The caller must hold the write lock
+func (kvs *KeyValueStore) evictKeyLocked(victim string) error {
+	if err := kvs.deleteLocked(victim); err != nil {
+		return err
+	}
+
+	kvs.evictions++
+	logMessage("SYSTEM", "eviction", "local", fmt.Sprintf("Evicted key '%s' (policy: %s)", victim, kvs.eviction), false)
+	return nil
+}
+
+// touchLocked records an access to key for the LRU and LFU eviction policies
+// The caller must hold the write lock
+func (kvs *KeyValueStore) touchLocked(key string, entry storeEntry, now time.Time) {
+	entry.lastAccess = now
+	entry.hits++
+	kvs.store[key] = entry
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newEvictingStore creates a store holding at most maxKeys keys under the given eviction policy
+func newEvictingStore(policy string, maxKeys int) *KeyValueStore {
+	limits := DefaultLimits()
+	limits.MaxKeyCount = maxKeys
+	kvs := NewKeyValueStore(limits)
+	kvs.SetEvictionPolicy(policy)
+	return kvs
+}
+
+// mustSet sets a key or fails the test
+func mustSet(t *testing.T, kvs *KeyValueStore, key string, ttl time.Duration) {
+	t.Helper()
+	if err := kvs.Set(key, "value", ttl); err != nil {
+		t.Fatalf("Set(%q): %v", key, err)
+	}
+}
+
+// TestEvictionPolicies checks which key each policy evicts to make room for a new one
+func TestEvictionPolicies(t *testing.T) {
+	t.Run("lru", func(t *testing.T) {
+		kvs := newEvictingStore(EvictionLRU, 2)
+		mustSet(t, kvs, "a", 0)
+		mustSet(t, kvs, "b", 0)
+		kvs.GetItem("a")
+		mustSet(t, kvs, "c", 0)
+
+		if _, exists := kvs.Get("b"); exists {
+			t.Errorf("least recently used key 'b' was not evicted")
+		}
+		if _, exists := kvs.Get("a"); !exists {
+			t.Errorf("recently read key 'a' was evicted")
+		}
+	})
+
+	t.Run("lfu", func(t *testing.T) {
+		kvs := newEvictingStore(EvictionLFU, 2)
+		mustSet(t, kvs, "a", 0)
+		mustSet(t, kvs, "b", 0)
+		kvs.GetItem("a")
+		kvs.GetItem("a")
+		kvs.GetItem("b")
+		mustSet(t, kvs, "c", 0)
+
+		if _, exists := kvs.Get("b"); exists {
+			t.Errorf("least frequently used key 'b' was not evicted")
+		}
+		if _, exists := kvs.Get("a"); !exists {
+			t.Errorf("frequently read key 'a' was evicted")
+		}
+	})
+
+	t.Run("random", func(t *testing.T) {
+		kvs := newEvictingStore(EvictionRandom, 2)
+		mustSet(t, kvs, "a", 0)
+		mustSet(t, kvs, "b", 0)
+		mustSet(t, kvs, "c", 0)
+
+		status := kvs.GetStatus()
+		if status.KeyCount != 2 || status.EvictedKeys != 1 {
+			t.Errorf("store has %d keys after %d evictions, want 2 keys after 1", status.KeyCount, status.EvictedKeys)
+		}
+		if _, exists := kvs.Get("c"); !exists {
+			t.Errorf("new key 'c' was evicted")
+		}
+	})
+
+	t.Run("volatile-ttl", func(t *testing.T) {
+		kvs := newEvictingStore(EvictionVolatileTTL, 3)
+		mustSet(t, kvs, "persistent", 0)
+		mustSet(t, kvs, "later", time.Hour)
+		mustSet(t, kvs, "sooner", time.Minute)
+		mustSet(t, kvs, "new", 0)
+
+		if _, exists := kvs.Get("sooner"); exists {
+			t.Errorf("key expiring soonest was not evicted")
+		}
+		for _, key := range []string{"persistent", "later", "new"} {
+			if _, exists := kvs.Get(key); !exists {
+				t.Errorf("key '%s' was evicted", key)
+			}
+		}
+	})
+
+	t.Run("volatile-ttl without volatile keys", func(t *testing.T) {
+		kvs := newEvictingStore(EvictionVolatileTTL, 2)
+		mustSet(t, kvs, "a", 0)
+		mustSet(t, kvs, "b", 0)
+
+		if err := kvs.Set("c", "value", 0); err == nil {
+			t.Fatalf("write succeeded without any key that may be evicted")
+		}
+		if status := kvs.GetStatus(); status.KeyCount != 2 || status.EvictedKeys != 0 {
+			t.Errorf("store has %d keys after %d evictions, want 2 keys and none evicted", status.KeyCount, status.EvictedKeys)
+		}
+	})
+}
+
+// TestEvictionInfeasibleWrites checks that writes which can't fit even after eviction evict nothing
+func TestEvictionInfeasibleWrites(t *testing.T) {
+	t.Run("batch", func(t *testing.T) {
+		kvs := newEvictingStore(EvictionLRU, 3)
+		mustSet(t, kvs, "a", 0)
+		mustSet(t, kvs, "b", 0)
+
+		items := []BatchItem{{Key: "w", Value: "1"}, {Key: "x", Value: "1"}, {Key: "y", Value: "1"}, {Key: "z", Value: "1"}}
+		if _, err := kvs.MSet(items); err == nil {
+			t.Fatalf("batch larger than the store succeeded")
+		}
+		if status := kvs.GetStatus(); status.KeyCount != 2 || status.EvictedKeys != 0 {
+			t.Errorf("store has %d keys after %d evictions, want 2 keys and none evicted", status.KeyCount, status.EvictedKeys)
+		}
+	})
+
+	t.Run("single key under volatile-ttl", func(t *testing.T) {
+		limits := DefaultLimits()
+		limits.MaxMemory = 100
+		kvs := NewKeyValueStore(limits)
+		kvs.SetEvictionPolicy(EvictionVolatileTTL)
+		if err := kvs.Set("a", "0123456789012345678", time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		if err := kvs.Set("b", "0123456789012345678901234567890123456789", 0); err != nil {
+			t.Fatal(err)
+		}
+
+		// Evicting 'a' alone can't make room, as 'b' has no TTL
+		if err := kvs.Set("c", "0123456789012345678901234567890123456789012345678901234567890123456789", 0); err == nil {
+			t.Fatalf("write larger than the evictable memory succeeded")
+		}
+		if _, exists := kvs.Get("a"); !exists {
+			t.Errorf("key 'a' was evicted for a write that was rejected")
+		}
+	})
+}
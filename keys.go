@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Paging limits for key listings
+const (
+	DefaultKeysLimit = 100  // Number of keys returned per page when no limit is given
+	MaxKeysLimit     = 1000 // Largest page size a client may request
+)
+
+// KeyListing is one page of a key listing
+type KeyListing struct {
+	Keys       []string `json:"keys"`
+	Count      int      `json:"count"`
+	NextCursor string   `json:"next_cursor,omitempty"` // Empty when there are no more keys
+}
+
+// KeysQuery describes which keys to list and which page to return
+type KeysQuery struct {
+	Prefix string // Only list keys starting with this prefix
+	Match  string // Only list keys matching this glob pattern (*, ? and [...])
+	Cursor string // Opaque cursor returned by the previous page, empty for the first page
+	Limit  int    // Maximum number of keys to return
+	Bytes  int    // Maximum encoded size of the keys and cursor of a page, 0 for no limit
+}
+
+// Keys returns one page of live keys, sorted lexicographically
+func (kvs *KeyValueStore) Keys(q KeysQuery) (KeyListing, error) {
+	after, err := decodeKeysCursor(q.Cursor)
+	if err != nil {
+		return KeyListing{}, err
+	}
+
+	var matcher *regexp.Regexp
+	if q.Match != "" {
+		matcher, err = globToRegexp(q.Match)
+		if err != nil {
+			return KeyListing{}, err
+		}
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultKeysLimit
+	}
+	if limit > MaxKeysLimit {
+		limit = MaxKeysLimit
+	}
+
+	now := time.Now()
+	var keys []string
+
+	kvs.mu.RLock()
+	for k, entry := range kvs.store {
+		if entry.expired(now) {
+			continue
+		}
+		if q.Cursor != "" && k <= after {
+			continue
+		}
+		if !strings.HasPrefix(k, q.Prefix) {
+			continue
+		}
+		if matcher != nil && !matcher.MatchString(k) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	kvs.mu.RUnlock()
+
+	sort.Strings(keys)
+
+	if q.Bytes > 0 {
+		limit = pageFitting(keys, limit, q.Bytes)
+	}
+
+	listing := KeyListing{Keys: keys}
+	if len(keys) > limit {
+		listing.Keys = keys[:limit]
+		listing.NextCursor = encodeKeysCursor(listing.Keys[limit-1])
+	}
+	if listing.Keys == nil {
+		listing.Keys = []string{}
+	}
+	listing.Count = len(listing.Keys)
+
+	return listing, nil
+}
+
+// pageFitting returns how many of at most limit keys fit in a page of maxBytes, counting their
+// JSON encoding and the cursor to the next page. At least one key is returned so paging always advances
+func pageFitting(keys []string, limit, maxBytes int) int {
+	size := 0
+	for i, k := range keys {
+		if i == limit {
+			return limit
+		}
+		encoded, _ := json.Marshal(k)
+		size += len(encoded) + 1
+		if i > 0 && size+len(encodeKeysCursor(k)) > maxBytes {
+			return i
+		}
+	}
+	return len(keys)
+}
+
+// encodeKeysCursor turns the last key of a page into an opaque cursor
+func encodeKeysCursor(lastKey string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(lastKey))
+}
+
+// decodeKeysCursor returns the last key of the previous page encoded in cursor
+func decodeKeysCursor(cursor string) (string, error) {
+	if cursor == "" {
+		return "", nil
+	}
+
+	lastKey, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", fmt.Errorf("invalid cursor '%s'", cursor)
+	}
+	return string(lastKey), nil
+}
+
+// parseKeysLimit parses a page size given as a string
+// An empty string means the default page size
+func parseKeysLimit(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("invalid limit '%s': must be a positive integer", s)
+	}
+	return limit, nil
+}
+
+// globToRegexp compiles a glob pattern into an anchored regular expression
+// Supports * (any sequence), ? (any single character) and [...] character classes
+func globToRegexp(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("(?s)^")
+
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		switch c := runes[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '\\':
+			// Escaped character matches itself
+			if i+1 < len(runes) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(runes[i])))
+			} else {
+				b.WriteString(`\\`)
+			}
+		case '[':
+			end := i + 1
+			for end < len(runes) && runes[end] != ']' {
+				end++
+			}
+			if end >= len(runes) {
+				return nil, fmt.Errorf("invalid pattern '%s': unterminated character class", pattern)
+			}
+			class := string(runes[i+1 : end])
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i = end
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	b.WriteString("$")
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern '%s': %v", pattern, err)
+	}
+	return re, nil
+}
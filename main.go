@@ -2,14 +2,20 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -21,10 +27,6 @@ var (
 )
 
 const (
-	MaxKeySize   = 255     // Maximum key size in bytes
-	MaxValueSize = 1048576 // Maximum value size in bytes (1MB)
-	MaxKeyCount  = 100     // Maximum number of keys allowed
-
 	// ANSI color codes
 	ColorReset  = "\033[0m"
 	ColorRed    = "\033[31m"
@@ -32,22 +34,133 @@ const (
 	ColorGreen  = "\033[32m"
 )
 
+// MaxTTLSeconds is the longest TTL in seconds that still fits in a time.Duration
+const MaxTTLSeconds = int64(math.MaxInt64 / time.Second)
+
+// UDP reply limits
+const (
+	MaxUDPResponseSize = 60 * 1024                // Largest reply datagram, below the 65507-byte UDP payload limit
+	udpKeysPageBytes   = MaxUDPResponseSize - 512 // Room for the keys of a listing, leaving the rest for the envelope
+)
+
 // KeyValueStore is a simple in-memory key-value store with mutex for concurrent access
 type KeyValueStore struct {
-	store map[string]string
-	mu    sync.RWMutex
+	store     map[string]storeEntry
+	mu        sync.RWMutex
+	limits    Limits
+	used      int64      // Total size of all stored keys and values in bytes
+	revision  uint64     // Incremented on every write; the version of a key is the revision that last wrote it
+	eviction  string     // Eviction policy applied when the store is full
+	evictions uint64     // Number of keys evicted so far
+	aof       *appendLog // Optional append-only log that records every mutation
+	watchers  *watchHub  // Delivers change events to watchers
+}
+
+// storeEntry holds a stored value together with its expiry time and access statistics
+type storeEntry struct {
+	value      string
+	expiresAt  time.Time // Zero value means the key never expires
+	lastAccess time.Time // Last read or write, used by LRU eviction
+	hits       uint64    // Number of reads and writes, used by LFU eviction
+	version    uint64    // Store revision at which the key was last written
+	flags      uint32    // Opaque client flags, as set by memcached clients
+}
+
+// Item is a stored key as returned to callers
+type Item struct {
+	Value   string
+	TTL     time.Duration // Remaining time to live (0 if the key never expires)
+	Version uint64
+	Flags   uint32
+}
+
+// item converts an entry into an Item as seen at now
+func (e storeEntry) item(now time.Time) Item {
+	return Item{Value: e.value, TTL: e.ttlRemaining(now), Version: e.version, Flags: e.flags}
+}
+
+// ErrConflict is returned when a conditional write doesn't match the current state of a key
+var ErrConflict = errors.New("conflict")
+
+// Errors returned by counter operations
+var (
+	ErrNotInteger = errors.New("value is not an integer")
+	ErrOverflow   = errors.New("increment or decrement would overflow")
+)
+
+// SetCondition restricts when a write may be applied
+// The zero value applies the write unconditionally
+type SetCondition struct {
+	IfVersion uint64 // Only write if the key currently has this version (0 disables the check)
+	IfAbsent  bool   // Only write if the key does not exist
+	IfPresent bool   // Only write if the key exists
+}
+
+// Validate checks that the condition is not contradictory
+func (c SetCondition) Validate() error {
+	if c.IfAbsent && (c.IfPresent || c.IfVersion != 0) {
+		return fmt.Errorf("'only if absent' cannot be combined with 'only if present' or an expected version")
+	}
+	return nil
+}
+
+// check verifies the condition against the current entry for key
+func (c SetCondition) check(key string, current storeEntry, exists bool) error {
+	if c.IfAbsent && exists {
+		return fmt.Errorf("%w: key '%s' already exists", ErrConflict, key)
+	}
+	if c.IfPresent && !exists {
+		return fmt.Errorf("%w: key '%s' does not exist", ErrConflict, key)
+	}
+	if c.IfVersion != 0 {
+		if !exists {
+			return fmt.Errorf("%w: key '%s' does not exist (expected version %d)", ErrConflict, key, c.IfVersion)
+		}
+		if current.version != c.IfVersion {
+			return fmt.Errorf("%w: key '%s' has version %d (expected version %d)", ErrConflict, key, current.version, c.IfVersion)
+		}
+	}
+	return nil
+}
+
+// expired reports whether the entry has passed its expiry time
+func (e storeEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+// size returns the number of bytes the entry counts against the memory limit
+func (e storeEntry) size(key string) int64 {
+	return int64(len(key) + len(e.value))
+}
+
+// ttlRemaining returns the time left until the entry expires (0 if it never expires)
+func (e storeEntry) ttlRemaining(now time.Time) time.Duration {
+	if e.expiresAt.IsZero() {
+		return 0
+	}
+	return e.expiresAt.Sub(now)
 }
 
 // StatusInfo represents the information returned by the status endpoint
 type StatusInfo struct {
-	KeyCount    int   `json:"key_count"`
-	MemoryUsage int64 `json:"memory_usage_bytes"`
+	KeyCount       int    `json:"key_count"`
+	MemoryUsage    int64  `json:"memory_usage_bytes"`
+	Limits         Limits `json:"limits"`
+	EvictionPolicy string `json:"eviction_policy"`
+	EvictedKeys    uint64 `json:"evicted_keys"`
 }
 
 // AccessControl represents settings for controlling access to the API
 type AccessControl struct {
-	AllowedCIDR  *net.IPNet
-	FirewallMode string // Can be "ACCEPT", "REJECT", or "DROP"
+	Rules        []AccessRule    // Allow and deny rules for client IPs, in the order they were given (empty allows every IP)
+	FirewallMode string          // Can be "ACCEPT", "REJECT", or "DROP"
+	AllowedUIDs  map[uint32]bool // Peer uids allowed on the Unix socket (nil allows every peer)
+
+	AllowedClients map[string]bool // Client certificate common names allowed over mutual TLS (nil allows every verified client)
+	Tokens         *Authenticator  // API tokens required from clients (nil disables authentication)
+	UDPVerifier    *udpVerifier    // Verifies signed UDP datagrams (nil accepts unsigned datagrams)
+	TrustedProxies []*net.IPNet    // Proxies whose forwarded client addresses are believed (empty trusts none)
+	AllowedOrigins []string        // Origins besides the server's own whose pages may open WebSockets without a token
 }
 
 // APIResponse represents the standardized JSON response format
@@ -56,49 +169,569 @@ type APIResponse struct {
 	Message   string      `json:"message"`
 	Key       string      `json:"key,omitempty"`
 	Value     string      `json:"value,omitempty"`
+	Version   uint64      `json:"version,omitempty"`
+	TTL       int64       `json:"ttl_remaining,omitempty"` // Remaining time to live in seconds
 	Data      interface{} `json:"data,omitempty"`
 	TimeStamp string      `json:"timestamp"`
 }
 
-// NewKeyValueStore creates a new key-value store
-func NewKeyValueStore() *KeyValueStore {
+// ttlSeconds converts a remaining TTL to whole seconds, rounding up so that a
+// key which is still alive never reports 0
+func ttlSeconds(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return int64((ttl + time.Second - 1) / time.Second)
+}
+
+// parseTTL parses a TTL given in whole seconds
+// An empty string means no expiry
+func parseTTL(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	seconds, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("invalid ttl '%s': must be a positive number of seconds", s)
+	}
+	if seconds > MaxTTLSeconds {
+		return 0, fmt.Errorf("invalid ttl '%s': value too large", s)
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// parseSetCondition builds a write condition from the version, nx and xx request parameters
+// nx means "only if absent" and xx means "only if present"
+func parseSetCondition(version, nx, xx string) (SetCondition, error) {
+	var cond SetCondition
+
+	if version != "" {
+		v, err := parseVersion(version)
+		if err != nil {
+			return cond, err
+		}
+		cond.IfVersion = v
+	}
+
+	for _, p := range []struct {
+		name, value string
+		target      *bool
+	}{{"nx", nx, &cond.IfAbsent}, {"xx", xx, &cond.IfPresent}} {
+		if p.value == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(p.value)
+		if err != nil {
+			return cond, fmt.Errorf("invalid %s '%s': must be true or false", p.name, p.value)
+		}
+		*p.target = b
+	}
+
+	return cond, cond.Validate()
+}
+
+// parseSetOptions splits the value tokens of a text SET command into the value and its options
+// Options (EX <seconds>, VERSION <n>, NX and XX) are written before the value, optionally ended by "--",
+// or after the value behind a "--" separator. Other tokens are part of the value, which is stored as sent
+func parseSetOptions(tokens []string) ([]string, time.Duration, SetCondition, error) {
+	var ttl time.Duration
+	var cond SetCondition
+
+	// Options before the value
+	i := 0
+	var err error
+	for i < len(tokens) && err == nil {
+		n, optErr := parseSetOption(tokens[i:], &ttl, &cond)
+		if n == 0 {
+			break
+		}
+		i, err = i+n, optErr
+	}
+	if i < len(tokens) && tokens[i] == "--" {
+		i++
+	}
+	if i == len(tokens) {
+		// Without a value after them, the tokens are the value itself, as in "SET k NX"
+		return tokens, 0, SetCondition{}, nil
+	}
+	if err != nil {
+		return nil, 0, cond, err
+	}
+	if i > 0 {
+		return tokens[i:], ttl, cond, cond.Validate()
+	}
+
+	// Options after the value, behind the last "--" separator
+	sep := -1
+	for j := len(tokens) - 1; j > 0; j-- {
+		if tokens[j] == "--" {
+			sep = j
+			break
+		}
+	}
+	if sep < 0 || sep == len(tokens)-1 {
+		return tokens, 0, cond, nil
+	}
+	for j := sep + 1; j < len(tokens); {
+		n, err := parseSetOption(tokens[j:], &ttl, &cond)
+		if n == 0 {
+			// Not only options, so the separator is part of the value
+			return tokens, 0, SetCondition{}, nil
+		}
+		if err != nil {
+			return nil, 0, cond, err
+		}
+		j += n
+	}
+	return tokens[:sep], ttl, cond, cond.Validate()
+}
+
+// parseSetOption parses the SET option at the start of tokens into ttl and cond
+// Returns the number of tokens the option takes, or 0 if tokens don't start with an option
+func parseSetOption(tokens []string, ttl *time.Duration, cond *SetCondition) (int, error) {
+	var err error
+	switch strings.ToUpper(tokens[0]) {
+	case "NX":
+		cond.IfAbsent = true
+		return 1, nil
+	case "XX":
+		cond.IfPresent = true
+		return 1, nil
+	case "EX":
+		if len(tokens) < 2 {
+			return 0, nil
+		}
+		*ttl, err = parseTTL(tokens[1])
+		return 2, err
+	case "VERSION":
+		if len(tokens) < 2 {
+			return 0, nil
+		}
+		cond.IfVersion, err = parseVersion(tokens[1])
+		return 2, err
+	}
+	return 0, nil
+}
+
+// parseVersion parses an expected key version
+func parseVersion(s string) (uint64, error) {
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || v == 0 {
+		return 0, fmt.Errorf("invalid version '%s': must be a positive integer", s)
+	}
+	return v, nil
+}
+
+// parseIncrement parses the amount a counter is incremented by
+// An empty string means 1
+func parseIncrement(s string) (int64, error) {
+	if s == "" {
+		return 1, nil
+	}
+
+	delta, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid increment '%s': must be a 64-bit integer", s)
+	}
+	return delta, nil
+}
+
+// writeErrorStatus returns the status code reported for a failed write
+func writeErrorStatus(err error) int {
+	if errors.Is(err, ErrConflict) {
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
+// NewKeyValueStore creates a new key-value store enforcing the given limits
+func NewKeyValueStore(limits Limits) *KeyValueStore {
 	return &KeyValueStore{
-		store: make(map[string]string),
+		store:    make(map[string]storeEntry),
+		limits:   limits,
+		eviction: EvictionNone,
+		watchers: newWatchHub(),
 	}
 }
 
+// Limits returns the resource limits enforced by the store
+func (kvs *KeyValueStore) Limits() Limits {
+	return kvs.limits
+}
+
 // Get retrieves a value by key
 func (kvs *KeyValueStore) Get(key string) (string, bool) {
+	item, exists := kvs.GetItem(key)
+	return item.Value, exists
+}
+
+// GetItem retrieves a value by key along with its remaining time to live and version
+func (kvs *KeyValueStore) GetItem(key string) (Item, bool) {
+	now := time.Now()
+
+	// LRU and LFU eviction record every access, which needs the write lock
+	if kvs.tracksAccess() {
+		kvs.mu.Lock()
+		defer kvs.mu.Unlock()
+
+		entry, exists := kvs.store[key]
+		if !exists {
+			return Item{}, false
+		}
+		if entry.expired(now) {
+			kvs.expireLocked(key)
+			return Item{}, false
+		}
+
+		kvs.touchLocked(key, entry, now)
+		return entry.item(now), true
+	}
+
 	kvs.mu.RLock()
-	defer kvs.mu.RUnlock()
-	value, exists := kvs.store[key]
-	return value, exists
+	entry, exists := kvs.store[key]
+	kvs.mu.RUnlock()
+
+	if !exists {
+		return Item{}, false
+	}
+
+	// Lazily remove the key if it has already expired
+	if entry.expired(now) {
+		kvs.mu.Lock()
+		if current, ok := kvs.store[key]; ok && current.expired(now) {
+			kvs.expireLocked(key)
+		}
+		kvs.mu.Unlock()
+		return Item{}, false
+	}
+
+	return entry.item(now), true
 }
 
 // Set stores a key-value pair
-// Returns error if the operation fails due to size or count constraints
-func (kvs *KeyValueStore) Set(key, value string) error {
+// A ttl greater than 0 makes the key expire after the given duration
+// Returns error if the operation fails due to size, count or memory constraints
+func (kvs *KeyValueStore) Set(key, value string, ttl time.Duration) error {
+	_, err := kvs.SetIf(key, value, ttl, SetCondition{})
+	return err
+}
+
+// SetIf stores a key-value pair if cond matches the current state of the key
+// Returns the new version of the key, or an error wrapping ErrConflict if cond doesn't match
+func (kvs *KeyValueStore) SetIf(key, value string, ttl time.Duration, cond SetCondition) (uint64, error) {
+	return kvs.SetWithFlags(key, value, 0, ttl, cond)
+}
+
+// SetWithFlags is like SetIf but also stores opaque client flags with the key
+func (kvs *KeyValueStore) SetWithFlags(key, value string, flags uint32, ttl time.Duration, cond SetCondition) (uint64, error) {
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+	return kvs.setLocked(key, value, flags, ttl, cond, time.Now())
+}
+
+// IncrBy atomically adds delta to the integer stored at key
+// A missing key is treated as 0; an existing key keeps its TTL and flags
+// Returns the new value and version of the key
+func (kvs *KeyValueStore) IncrBy(key string, delta int64) (int64, uint64, error) {
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+
+	now := time.Now()
+	var current int64
+	var ttl time.Duration
+	var flags uint32
+
+	if entry, exists := kvs.store[key]; exists && !entry.expired(now) {
+		n, err := strconv.ParseInt(entry.value, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%w: key '%s' holds '%s'", ErrNotInteger, key, entry.value)
+		}
+		current = n
+		ttl = entry.ttlRemaining(now)
+		flags = entry.flags
+	}
+
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return 0, 0, fmt.Errorf("%w: key '%s' holds %d", ErrOverflow, key, current)
+	}
+
+	next := current + delta
+	version, err := kvs.setLocked(key, strconv.FormatInt(next, 10), flags, ttl, SetCondition{}, now)
+	if err != nil {
+		return 0, 0, err
+	}
+	return next, version, nil
+}
+
+// setLocked validates and applies a conditional write
+// The caller must hold the write lock
+func (kvs *KeyValueStore) setLocked(key, value string, flags uint32, ttl time.Duration, cond SetCondition, now time.Time) (uint64, error) {
+	if err := cond.Validate(); err != nil {
+		return 0, err
+	}
+
 	// Check key size
-	if len([]byte(key)) > MaxKeySize {
-		return fmt.Errorf("key exceeds maximum size of %d bytes", MaxKeySize)
+	if len([]byte(key)) > kvs.limits.MaxKeySize {
+		return 0, fmt.Errorf("key exceeds maximum size of %d bytes", kvs.limits.MaxKeySize)
 	}
 
 	// Check value size
-	if len([]byte(value)) > MaxValueSize {
-		return fmt.Errorf("value exceeds maximum size of %d bytes", MaxValueSize)
+	if len([]byte(value)) > kvs.limits.MaxValueSize {
+		return 0, fmt.Errorf("value exceeds maximum size of %d bytes", kvs.limits.MaxValueSize)
+	}
+
+	// Check TTL
+	if ttl < 0 {
+		return 0, fmt.Errorf("ttl must not be negative")
+	}
+
+	current, exists := kvs.store[key]
+	if exists && current.expired(now) {
+		exists = false
+	}
+
+	if err := cond.check(key, current, exists); err != nil {
+		return 0, err
+	}
+
+	entry := storeEntry{value: value, lastAccess: now, hits: 1, flags: flags}
+	if ttl > 0 {
+		entry.expiresAt = now.Add(ttl)
+	}
+	if exists {
+		entry.hits = current.hits + 1
+	}
+
+	if err := kvs.checkLimitsLocked(key, entry, now); err != nil {
+		return 0, err
+	}
+
+	entry.version = kvs.revision + 1
+	if err := kvs.logSetLocked(key, entry); err != nil {
+		return 0, err
+	}
+
+	kvs.revision = entry.version
+	kvs.putLocked(key, entry)
+	kvs.publishLocked(setEvent(key, entry, now))
+	return entry.version, nil
+}
+
+// checkLimitsLocked verifies that storing entry under key stays within the key count and memory limits
+// Expired keys that haven't been swept yet are removed first so they don't block new writes,
+// after which other keys are evicted according to the eviction policy
+// The caller must hold the write lock
+func (kvs *KeyValueStore) checkLimitsLocked(key string, entry storeEntry, now time.Time) error {
+	if err := kvs.limitErrorLocked(key, entry); err == nil {
+		return nil
+	}
+
+	kvs.removeExpiredLocked(now)
+	if kvs.eviction == EvictionNone {
+		return kvs.limitErrorLocked(key, entry)
+	}
+	return kvs.evictLocked(key, entry)
+}
+
+// limitErrorLocked returns the limit that storing entry under key would exceed, if any
+// The caller must hold at least the read lock
+func (kvs *KeyValueStore) limitErrorLocked(key string, entry storeEntry) error {
+	current, exists := kvs.store[key]
+	if !exists && len(kvs.store) >= kvs.limits.MaxKeyCount {
+		return fmt.Errorf("maximum number of keys (%d) reached", kvs.limits.MaxKeyCount)
+	}
+
+	if kvs.limits.MaxMemory > 0 {
+		newUsed := kvs.used + entry.size(key)
+		if exists {
+			newUsed -= current.size(key)
+		}
+		if newUsed > kvs.limits.MaxMemory {
+			return fmt.Errorf("memory limit of %d bytes reached", kvs.limits.MaxMemory)
+		}
+	}
+
+	return nil
+}
+
+// putLocked stores entry under key and updates the memory accounting
+// The caller must hold the write lock
+func (kvs *KeyValueStore) putLocked(key string, entry storeEntry) {
+	if current, exists := kvs.store[key]; exists {
+		kvs.used -= current.size(key)
 	}
+	kvs.store[key] = entry
+	kvs.used += entry.size(key)
+}
+
+// removeLocked deletes key and updates the memory accounting
+// The caller must hold the write lock
+func (kvs *KeyValueStore) removeLocked(key string) {
+	if current, exists := kvs.store[key]; exists {
+		kvs.used -= current.size(key)
+		delete(kvs.store, key)
+	}
+}
 
+// replaceAllLocked replaces the whole contents of the store
+// The caller must hold the write lock
+func (kvs *KeyValueStore) replaceAllLocked(store map[string]storeEntry) {
+	kvs.store = store
+	kvs.used = 0
+	for k, entry := range store {
+		kvs.used += entry.size(k)
+	}
+}
+
+// Delete removes a key from the store
+// Returns false if the key does not exist
+func (kvs *KeyValueStore) Delete(key string) bool {
 	kvs.mu.Lock()
 	defer kvs.mu.Unlock()
 
-	// Check if we're adding a new key and if we've reached the limit
-	_, exists := kvs.store[key]
-	if !exists && len(kvs.store) >= MaxKeyCount {
-		return fmt.Errorf("maximum number of keys (%d) reached", MaxKeyCount)
+	entry, exists := kvs.store[key]
+	if !exists {
+		return false
 	}
 
-	kvs.store[key] = value
-	return nil
+	if entry.expired(time.Now()) {
+		kvs.expireLocked(key)
+		return false
+	}
+
+	if err := kvs.deleteLocked(key); err != nil {
+		logMessage("SYSTEM", "aof", "local", err.Error(), false, http.StatusInternalServerError)
+	}
+	return true
+}
+
+// deleteLocked removes a live key as a new revision of the store
+// The key is removed even if recording the deletion in the append-only log fails
+// The caller must hold the write lock
+func (kvs *KeyValueStore) deleteLocked(key string) error {
+	kvs.revision++
+	err := kvs.logMutationLocked(logRecord{Op: OpDelete, Key: key, Version: kvs.revision})
+	kvs.removeLocked(key)
+	kvs.publishLocked(WatchEvent{Type: EventDelete, Key: key, Revision: kvs.revision})
+	return err
+}
+
+// expireLocked removes an expired key as a new revision of the store
+// The removal is logged so revisions keep increasing across restarts
+// The caller must hold the write lock
+func (kvs *KeyValueStore) expireLocked(key string) {
+	kvs.revision++
+	if err := kvs.logMutationLocked(logRecord{Op: OpDelete, Key: key, Version: kvs.revision}); err != nil {
+		logMessage("SYSTEM", "aof", "local", err.Error(), false, http.StatusInternalServerError)
+	}
+	kvs.removeLocked(key)
+	kvs.publishLocked(WatchEvent{Type: EventExpire, Key: key, Revision: kvs.revision})
+}
+
+// SetAppendLog attaches an append-only log that records every subsequent mutation
+func (kvs *KeyValueStore) SetAppendLog(l *appendLog) {
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+	kvs.aof = l
+}
+
+// CompactAppendLog rewrites the append-only log so it only holds the current contents of the store
+func (kvs *KeyValueStore) CompactAppendLog() error {
+	// Holding the read lock keeps writers, and therefore appends, out while the log is rewritten
+	kvs.mu.RLock()
+	defer kvs.mu.RUnlock()
+
+	if kvs.aof == nil {
+		return nil
+	}
+	return kvs.aof.Rewrite(kvs.snapshotLocked(time.Now()), kvs.revision)
+}
+
+// logMutationLocked records a mutation in the append-only log, if one is attached
+// The caller must hold the write lock
+func (kvs *KeyValueStore) logMutationLocked(rec logRecord) error {
+	if kvs.aof == nil {
+		return nil
+	}
+	return kvs.aof.Append(rec)
+}
+
+// logSetLocked records that key is being set to entry
+// The caller must hold the write lock
+func (kvs *KeyValueStore) logSetLocked(key string, entry storeEntry) error {
+	return kvs.logMutationLocked(setRecord(key, entry))
+}
+
+// setRecord returns the log record that sets key to entry
+func setRecord(key string, entry storeEntry) logRecord {
+	rec := logRecord{Op: OpSet, Key: key, Value: entry.value, Version: entry.version, Flags: entry.flags}
+	if !entry.expiresAt.IsZero() {
+		expiresAt := entry.expiresAt
+		rec.ExpiresAt = &expiresAt
+	}
+	return rec
+}
+
+// applyRecordLocked applies a replayed log record to the store without logging it again
+// The caller must hold the write lock
+func (kvs *KeyValueStore) applyRecordLocked(rec logRecord, now time.Time) {
+	if rec.Version > kvs.revision {
+		kvs.revision = rec.Version
+	}
+
+	switch rec.Op {
+	case OpSet:
+		entry := storeEntry{value: rec.Value, version: rec.Version, flags: rec.Flags}
+		if rec.ExpiresAt != nil {
+			entry.expiresAt = *rec.ExpiresAt
+		}
+		if entry.expired(now) {
+			kvs.removeLocked(rec.Key)
+			return
+		}
+		kvs.putLocked(rec.Key, entry)
+	case OpDelete:
+		kvs.removeLocked(rec.Key)
+	case OpClear:
+		kvs.replaceAllLocked(make(map[string]storeEntry))
+	case OpBatch:
+		for _, nested := range rec.Records {
+			kvs.applyRecordLocked(nested, now)
+		}
+	}
+}
+
+// removeExpiredLocked deletes all expired keys and returns their names
+// The caller must hold the write lock
+func (kvs *KeyValueStore) removeExpiredLocked(now time.Time) []string {
+	var removed []string
+	for k, entry := range kvs.store {
+		if entry.expired(now) {
+			kvs.expireLocked(k)
+			removed = append(removed, k)
+		}
+	}
+	return removed
+}
+
+// StartExpirySweeper starts a background goroutine that periodically removes expired keys
+func (kvs *KeyValueStore) StartExpirySweeper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			kvs.mu.Lock()
+			removed := kvs.removeExpiredLocked(now)
+			kvs.mu.Unlock()
+
+			for _, key := range removed {
+				logMessage("SYSTEM", "expiry", "local", fmt.Sprintf("Expired key '%s'", key), false, http.StatusOK)
+			}
+		}
+	}()
 }
 
 // GetStatus returns information about the current state of the store
@@ -106,15 +739,37 @@ func (kvs *KeyValueStore) GetStatus() StatusInfo {
 	kvs.mu.RLock()
 	defer kvs.mu.RUnlock()
 
+	now := time.Now()
+	var keyCount int
 	var totalSize int64
-	for k, v := range kvs.store {
-		totalSize += int64(len([]byte(k)) + len([]byte(v)))
+	for k, entry := range kvs.store {
+		if entry.expired(now) {
+			continue
+		}
+		keyCount++
+		totalSize += int64(len([]byte(k)) + len([]byte(entry.value)))
 	}
 
 	return StatusInfo{
-		KeyCount:    len(kvs.store),
-		MemoryUsage: totalSize,
+		KeyCount:       keyCount,
+		MemoryUsage:    totalSize,
+		Limits:         kvs.limits,
+		EvictionPolicy: kvs.eviction,
+		EvictedKeys:    kvs.evictions,
+	}
+}
+
+// checkConnAccess checks a stream connection against the access rules, logging refused connections
+// Returns whether the connection is refused and, unless it is silently dropped, the message to send before closing it
+func checkConnAccess(protocol string, conn net.Conn, ac *AccessControl) (ipStr string, refused bool, message string) {
+	ipStr, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+	ip := net.ParseIP(ipStr)
+
+	reason, mode := ac.CheckIP(ip, accessScope{})
+	if reason == "" {
+		return ipStr, false, ""
 	}
+	return ipStr, true, refusalMessage(protocol, "connect", ipStr, reason, mode)
 }
 
 // getIPFromRequest extracts the client IP address from a request
@@ -165,8 +820,26 @@ func logMessage(method, path, ip, msg string, rejected bool, statusCode ...int)
 // accessMiddleware checks if the request IP is allowed based on CIDR restrictions
 func accessMiddleware(ac *AccessControl, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// If no CIDR restrictions, allow all
-		if ac.AllowedCIDR == nil {
+		// Requests over the Unix socket have no IP; the peer uid is their identity instead
+		if cred, unix := unixPeerFromRequest(r); unix {
+			if ac.AllowedUIDs != nil && (cred == nil || !ac.AllowedUIDs[cred.UID]) {
+				logMessage(r.Method, r.URL.Path, clientIdentity(r), "Access denied (peer uid not allowed)", true, http.StatusForbidden)
+				sendJSONResponse(w, http.StatusForbidden, "Access denied: Your user is not allowed on this socket", "", "", nil)
+				return
+			}
+			next(w, r)
+			return
+		}
+
+		// With mutual TLS, only the listed client certificates are allowed
+		if ac.AllowedClients != nil && !ac.AllowedClients[clientCertCommonName(r)] {
+			logMessage(r.Method, r.URL.Path, clientIdentity(r), "Access denied (client certificate not allowed)", true, http.StatusForbidden)
+			sendJSONResponse(w, http.StatusForbidden, "Access denied: Your client certificate is not allowed", "", "", nil)
+			return
+		}
+
+		// If no access rules, allow all
+		if !ac.Restricted() {
 			next(w, r)
 			return
 		}
@@ -180,35 +853,11 @@ func accessMiddleware(ac *AccessControl, next http.HandlerFunc) http.HandlerFunc
 			return
 		}
 
-		// Check if IP is allowed
-		if !ac.AllowedCIDR.Contains(ip) {
-			// IP is not in allowed CIDR range - handle according to firewall mode
-			switch ac.FirewallMode {
-			case "DROP":
-				// Simulate firewall DROP behavior but still log the attempt
-				logMessage(r.Method, r.URL.Path, ip.String(), "DROPPED (fw-drop mode) - IP not in allowed CIDR", true, 0)
-				// Don't respond to the client - terminate the connection silently
-				// Using hijack to close the connection without sending a response
-				hj, ok := w.(http.Hijacker)
-				if ok {
-					conn, _, _ := hj.Hijack()
-					if conn != nil {
-						conn.Close()
-					}
-				}
-				return
-			case "REJECT":
-				// Simulate firewall REJECT behavior - actively refuse the connection
-				logMessage(r.Method, r.URL.Path, ip.String(), "REJECTED (fw-reject mode) - IP not in allowed CIDR", true, http.StatusForbidden)
-				// Send a "Connection Refused" type response
-				sendJSONResponse(w, http.StatusForbidden, "Connection rejected by firewall: Your IP is not in the allowed range", "", "", nil)
-				return
-			default: // "ACCEPT" or any other value - standard 403 response
-				// IP is not in allowed CIDR range - explicit reject with 403 Forbidden
-				logMessage(r.Method, r.URL.Path, ip.String(), "Access denied (IP not in allowed CIDR)", true, http.StatusForbidden)
-				sendJSONResponse(w, http.StatusForbidden, "Access denied: Your IP is not in the allowed range", "", "", nil)
-				return
-			}
+		// Check if IP is allowed on the route and for the command it runs
+		scope := accessScope{method: r.Method, route: r.URL.Path, command: routeCommands[r.URL.Path]}
+		if reason, mode := ac.CheckIP(ip, scope); reason != "" {
+			refuseRequest(w, r, ip.String(), reason, mode)
+			return
 		}
 
 		// IP is allowed, proceed to next handler
@@ -216,17 +865,58 @@ func accessMiddleware(ac *AccessControl, next http.HandlerFunc) http.HandlerFunc
 	}
 }
 
-// sendJSONResponse sends a standardized JSON response
-func sendJSONResponse(w http.ResponseWriter, status int, message string, key, value string, data interface{}) {
-	response := APIResponse{
-		Status:    status,
-		Message:   message,
-		TimeStamp: time.Now().Format(time.RFC3339),
+// refuseRequest answers a request refused by the access rules according to the firewall mode
+func refuseRequest(w http.ResponseWriter, r *http.Request, ipStr, reason, mode string) {
+	message := refusalMessage(r.Method, r.URL.Path, ipStr, reason, mode)
+	if message == "" {
+		// Don't respond to the client - terminate the connection silently
+		// Using hijack to close the connection without sending a response
+		hj, ok := w.(http.Hijacker)
+		if ok {
+			conn, _, _ := hj.Hijack()
+			if conn != nil {
+				conn.Close()
+			}
+		}
+		return
 	}
+	sendJSONResponse(w, http.StatusForbidden, message, "", "", nil)
+}
 
-	// Add key and value for 200 responses
-	if status == http.StatusOK && key != "" {
-		response.Key = key
+// checkRequestCommands applies the access rules for the commands a request runs, on top of those
+// accessMiddleware applied for its route
+// Returns false if the request was refused, in which case the response has been handled
+func checkRequestCommands(w http.ResponseWriter, r *http.Request, ac *AccessControl, commands []string) bool {
+	if _, unix := unixPeerFromRequest(r); unix || !ac.Restricted() {
+		return true
+	}
+
+	ip, err := getIPFromRequest(r)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "Failed to parse client IP", "", "", nil)
+		return false
+	}
+
+	for _, command := range commands {
+		if reason, mode := ac.CheckIP(ip, accessScope{method: r.Method, route: r.URL.Path, command: command}); reason != "" {
+			refuseRequest(w, r, ip.String(), reason, mode)
+			return false
+		}
+	}
+	return true
+}
+
+// sendJSONResponse sends a standardized JSON response
+func sendJSONResponse(w http.ResponseWriter, status int, message string, key, value string, data interface{}) {
+	response := APIResponse{
+		Status:    status,
+		Message:   message,
+		TimeStamp: time.Now().Format(time.RFC3339),
+	}
+
+	// Add key and value for 200 responses
+	if status == http.StatusOK && key != "" {
+		response.Key = key
 		response.Value = value
 	}
 
@@ -235,9 +925,14 @@ func sendJSONResponse(w http.ResponseWriter, status int, message string, key, va
 		response.Data = data
 	}
 
+	sendAPIResponse(w, response)
+}
+
+// sendAPIResponse sends an already populated APIResponse as JSON
+func sendAPIResponse(w http.ResponseWriter, response APIResponse) {
 	// Set content type and status code
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
+	w.WriteHeader(response.Status)
 
 	// Encode and send the response
 	if err := json.NewEncoder(w).Encode(response); err != nil {
@@ -249,73 +944,270 @@ func sendJSONResponse(w http.ResponseWriter, status int, message string, key, va
 	}
 }
 
-func main() {
-	// Parse command line arguments
-	listenAddr := flag.String("listen", ":8080", "Address and port to listen on (format: addr:port)")
-	allowedCIDR := flag.String("allowed-cidr", "", "CIDR range for allowed IPs (e.g., 192.168.1.0/24). If not set, all IPs are allowed")
-	fwDrop := flag.Bool("fw-drop", false, "If set, silently drops requests from non-allowed IPs (like a firewall DROP policy, with timeout)")
-	fwReject := flag.Bool("fw-reject", false, "If set, actively rejects connections from non-allowed IPs (like a firewall REJECT policy)")
-	udpMode := flag.Bool("udp", false, "Enable UDP mode instead of HTTP mode")
-	showVersion := flag.Bool("version", false, "Show version information and exit")
-
-	// For backward compatibility - to be deprecated
-	simulateFirewall := flag.Bool("simulate-firewall", false, "Deprecated: Please use --fw-drop instead")
-
-	// Override the default usage message
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Key-Value API Server version %s (%s)\n\n", Version, GitCommit)
-		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-		flag.PrintDefaults()
-		fmt.Fprintf(os.Stderr, "\nBuild time: %s\n", BuildTime)
+// decodeJSONBody decodes the JSON request body into v, rejecting unknown fields
+// and bodies larger than maxSize bytes
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}, maxSize int64) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid JSON body: %v", err)
 	}
+	return nil
+}
 
+func main() {
+	// Parse command line arguments
+	opts := registerFlags()
 	flag.Parse()
 
 	// Show version and exit if requested
-	if *showVersion {
+	if opts.ShowVersion {
 		fmt.Printf("Key-Value API Server version %s\n", Version)
 		fmt.Printf("Git commit: %s\n", GitCommit)
 		fmt.Printf("Build time: %s\n", BuildTime)
 		os.Exit(0)
 	}
 
+	if opts.SweepInterval <= 0 {
+		fmt.Printf("❌ Error: sweep interval must be positive\n")
+		os.Exit(1)
+	}
+
+	if opts.DataFile != "" && opts.SnapshotInterval <= 0 {
+		fmt.Printf("❌ Error: snapshot interval must be positive\n")
+		os.Exit(1)
+	}
+
+	fsyncPolicy, err := parseFsyncPolicy(opts.AOFFsync)
+	if err != nil {
+		fmt.Printf("❌ Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if opts.AOFMaxSize < 0 {
+		fmt.Printf("❌ Error: append-only log max size must not be negative\n")
+		os.Exit(1)
+	}
+
+	// Resolve settings: defaults, then config file, then environment, then explicit flags
+	cfg := Config{Limits: DefaultLimits(), Eviction: EvictionNone}
+	if opts.ConfigFile != "" {
+		if err := loadConfigFile(opts.ConfigFile, &cfg); err != nil {
+			fmt.Printf("❌ Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if err := applyEnvConfig(&cfg); err != nil {
+		fmt.Printf("❌ Error: %v\n", err)
+		os.Exit(1)
+	}
+	if flagWasSet("max-keys") {
+		cfg.MaxKeyCount = opts.MaxKeys
+	}
+	if flagWasSet("max-key-size") {
+		cfg.MaxKeySize = opts.MaxKeySize
+	}
+	if flagWasSet("max-value-size") {
+		cfg.MaxValueSize = opts.MaxValueSize
+	}
+	if flagWasSet("max-memory") {
+		cfg.MaxMemory = opts.MaxMemory
+	}
+	if flagWasSet("eviction") {
+		cfg.Eviction = opts.Eviction
+	}
+	if err := cfg.Limits.Validate(); err != nil {
+		fmt.Printf("❌ Error: %v\n", err)
+		os.Exit(1)
+	}
+	evictionPolicy, err := parseEvictionPolicy(cfg.Eviction)
+	if err != nil {
+		fmt.Printf("❌ Error: %v\n", err)
+		os.Exit(1)
+	}
+
 	// Initialize access control
 	var ac AccessControl
 
-	// Prepare protocol type for display
-	protocolType := "HTTP/TCP"
-	if *udpMode {
-		protocolType = "UDP"
+	// Resolve the listener addresses; every listener serves the same store
+	// --udp is kept for compatibility and moves --listen from HTTP to UDP
+	httpAddr := opts.Listen
+	udpAddr := opts.UDPListen
+	if opts.UDPMode {
+		httpAddr = ""
+		if udpAddr == "" {
+			udpAddr = opts.Listen
+		}
+	}
+	if flagWasSet("http-listen") {
+		httpAddr = opts.HTTPListen
+	}
+
+	// TLS options
+	if (opts.TLSCert == "") != (opts.TLSKey == "") {
+		fmt.Printf("❌ Error: --tls-cert and --tls-key must be set together\n")
+		os.Exit(1)
+	}
+	if opts.TLSClientCA != "" && opts.TLSCert == "" {
+		fmt.Printf("❌ Error: --tls-client-ca requires --tls-cert and --tls-key\n")
+		os.Exit(1)
+	}
+	if opts.TLSAllowedClients != "" && opts.TLSClientCA == "" {
+		fmt.Printf("❌ Error: --tls-allowed-clients requires --tls-client-ca\n")
+		os.Exit(1)
+	}
+	if opts.TLSCert != "" && httpAddr == "" {
+		fmt.Printf("❌ Error: TLS options require the HTTP listener\n")
+		os.Exit(1)
+	}
+	var tlsCerts *tlsReloader
+	httpProtocol := "HTTP/TCP"
+	if opts.TLSCert != "" {
+		tlsCerts, err = newTLSReloader(opts.TLSCert, opts.TLSKey, opts.TLSClientCA)
+		if err != nil {
+			fmt.Printf("❌ Error: %v\n", err)
+			os.Exit(1)
+		}
+		ac.AllowedClients = parseAllowedClients(opts.TLSAllowedClients)
+		httpProtocol = "HTTPS/TCP"
+	}
+
+	// Authentication
+	if opts.TokenFile != "" {
+		if opts.MemcacheListen != "" {
+			fmt.Printf("❌ Error: --token-file can't be combined with --memcache-listen, as the memcached protocol has no authentication\n")
+			os.Exit(1)
+		}
+		ac.Tokens, err = loadTokenFile(opts.TokenFile)
+		if err != nil {
+			fmt.Printf("❌ Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Trusted proxies
+	ac.TrustedProxies, err = parseTrustedProxies(opts.TrustedProxies)
+	if err != nil {
+		fmt.Printf("❌ Error: %v\n", err)
+		os.Exit(1)
+	}
+	if opts.ProxyProtocol && (len(ac.TrustedProxies) == 0 || httpAddr == "") {
+		fmt.Printf("❌ Error: --proxy-protocol requires --trusted-proxies and the HTTP listener\n")
+		os.Exit(1)
+	}
+
+	// Pages from other sites may only open WebSockets from the allowed origins
+	ac.AllowedOrigins, err = parseAllowedOrigins(opts.WSAllowedOrigins)
+	if err != nil {
+		fmt.Printf("❌ Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Signed UDP datagrams; the environment keeps the secret out of the process list
+	if opts.UDPSecret == "" {
+		opts.UDPSecret = os.Getenv("KVAPI_UDP_SECRET")
+	}
+	if opts.UDPSecret != "" {
+		if udpAddr == "" {
+			fmt.Printf("❌ Error: --udp-secret requires the UDP listener\n")
+			os.Exit(1)
+		}
+		ac.UDPVerifier = newUDPVerifier(opts.UDPSecret)
+	}
+
+	listeners := []struct {
+		protocol string
+		addr     string
+	}{
+		{httpProtocol, httpAddr},
+		{"HTTP/Unix socket", opts.UnixSocket},
+		{"UDP", udpAddr},
+		{"Redis (RESP2)", opts.RESPListen},
+		{"Memcached", opts.MemcacheListen},
+	}
+	var active []string
+	for _, l := range listeners {
+		if l.addr != "" {
+			active = append(active, fmt.Sprintf("%s on %s", l.protocol, l.addr))
+		}
+	}
+	if len(active) == 0 {
+		fmt.Printf("❌ Error: no listener configured\n")
+		os.Exit(1)
+	}
+
+	// Unix socket options
+	socketMode, err := parseSocketMode(opts.UnixSocketMode)
+	if err != nil {
+		fmt.Printf("❌ Error: %v\n", err)
+		os.Exit(1)
+	}
+	socketUID, socketGID, err := parseSocketOwner(opts.UnixSocketOwner)
+	if err != nil {
+		fmt.Printf("❌ Error: %v\n", err)
+		os.Exit(1)
+	}
+	ac.AllowedUIDs, err = parseAllowedUIDs(opts.UnixSocketUsers)
+	if err != nil {
+		fmt.Printf("❌ Error: %v\n", err)
+		os.Exit(1)
 	}
 
 	// Display startup information with emojis
-	fmt.Printf("\n🚀 Starting key-value API server v%s (%s) listening on %s\n", Version, GitCommit, *listenAddr)
+	fmt.Printf("\n🚀 Starting key-value API server v%s (%s) listening on %s\n", Version, GitCommit, strings.Join(active, ", "))
 
 	// Display applied rules based on command line switches
 	fmt.Println("\n✨ === APPLIED RULES === ✨")
 
 	// Network rules
 	fmt.Println("🌐 Network rules:")
-	fmt.Printf("  - Listen address: %s\n", *listenAddr)
-	fmt.Printf("  - Protocol: %s\n", protocolType)
+	for _, l := range listeners {
+		if l.addr != "" {
+			fmt.Printf("  - %s listener: %s\n", l.protocol, l.addr)
+		}
+	}
+	if tlsCerts != nil {
+		fmt.Printf("  - TLS certificate: %s (reloaded on SIGHUP)\n", opts.TLSCert)
+		if opts.TLSClientCA != "" {
+			fmt.Printf("  - Client certificates: required, verified against %s\n", opts.TLSClientCA)
+		}
+		if ac.AllowedClients != nil {
+			fmt.Printf("  - Allowed client certificates: %s\n", opts.TLSAllowedClients)
+		}
+	}
 
-	// IP access rules
+	// IP access rules: --allowed-cidr, then the access file, then --allow, --deny and --rule in command line order
 	fmt.Println("🔒 IP access rules:")
-	if *allowedCIDR != "" {
-		_, ipNet, err := net.ParseCIDR(*allowedCIDR)
+	if opts.AllowedCIDR != "" {
+		rule, err := parseAccessRule(RuleAllow, opts.AllowedCIDR)
 		if err != nil {
 			fmt.Printf("❌ Error parsing CIDR: %v\n", err)
 			os.Exit(1)
 		}
-		ac.AllowedCIDR = ipNet
-		fmt.Printf("  - Restricted to CIDR: %s\n", *allowedCIDR)
+		ac.Rules = append(ac.Rules, rule)
+	}
+	if opts.AccessFile != "" {
+		rules, err := loadAccessFile(opts.AccessFile)
+		if err != nil {
+			fmt.Printf("❌ Error: %v\n", err)
+			os.Exit(1)
+		}
+		ac.Rules = append(ac.Rules, rules...)
+	}
+	ac.Rules = append(ac.Rules, opts.Rules...)
+	if ac.Restricted() {
+		for i, rule := range ac.Rules {
+			fmt.Printf("  - Rule %d: %s\n", i+1, rule)
+		}
+		fmt.Printf("  - Deny rules win; with allow rules, IPs matching none of them are refused\n")
+		fmt.Printf("  - Allow rules scoped to a route or command replace the unscoped allow rules there\n")
 
 		// Handle firewall flags (set the FirewallMode to the appropriate value)
 		// Support backward compatibility with --simulate-firewall as well
-		if *fwDrop || *simulateFirewall {
+		if opts.FwDrop || opts.SimulateFirewall {
 			fmt.Printf("  - Firewall behavior: SILENTLY DROP non-matching IPs ⚠️\n")
 			ac.FirewallMode = "DROP"
-		} else if *fwReject {
+		} else if opts.FwReject {
 			fmt.Printf("  - Firewall behavior: ACTIVELY REJECT non-matching IPs ⚠️\n")
 			ac.FirewallMode = "REJECT"
 		} else {
@@ -327,30 +1219,165 @@ func main() {
 		fmt.Printf("  - Firewall behavior: ACCEPT ALL\n")
 		ac.FirewallMode = "ACCEPT"
 	}
+	if len(ac.TrustedProxies) > 0 {
+		fmt.Printf("  - Trusted proxies: %s (client IP taken from Forwarded or X-Forwarded-For)\n", opts.TrustedProxies)
+		if opts.ProxyProtocol {
+			fmt.Printf("  - PROXY protocol v1/v2 accepted from trusted proxies on %s\n", httpAddr)
+		}
+	}
+	if len(ac.AllowedOrigins) > 0 {
+		fmt.Printf("  - WebSocket origins allowed without a token: %s\n", strings.Join(ac.AllowedOrigins, ", "))
+	}
+	if opts.UnixSocket != "" {
+		fmt.Printf("  - Unix socket: mode %04o, clients identified by peer uid instead of IP\n", socketMode)
+		if opts.UnixSocketOwner != "" {
+			fmt.Printf("  - Unix socket owner: %s\n", opts.UnixSocketOwner)
+		}
+		if ac.AllowedUIDs != nil {
+			fmt.Printf("  - Unix socket restricted to uids: %s\n", formatUIDs(ac.AllowedUIDs))
+		} else {
+			fmt.Printf("  - Unix socket open to every user permitted by its file mode\n")
+		}
+	}
+
+	// Authentication rules
+	fmt.Println("🔑 Authentication:")
+	if ac.Tokens != nil {
+		fmt.Printf("  - Bearer tokens required: %d tokens loaded from %s\n", ac.Tokens.Count(), opts.TokenFile)
+		if udpAddr != "" {
+			fmt.Printf("  - UDP commands must be sent as AUTH <token> <command>\n")
+		}
+		if opts.RESPListen != "" {
+			fmt.Printf("  - Redis clients must send AUTH <token> first\n")
+		}
+	} else {
+		fmt.Printf("  - No authentication (anyone allowed by the access rules has full access) ⚠️\n")
+	}
+	if ac.UDPVerifier != nil {
+		fmt.Printf("  - UDP datagrams must be signed with HMAC-SHA256 (clock skew up to %s, replays rejected)\n", UDPSignatureMaxSkew)
+	} else if udpAddr != "" {
+		fmt.Printf("  - UDP datagrams are not signed (source addresses can be spoofed) ⚠️\n")
+	}
 
 	// Resource limits
 	fmt.Println("📊 Resource limits:")
-	fmt.Printf("  - Maximum keys: %d\n", MaxKeyCount)
-	fmt.Printf("  - Maximum key size: %d bytes\n", MaxKeySize)
-	fmt.Printf("  - Maximum value size: %d bytes (%d MB)\n", MaxValueSize, MaxValueSize/1024/1024)
+	fmt.Printf("  - Maximum keys: %d\n", cfg.MaxKeyCount)
+	fmt.Printf("  - Maximum key size: %d bytes\n", cfg.MaxKeySize)
+	if cfg.MaxValueSize >= 1024*1024 {
+		fmt.Printf("  - Maximum value size: %d bytes (%d MB)\n", cfg.MaxValueSize, cfg.MaxValueSize/1024/1024)
+	} else {
+		fmt.Printf("  - Maximum value size: %d bytes\n", cfg.MaxValueSize)
+	}
+	if cfg.MaxMemory > 0 {
+		fmt.Printf("  - Memory budget: %d bytes\n", cfg.MaxMemory)
+	} else {
+		fmt.Printf("  - Memory budget: unlimited ⚠️\n")
+	}
+	if evictionPolicy == EvictionNone {
+		fmt.Printf("  - Eviction policy: %s (writes fail when full)\n", evictionPolicy)
+	} else {
+		fmt.Printf("  - Eviction policy: %s\n", evictionPolicy)
+	}
+	fmt.Printf("  - Expired key sweep interval: %s\n", opts.SweepInterval)
+
+	// Persistence
+	fmt.Println("💾 Persistence:")
+	if opts.DataFile != "" {
+		fmt.Printf("  - Data file: %s\n", opts.DataFile)
+		fmt.Printf("  - Snapshot interval: %s (and on shutdown)\n", opts.SnapshotInterval)
+	}
+	if opts.AOFFile != "" {
+		fmt.Printf("  - Append-only log: %s\n", opts.AOFFile)
+		fmt.Printf("  - Append-only log fsync: %s\n", fsyncPolicy)
+		if opts.AOFMaxSize > 0 {
+			fmt.Printf("  - Append-only log compaction after: %d bytes\n", opts.AOFMaxSize)
+		} else {
+			fmt.Printf("  - Append-only log compaction: disabled\n")
+		}
+	}
+	if opts.DataFile == "" && opts.AOFFile == "" {
+		fmt.Printf("  - In-memory only (data is lost on restart) ⚠️\n")
+	}
 	fmt.Printf("✨============================✨\n\n")
 
 	// Create KeyValueStore
-	kvs := NewKeyValueStore()
+	kvs := NewKeyValueStore(cfg.Limits)
+	kvs.SetEvictionPolicy(evictionPolicy)
 
-	// Start server based on mode
-	if *udpMode {
-		// Start UDP server
-		fmt.Println("📡 UDP server is ready to accept connections! Press Ctrl+C to stop.")
-		startUDPServer(*listenAddr, kvs, &ac)
-	} else {
-		// Continue with HTTP server setup
+	var shutdownHooks []func()
+
+	// Restore the last snapshot before any listener starts accepting requests
+	if opts.DataFile != "" {
+		count, err := loadSnapshot(opts.DataFile, kvs)
+		if err != nil {
+			fmt.Printf("❌ Error loading data file %s: %v\n", opts.DataFile, err)
+			os.Exit(1)
+		}
+		fmt.Printf("💾 Restored %d keys from %s\n", count, opts.DataFile)
+
+		startSnapshotter(opts.DataFile, opts.SnapshotInterval, kvs)
+		shutdownHooks = append(shutdownHooks, func() {
+			count, err := saveSnapshot(opts.DataFile, kvs)
+			if err != nil {
+				fmt.Printf("❌ Error writing snapshot on shutdown: %v\n", err)
+				return
+			}
+			fmt.Printf("💾 Wrote snapshot with %d keys to %s\n", count, opts.DataFile)
+		})
+	}
+
+	// Replay the append-only log on top of the snapshot; it holds every write since it was last compacted
+	if opts.AOFFile != "" {
+		aof, replayed, err := openAppendLog(opts.AOFFile, fsyncPolicy, opts.AOFMaxSize, kvs)
+		if err != nil {
+			fmt.Printf("❌ Error loading append-only log %s: %v\n", opts.AOFFile, err)
+			os.Exit(1)
+		}
+		fmt.Printf("💾 Replayed %d records from %s\n", replayed, opts.AOFFile)
+
+		kvs.SetAppendLog(aof)
+
+		// A new log starts with the full current state so it never depends on an older snapshot
+		if aof.Size() == 0 {
+			if err := kvs.CompactAppendLog(); err != nil {
+				fmt.Printf("❌ Error initializing append-only log %s: %v\n", opts.AOFFile, err)
+				os.Exit(1)
+			}
+		}
+
+		startAppendLogWorker(aof, kvs)
+
+		// Versions survive a restart only if no acknowledged write can be lost
+		if fsyncPolicy == FsyncAlways {
+			etagEpoch = ""
+		}
+
+		shutdownHooks = append(shutdownHooks, func() {
+			if err := aof.Close(); err != nil {
+				fmt.Printf("❌ Error closing append-only log: %v\n", err)
+			}
+		})
+	}
+
+	if len(shutdownHooks) > 0 {
+		handleShutdown(func() {
+			for _, hook := range shutdownHooks {
+				hook()
+			}
+		})
+	}
+
+	kvs.StartExpirySweeper(opts.SweepInterval)
+
+	// Handler shared by the HTTP listener and the Unix socket
+	var handler http.Handler
+	if httpAddr != "" || opts.UnixSocket != "" {
+		// HTTP server setup
 		mux := http.NewServeMux()
 
 		// Ping endpoint
 		mux.HandleFunc("/api/ping", accessMiddleware(&ac, func(w http.ResponseWriter, r *http.Request) {
-			ip, _ := getIPFromRequest(r)
-			ipStr := ip.String()
+			ipStr := clientIdentity(r)
 
 			if r.Method != http.MethodGet {
 				logMessage(r.Method, r.URL.Path, ipStr, "Method not allowed", false, http.StatusMethodNotAllowed)
@@ -363,9 +1390,8 @@ func main() {
 		}))
 
 		// Status endpoint
-		mux.HandleFunc("/api/status", accessMiddleware(&ac, func(w http.ResponseWriter, r *http.Request) {
-			ip, _ := getIPFromRequest(r)
-			ipStr := ip.String()
+		mux.HandleFunc("/api/status", accessMiddleware(&ac, authMiddleware(ac.Tokens, RoleAdmin, func(w http.ResponseWriter, r *http.Request) {
+			ipStr := clientIdentity(r)
 
 			if r.Method != http.MethodGet {
 				logMessage(r.Method, r.URL.Path, ipStr, "Method not allowed", false, http.StatusMethodNotAllowed)
@@ -376,12 +1402,25 @@ func main() {
 			status := kvs.GetStatus()
 			logMessage(r.Method, r.URL.Path, ipStr, fmt.Sprintf("Status: %d keys, %d bytes", status.KeyCount, status.MemoryUsage), false, http.StatusOK)
 			sendJSONResponse(w, http.StatusOK, "Status retrieved successfully", "status", "", status)
-		}))
+		})))
+
+		// Access rules endpoint
+		mux.HandleFunc("/api/access", accessMiddleware(&ac, authMiddleware(ac.Tokens, RoleAdmin, func(w http.ResponseWriter, r *http.Request) {
+			ipStr := clientIdentity(r)
+
+			if r.Method != http.MethodGet {
+				logMessage(r.Method, r.URL.Path, ipStr, "Method not allowed", false, http.StatusMethodNotAllowed)
+				sendJSONResponse(w, http.StatusMethodNotAllowed, "Method not allowed", "", "", nil)
+				return
+			}
+
+			logMessage(r.Method, r.URL.Path, ipStr, fmt.Sprintf("Access rules: %d rules", len(ac.Rules)), false, http.StatusOK)
+			sendJSONResponse(w, http.StatusOK, "Access rules retrieved successfully", "access", "", ac.Info())
+		})))
 
 		// Get value endpoint
-		mux.HandleFunc("/api/get", accessMiddleware(&ac, func(w http.ResponseWriter, r *http.Request) {
-			ip, _ := getIPFromRequest(r)
-			ipStr := ip.String()
+		mux.HandleFunc("/api/get", accessMiddleware(&ac, authMiddleware(ac.Tokens, RoleRead, func(w http.ResponseWriter, r *http.Request) {
+			ipStr := clientIdentity(r)
 
 			if r.Method != http.MethodGet {
 				logMessage(r.Method, r.URL.Path, ipStr, "Method not allowed", false, http.StatusMethodNotAllowed)
@@ -395,62 +1434,488 @@ func main() {
 				sendJSONResponse(w, http.StatusBadRequest, "Missing key parameter", "", "", nil)
 				return
 			}
+			if !authorizeRequest(w, r, ipStr, permission{role: RoleRead, keys: []string{key}}) {
+				return
+			}
 
-			value, exists := kvs.Get(key)
+			item, exists := kvs.GetItem(key)
 			if !exists {
 				logMessage(r.Method, r.URL.Path, ipStr, fmt.Sprintf("Key '%s' not found", key), false, http.StatusNotFound)
 				sendJSONResponse(w, http.StatusNotFound, fmt.Sprintf("Key '%s' not found", key), key, "", nil)
 				return
 			}
 
-			logMessage(r.Method, r.URL.Path, ipStr, fmt.Sprintf("Retrieved key '%s' with value '%s'", key, value), false, http.StatusOK)
-			sendJSONResponse(w, http.StatusOK, "Key retrieved successfully", key, value, nil)
-		}))
+			etag := formatETag(item.Version)
+			w.Header().Set("ETag", etag)
+			if notModified(r, etag) {
+				logMessage(r.Method, r.URL.Path, ipStr, fmt.Sprintf("Key '%s' not modified", key), false, http.StatusNotModified)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+
+			logMessage(r.Method, r.URL.Path, ipStr, fmt.Sprintf("Retrieved key '%s' with value '%s'", key, item.Value), false, http.StatusOK)
+			sendAPIResponse(w, APIResponse{
+				Status:    http.StatusOK,
+				Message:   "Key retrieved successfully",
+				Key:       key,
+				Value:     item.Value,
+				Version:   item.Version,
+				TTL:       ttlSeconds(item.TTL),
+				TimeStamp: time.Now().Format(time.RFC3339),
+			})
+		})))
+
+		// Set value endpoint
+		mux.HandleFunc("/api/set", accessMiddleware(&ac, authMiddleware(ac.Tokens, RoleWrite, func(w http.ResponseWriter, r *http.Request) {
+			ipStr := clientIdentity(r)
+
+			if r.Method != http.MethodPost && r.Method != http.MethodPut {
+				logMessage(r.Method, r.URL.Path, ipStr, "Method not allowed", false, http.StatusMethodNotAllowed)
+				sendJSONResponse(w, http.StatusMethodNotAllowed, "Method not allowed", "", "", nil)
+				return
+			}
+
+			// Parameters may be passed in the query string or as a form-encoded body
+			key := r.FormValue("k")
+			value := r.FormValue("v")
+
+			if key == "" {
+				logMessage(r.Method, r.URL.Path, ipStr, "Missing key parameter", false, http.StatusBadRequest)
+				sendJSONResponse(w, http.StatusBadRequest, "Missing key parameter", "", "", nil)
+				return
+			}
+
+			if value == "" {
+				logMessage(r.Method, r.URL.Path, ipStr, "Missing value parameter", false, http.StatusBadRequest)
+				sendJSONResponse(w, http.StatusBadRequest, "Missing value parameter", "", "", nil)
+				return
+			}
+
+			if !authorizeRequest(w, r, ipStr, permission{role: RoleWrite, keys: []string{key}}) {
+				return
+			}
+
+			ttl, err := parseTTL(r.FormValue("ttl"))
+			if err != nil {
+				logMessage(r.Method, r.URL.Path, ipStr, err.Error(), false, http.StatusBadRequest)
+				sendJSONResponse(w, http.StatusBadRequest, err.Error(), key, "", nil)
+				return
+			}
+
+			cond, err := parseSetCondition(r.FormValue("version"), r.FormValue("nx"), r.FormValue("xx"))
+			if err != nil {
+				logMessage(r.Method, r.URL.Path, ipStr, err.Error(), false, http.StatusBadRequest)
+				sendJSONResponse(w, http.StatusBadRequest, err.Error(), key, "", nil)
+				return
+			}
+
+			// If-Match and If-None-Match headers express the same conditions in HTTP terms
+			cond, hasPrecondition, err := preconditionFromHeaders(r, cond, func() uint64 {
+				item, _ := kvs.GetItem(key)
+				return item.Version
+			})
+			if err != nil {
+				status := http.StatusBadRequest
+				if errors.Is(err, ErrConflict) {
+					status = http.StatusPreconditionFailed
+				}
+				logMessage(r.Method, r.URL.Path, ipStr, err.Error(), false, status)
+				sendJSONResponse(w, status, err.Error(), key, "", nil)
+				return
+			}
+
+			version, err := kvs.SetIf(key, value, ttl, cond)
+			if err != nil {
+				status := writeErrorStatus(err)
+				if hasPrecondition && status == http.StatusConflict {
+					status = http.StatusPreconditionFailed
+				}
+				logMessage(r.Method, r.URL.Path, ipStr, fmt.Sprintf("Error setting key '%s': %v", key, err), false, status)
+				sendJSONResponse(w, status, err.Error(), key, "", nil)
+				return
+			}
+
+			if ttl > 0 {
+				logMessage(r.Method, r.URL.Path, ipStr, fmt.Sprintf("Set key '%s' to value '%s' with TTL %s", key, value, ttl), false, http.StatusOK)
+			} else {
+				logMessage(r.Method, r.URL.Path, ipStr, fmt.Sprintf("Set key '%s' to value '%s'", key, value), false, http.StatusOK)
+			}
+			w.Header().Set("ETag", formatETag(version))
+			sendAPIResponse(w, APIResponse{
+				Status:    http.StatusOK,
+				Message:   "Key set successfully",
+				Key:       key,
+				Value:     value,
+				Version:   version,
+				TTL:       ttlSeconds(ttl),
+				TimeStamp: time.Now().Format(time.RFC3339),
+			})
+		})))
+
+		// Counter endpoint
+		mux.HandleFunc("/api/incr", accessMiddleware(&ac, authMiddleware(ac.Tokens, RoleWrite, func(w http.ResponseWriter, r *http.Request) {
+			ipStr := clientIdentity(r)
+
+			if r.Method != http.MethodPost && r.Method != http.MethodPut {
+				logMessage(r.Method, r.URL.Path, ipStr, "Method not allowed", false, http.StatusMethodNotAllowed)
+				sendJSONResponse(w, http.StatusMethodNotAllowed, "Method not allowed", "", "", nil)
+				return
+			}
+
+			key := r.FormValue("k")
+			if key == "" {
+				logMessage(r.Method, r.URL.Path, ipStr, "Missing key parameter", false, http.StatusBadRequest)
+				sendJSONResponse(w, http.StatusBadRequest, "Missing key parameter", "", "", nil)
+				return
+			}
+			if !authorizeRequest(w, r, ipStr, permission{role: RoleWrite, keys: []string{key}}) {
+				return
+			}
+
+			delta, err := parseIncrement(r.FormValue("by"))
+			if err != nil {
+				logMessage(r.Method, r.URL.Path, ipStr, err.Error(), false, http.StatusBadRequest)
+				sendJSONResponse(w, http.StatusBadRequest, err.Error(), key, "", nil)
+				return
+			}
+
+			value, version, err := kvs.IncrBy(key, delta)
+			if err != nil {
+				logMessage(r.Method, r.URL.Path, ipStr, fmt.Sprintf("Error incrementing key '%s': %v", key, err), false, http.StatusBadRequest)
+				sendJSONResponse(w, http.StatusBadRequest, err.Error(), key, "", nil)
+				return
+			}
+
+			logMessage(r.Method, r.URL.Path, ipStr, fmt.Sprintf("Incremented key '%s' by %d to %d", key, delta, value), false, http.StatusOK)
+			w.Header().Set("ETag", formatETag(version))
+			sendAPIResponse(w, APIResponse{
+				Status:    http.StatusOK,
+				Message:   "Key incremented successfully",
+				Key:       key,
+				Value:     strconv.FormatInt(value, 10),
+				Version:   version,
+				TimeStamp: time.Now().Format(time.RFC3339),
+			})
+		})))
+
+		// Batch get endpoint
+		mux.HandleFunc("/api/mget", accessMiddleware(&ac, authMiddleware(ac.Tokens, RoleRead, func(w http.ResponseWriter, r *http.Request) {
+			ipStr := clientIdentity(r)
+
+			if r.Method != http.MethodPost {
+				logMessage(r.Method, r.URL.Path, ipStr, "Method not allowed", false, http.StatusMethodNotAllowed)
+				sendJSONResponse(w, http.StatusMethodNotAllowed, "Method not allowed", "", "", nil)
+				return
+			}
+
+			var req struct {
+				Keys []string `json:"keys"`
+			}
+			if err := decodeJSONBody(w, r, &req, MaxBatchBodySize); err != nil {
+				logMessage(r.Method, r.URL.Path, ipStr, err.Error(), false, http.StatusBadRequest)
+				sendJSONResponse(w, http.StatusBadRequest, err.Error(), "", "", nil)
+				return
+			}
+
+			if !authorizeRequest(w, r, ipStr, permission{role: RoleRead, keys: req.Keys}) {
+				return
+			}
+
+			result, err := kvs.MGet(req.Keys)
+			if err != nil {
+				logMessage(r.Method, r.URL.Path, ipStr, err.Error(), false, http.StatusBadRequest)
+				sendJSONResponse(w, http.StatusBadRequest, err.Error(), "", "", nil)
+				return
+			}
+
+			logMessage(r.Method, r.URL.Path, ipStr, fmt.Sprintf("Retrieved %d of %d keys", len(result.Items), len(result.Items)+len(result.Missing)), false, http.StatusOK)
+			sendJSONResponse(w, http.StatusOK, "Keys retrieved successfully", "mget", "", result)
+		})))
+
+		// Batch set endpoint
+		mux.HandleFunc("/api/mset", accessMiddleware(&ac, authMiddleware(ac.Tokens, RoleWrite, func(w http.ResponseWriter, r *http.Request) {
+			ipStr := clientIdentity(r)
+
+			if r.Method != http.MethodPost && r.Method != http.MethodPut {
+				logMessage(r.Method, r.URL.Path, ipStr, "Method not allowed", false, http.StatusMethodNotAllowed)
+				sendJSONResponse(w, http.StatusMethodNotAllowed, "Method not allowed", "", "", nil)
+				return
+			}
+
+			var req struct {
+				Items []BatchItem `json:"items"`
+			}
+			if err := decodeJSONBody(w, r, &req, MaxBatchBodySize); err != nil {
+				logMessage(r.Method, r.URL.Path, ipStr, err.Error(), false, http.StatusBadRequest)
+				sendJSONResponse(w, http.StatusBadRequest, err.Error(), "", "", nil)
+				return
+			}
+
+			keys := make([]string, len(req.Items))
+			for i, item := range req.Items {
+				keys[i] = item.Key
+			}
+			if !authorizeRequest(w, r, ipStr, permission{role: RoleWrite, keys: keys}) {
+				return
+			}
+
+			result, err := kvs.MSet(req.Items)
+			if err != nil {
+				logMessage(r.Method, r.URL.Path, ipStr, fmt.Sprintf("Error setting batch of %d keys: %v", len(req.Items), err), false, http.StatusBadRequest)
+				sendJSONResponse(w, http.StatusBadRequest, err.Error(), "", "", nil)
+				return
+			}
+
+			logMessage(r.Method, r.URL.Path, ipStr, fmt.Sprintf("Set %d keys at version %d", result.Count, result.Version), false, http.StatusOK)
+			sendAPIResponse(w, APIResponse{
+				Status:    http.StatusOK,
+				Message:   "Keys set successfully",
+				Key:       "mset",
+				Version:   result.Version,
+				Data:      result,
+				TimeStamp: time.Now().Format(time.RFC3339),
+			})
+		})))
+
+		// Transaction endpoint
+		mux.HandleFunc("/api/txn", accessMiddleware(&ac, authMiddleware(ac.Tokens, RoleRead, func(w http.ResponseWriter, r *http.Request) {
+			ipStr := clientIdentity(r)
+
+			if r.Method != http.MethodPost {
+				logMessage(r.Method, r.URL.Path, ipStr, "Method not allowed", false, http.StatusMethodNotAllowed)
+				sendJSONResponse(w, http.StatusMethodNotAllowed, "Method not allowed", "", "", nil)
+				return
+			}
+
+			var txn TxnRequest
+			if err := decodeJSONBody(w, r, &txn, MaxBatchBodySize); err != nil {
+				logMessage(r.Method, r.URL.Path, ipStr, err.Error(), false, http.StatusBadRequest)
+				sendJSONResponse(w, http.StatusBadRequest, err.Error(), "", "", nil)
+				return
+			}
+
+			if !authorizeRequest(w, r, ipStr, txnPermission(txn)) {
+				return
+			}
+			if !checkRequestCommands(w, r, &ac, txn.commands()) {
+				return
+			}
+
+			result, err := kvs.Txn(txn)
+			if err != nil {
+				logMessage(r.Method, r.URL.Path, ipStr, fmt.Sprintf("Error executing transaction: %v", err), false, http.StatusBadRequest)
+				sendJSONResponse(w, http.StatusBadRequest, err.Error(), "", "", nil)
+				return
+			}
+
+			message := "Transaction succeeded"
+			if !result.Succeeded {
+				message = "Transaction compare failed, failure operations executed"
+			}
+			logMessage(r.Method, r.URL.Path, ipStr, fmt.Sprintf("%s (%d operations, revision %d)", message, len(result.Results), result.Revision), false, http.StatusOK)
+			sendAPIResponse(w, APIResponse{
+				Status:    http.StatusOK,
+				Message:   message,
+				Key:       "txn",
+				Version:   result.Revision,
+				Data:      result,
+				TimeStamp: time.Now().Format(time.RFC3339),
+			})
+		})))
+
+		// Watch endpoint streaming change events as Server-Sent Events
+		mux.HandleFunc("/api/watch", accessMiddleware(&ac, authMiddleware(ac.Tokens, RoleRead, func(w http.ResponseWriter, r *http.Request) {
+			ipStr := clientIdentity(r)
+
+			if r.Method != http.MethodGet {
+				logMessage(r.Method, r.URL.Path, ipStr, "Method not allowed", false, http.StatusMethodNotAllowed)
+				sendJSONResponse(w, http.StatusMethodNotAllowed, "Method not allowed", "", "", nil)
+				return
+			}
+
+			flusher, ok := w.(http.Flusher)
+			if !ok {
+				logMessage(r.Method, r.URL.Path, ipStr, "Streaming not supported", false, http.StatusInternalServerError)
+				sendJSONResponse(w, http.StatusInternalServerError, "Streaming not supported", "", "", nil)
+				return
+			}
+
+			filter := WatchFilter{Key: r.URL.Query().Get("k"), Prefix: r.URL.Query().Get("prefix")}
+			if !authorizeRequest(w, r, ipStr, watchPermission(filter)) {
+				return
+			}
+
+			// Resume after the given revision or event; EventSource clients send the last event id on reconnect
+			revisionParam := r.URL.Query().Get("revision")
+			if revisionParam == "" {
+				revisionParam = r.Header.Get("Last-Event-ID")
+			}
+			var from WatchPosition
+			if revisionParam != "" {
+				var err error
+				from, err = parseWatchPosition(revisionParam)
+				if err != nil {
+					logMessage(r.Method, r.URL.Path, ipStr, err.Error(), false, http.StatusBadRequest)
+					sendJSONResponse(w, http.StatusBadRequest, err.Error(), "", "", nil)
+					return
+				}
+			}
+
+			watcher, backlog, revision, err := kvs.Watch(filter, from)
+			if err != nil {
+				status := http.StatusBadRequest
+				if errors.Is(err, ErrCompacted) {
+					status = http.StatusGone
+				}
+				logMessage(r.Method, r.URL.Path, ipStr, err.Error(), false, status)
+				sendJSONResponse(w, status, err.Error(), "", "", nil)
+				return
+			}
+			defer watcher.Cancel()
+
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("Connection", "keep-alive")
+			w.Header().Set("X-Accel-Buffering", "no")
+			w.WriteHeader(http.StatusOK)
+
+			logMessage(r.Method, r.URL.Path, ipStr, fmt.Sprintf("Watch started at revision %d (key: '%s', prefix: '%s')", revision, filter.Key, filter.Prefix), false, http.StatusOK)
+
+			fmt.Fprintf(w, ": watching from revision %d\n\n", revision)
+			for _, ev := range backlog {
+				if writeSSEEvent(w, ev) != nil {
+					return
+				}
+			}
+			flusher.Flush()
+
+			heartbeat := time.NewTicker(WatchHeartbeatInterval)
+			defer heartbeat.Stop()
+
+			for {
+				select {
+				case <-r.Context().Done():
+					logMessage(r.Method, r.URL.Path, ipStr, "Watch closed by client", false, http.StatusOK)
+					return
+				case ev, ok := <-watcher.Events:
+					if !ok {
+						// Dropped for falling behind; the client can resume from its last event id
+						fmt.Fprintf(w, "event: error\ndata: {\"message\":\"watcher fell behind, reconnect to resume\"}\n\n")
+						flusher.Flush()
+						logMessage(r.Method, r.URL.Path, ipStr, "Watch dropped for falling behind", false, http.StatusOK)
+						return
+					}
+					if writeSSEEvent(w, ev) != nil {
+						return
+					}
+					flusher.Flush()
+				case <-heartbeat.C:
+					if _, err := fmt.Fprintf(w, ": keepalive\n\n"); err != nil {
+						return
+					}
+					flusher.Flush()
+				}
+			}
+		})))
+
+		// WebSocket endpoint accepting the UDP command set plus subscriptions
+		mux.HandleFunc("/api/ws", accessMiddleware(&ac, authMiddleware(ac.Tokens, RoleRead, func(w http.ResponseWriter, r *http.Request) {
+			ipStr := clientIdentity(r)
+
+			if err := checkWebSocketOrigin(r, ac.AllowedOrigins); err != nil {
+				logMessage(r.Method, r.URL.Path, ipStr, err.Error(), true, http.StatusForbidden)
+				sendJSONResponse(w, http.StatusForbidden, err.Error(), "", "", nil)
+				return
+			}
+
+			conn, err := upgradeWebSocket(w, r, MaxBatchBodySize)
+			if err != nil {
+				logMessage(r.Method, r.URL.Path, ipStr, fmt.Sprintf("WebSocket upgrade failed: %v", err), false, http.StatusBadRequest)
+				sendJSONResponse(w, http.StatusBadRequest, err.Error(), "", "", nil)
+				return
+			}
+
+			// Each command is checked against the access rules for it, except over the Unix socket
+			var ip net.IP
+			if _, unix := unixPeerFromRequest(r); !unix {
+				ip, _ = getIPFromRequest(r)
+			}
+
+			logMessage(r.Method, r.URL.Path, ipStr, "WebSocket connection opened", false, http.StatusSwitchingProtocols)
+			serveWebSocket(conn, ip, ipStr, kvs, &ac, tokenFromRequest(r))
+		})))
+
+		// Delete value endpoint
+		mux.HandleFunc("/api/delete", accessMiddleware(&ac, authMiddleware(ac.Tokens, RoleWrite, func(w http.ResponseWriter, r *http.Request) {
+			ipStr := clientIdentity(r)
+
+			if r.Method != http.MethodDelete && r.Method != http.MethodPost {
+				logMessage(r.Method, r.URL.Path, ipStr, "Method not allowed", false, http.StatusMethodNotAllowed)
+				sendJSONResponse(w, http.StatusMethodNotAllowed, "Method not allowed", "", "", nil)
+				return
+			}
+
+			key := r.URL.Query().Get("k")
+			if key == "" {
+				logMessage(r.Method, r.URL.Path, ipStr, "Missing key parameter", false, http.StatusBadRequest)
+				sendJSONResponse(w, http.StatusBadRequest, "Missing key parameter", "", "", nil)
+				return
+			}
+			if !authorizeRequest(w, r, ipStr, permission{role: RoleWrite, keys: []string{key}}) {
+				return
+			}
+
+			if !kvs.Delete(key) {
+				logMessage(r.Method, r.URL.Path, ipStr, fmt.Sprintf("Key '%s' not found", key), false, http.StatusNotFound)
+				sendJSONResponse(w, http.StatusNotFound, fmt.Sprintf("Key '%s' not found", key), key, "", nil)
+				return
+			}
+
+			logMessage(r.Method, r.URL.Path, ipStr, fmt.Sprintf("Deleted key '%s'", key), false, http.StatusOK)
+			sendJSONResponse(w, http.StatusOK, "Key deleted successfully", key, "", nil)
+		})))
 
-		// Set value endpoint
-		mux.HandleFunc("/api/set", accessMiddleware(&ac, func(w http.ResponseWriter, r *http.Request) {
-			ip, _ := getIPFromRequest(r)
-			ipStr := ip.String()
+		// List keys endpoint
+		mux.HandleFunc("/api/keys", accessMiddleware(&ac, authMiddleware(ac.Tokens, RoleRead, func(w http.ResponseWriter, r *http.Request) {
+			ipStr := clientIdentity(r)
 
-			if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			if r.Method != http.MethodGet {
 				logMessage(r.Method, r.URL.Path, ipStr, "Method not allowed", false, http.StatusMethodNotAllowed)
 				sendJSONResponse(w, http.StatusMethodNotAllowed, "Method not allowed", "", "", nil)
 				return
 			}
 
-			key := r.URL.Query().Get("k")
-			value := r.URL.Query().Get("v")
-
-			if key == "" {
-				logMessage(r.Method, r.URL.Path, ipStr, "Missing key parameter", false, http.StatusBadRequest)
-				sendJSONResponse(w, http.StatusBadRequest, "Missing key parameter", "", "", nil)
+			limit, err := parseKeysLimit(r.URL.Query().Get("limit"))
+			if err != nil {
+				logMessage(r.Method, r.URL.Path, ipStr, err.Error(), false, http.StatusBadRequest)
+				sendJSONResponse(w, http.StatusBadRequest, err.Error(), "", "", nil)
 				return
 			}
 
-			if value == "" {
-				logMessage(r.Method, r.URL.Path, ipStr, "Missing value parameter", false, http.StatusBadRequest)
-				sendJSONResponse(w, http.StatusBadRequest, "Missing value parameter", "", "", nil)
+			query := KeysQuery{
+				Prefix: r.URL.Query().Get("prefix"),
+				Match:  r.URL.Query().Get("match"),
+				Cursor: r.URL.Query().Get("cursor"),
+				Limit:  limit,
+			}
+			if !authorizeRequest(w, r, ipStr, permission{role: RoleRead, listing: true, prefix: query.Prefix, match: query.Match}) {
 				return
 			}
 
-			err := kvs.Set(key, value)
+			listing, err := kvs.Keys(query)
 			if err != nil {
-				logMessage(r.Method, r.URL.Path, ipStr, fmt.Sprintf("Error setting key '%s': %v", key, err), false, http.StatusBadRequest)
-				sendJSONResponse(w, http.StatusBadRequest, err.Error(), key, "", nil)
+				logMessage(r.Method, r.URL.Path, ipStr, err.Error(), false, http.StatusBadRequest)
+				sendJSONResponse(w, http.StatusBadRequest, err.Error(), "", "", nil)
 				return
 			}
 
-			logMessage(r.Method, r.URL.Path, ipStr, fmt.Sprintf("Set key '%s' to value '%s'", key, value), false, http.StatusOK)
-			sendJSONResponse(w, http.StatusOK, "Key set successfully", key, value, nil)
-		}))
+			logMessage(r.Method, r.URL.Path, ipStr, fmt.Sprintf("Listed %d keys", listing.Count), false, http.StatusOK)
+			sendJSONResponse(w, http.StatusOK, "Keys listed successfully", "keys", "", listing)
+		})))
 
 		// NotFound handler for logging 404 requests
 		notFoundHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ip, err := getIPFromRequest(r)
-			ipStr := "unknown"
-			if err == nil {
-				ipStr = ip.String()
-			}
+			ipStr := clientIdentity(r)
 			logMessage(r.Method, r.URL.Path, ipStr, "Route not found", false, http.StatusNotFound)
 
 			// Return JSON response for 404 to maintain consistent API response format
@@ -458,7 +1923,8 @@ func main() {
 		})
 
 		// Create a middleware to catch all requests
-		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Requests relayed by trusted proxies are attributed to the client they forward for
+		handler = realIPMiddleware(&ac, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			// Use the mux to find a handler, or use notFoundHandler if none exists
 			h, pattern := mux.Handler(r)
 			if pattern == "" {
@@ -468,43 +1934,195 @@ func main() {
 			}
 			// Handler found, use it
 			h.ServeHTTP(w, r)
-		})
+		}))
+	}
 
-		// Start server with our custom handler
-		fmt.Println("📡 HTTP server is ready to accept connections! Press Ctrl+C to stop.")
-		log.Fatal(http.ListenAndServe(*listenAddr, handler))
+	// Every listener is bound before the server reports that it is ready
+	lc := listenerConfig{
+		HTTPAddr:      httpAddr,
+		ProxyProtocol: opts.ProxyProtocol,
+		TLS:           tlsCerts,
+		UnixSocket:    opts.UnixSocket,
+		SocketMode:    socketMode,
+		SocketUID:     socketUID,
+		SocketGID:     socketGID,
+		UDPAddr:       udpAddr,
+		RESPAddr:      opts.RESPListen,
+		MemcacheAddr:  opts.MemcacheListen,
+	}
+	if err := startListeners(lc, handler, kvs, &ac); err != nil {
+		fmt.Printf("❌ Error: %v\n", err)
+		os.Exit(1)
 	}
+
+	fmt.Println("📡 Server is ready to accept connections! Press Ctrl+C to stop.")
+	select {}
 }
 
-// handleUDPCommand processes a UDP command and returns a response
-func handleUDPCommand(command string, addr net.Addr, kvs *KeyValueStore, ac *AccessControl) []byte {
-	// Extract client IP for access control and logging
-	ipStr := strings.Split(addr.String(), ":")[0]
-	ip := net.ParseIP(ipStr)
+// listenerConfig holds the addresses and options of the listeners; an empty address disables a listener
+type listenerConfig struct {
+	HTTPAddr      string
+	ProxyProtocol bool         // Accept PROXY protocol headers on the HTTP listener
+	TLS           *tlsReloader // Certificates of the HTTP listener, nil to serve plain HTTP
+	UnixSocket    string
+	SocketMode    os.FileMode
+	SocketUID     int
+	SocketGID     int
+	UDPAddr       string
+	RESPAddr      string
+	MemcacheAddr  string
+}
+
+// startListeners binds every configured listener and then serves them in the background
+// If a listener can't be bound, the ones already bound are closed and the error is returned
+func startListeners(lc listenerConfig, handler http.Handler, kvs *KeyValueStore, ac *AccessControl) error {
+	var bound []io.Closer
+	fail := func(format string, err error) error {
+		for _, c := range bound {
+			c.Close()
+		}
+		return fmt.Errorf(format, err)
+	}
+
+	var httpLn, unixLn, respLn, memcacheLn net.Listener
+	var udpConn *net.UDPConn
+	var err error
+
+	if lc.HTTPAddr != "" {
+		if httpLn, err = net.Listen("tcp", lc.HTTPAddr); err != nil {
+			return fail("failed to start HTTP server: %v", err)
+		}
+		bound = append(bound, httpLn)
+		if lc.ProxyProtocol {
+			httpLn = &proxyListener{Listener: httpLn, ac: ac}
+		}
+	}
+	if lc.UnixSocket != "" {
+		if unixLn, err = listenUnixSocket(lc.UnixSocket, lc.SocketMode, lc.SocketUID, lc.SocketGID); err != nil {
+			return fail("failed to start Unix socket server: %v", err)
+		}
+		bound = append(bound, unixLn)
+	}
+	if lc.UDPAddr != "" {
+		addr, err := net.ResolveUDPAddr("udp", lc.UDPAddr)
+		if err != nil {
+			return fail("failed to resolve UDP address: %v", err)
+		}
+		if udpConn, err = net.ListenUDP("udp", addr); err != nil {
+			return fail("failed to start UDP server: %v", err)
+		}
+		bound = append(bound, udpConn)
+	}
+	if lc.RESPAddr != "" {
+		if respLn, err = net.Listen("tcp", lc.RESPAddr); err != nil {
+			return fail("failed to start RESP server: %v", err)
+		}
+		bound = append(bound, respLn)
+	}
+	if lc.MemcacheAddr != "" {
+		if memcacheLn, err = net.Listen("tcp", lc.MemcacheAddr); err != nil {
+			return fail("failed to start memcached server: %v", err)
+		}
+		bound = append(bound, memcacheLn)
+	}
+
+	// Serving only fails if a bound listener breaks, which stops the server
+	if httpLn != nil {
+		server := &http.Server{Addr: lc.HTTPAddr, Handler: handler}
+		if lc.TLS != nil {
+			lc.TLS.reloadOnSIGHUP()
+			server.TLSConfig = lc.TLS.config()
+		}
+		go func() {
+			if lc.TLS == nil {
+				log.Fatalf("HTTP server stopped: %v", server.Serve(httpLn))
+			}
+			log.Fatalf("HTTPS server stopped: %v", server.ServeTLS(httpLn, "", ""))
+		}()
+	}
+	if unixLn != nil {
+		log.Printf("HTTP server listening on Unix socket %s", lc.UnixSocket)
+		go func() {
+			log.Fatalf("Unix socket server stopped: %v", serveUnixSocket(unixLn, handler))
+		}()
+	}
+	if udpConn != nil {
+		log.Printf("UDP server listening on %s", lc.UDPAddr)
+		go serveUDP(udpConn, kvs, ac)
+	}
+	if respLn != nil {
+		log.Printf("RESP server listening on %s", lc.RESPAddr)
+		go serveRESP(respLn, kvs, ac)
+	}
+	if memcacheLn != nil {
+		log.Printf("Memcached server listening on %s", lc.MemcacheAddr)
+		go serveMemcache(memcacheLn, kvs, ac)
+	}
+
+	return nil
+}
+
+// handleShutdown runs cleanup once the process receives SIGINT or SIGTERM and then exits
+func handleShutdown(cleanup func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		fmt.Printf("\n🛑 Received %s, shutting down...\n", sig)
+		cleanup()
+		os.Exit(0)
+	}()
+}
 
-	// Check IP restrictions if CIDR is set
-	if ac.AllowedCIDR != nil && !ac.AllowedCIDR.Contains(ip) {
-		// Handle based on firewall mode
-		switch ac.FirewallMode {
-		case "DROP":
-			// Log the dropped packet but return nil (no response)
-			logMessage("UDP", "command", ipStr, "DROPPED (fw-drop mode) - IP not in allowed CIDR", true, 0)
+// handleUDPCommand processes a UDP command and returns a response
+func handleUDPCommand(command string, addr *net.UDPAddr, kvs *KeyValueStore, ac *AccessControl) []byte {
+	// Use the client IP directly; the string form of the address can't be split on ':' for IPv6
+	ip := addr.IP
+	ipStr := ip.String()
+
+	// Check the access rules, including those scoped to the command
+	if reason, mode := ac.CheckIP(ip, accessScope{command: udpCommandName(command)}); reason != "" {
+		message := refusalMessage("UDP", "command", ipStr, reason, mode)
+		if message == "" {
+			// Dropped datagrams get no response at all
 			return nil
-		case "REJECT":
-			// Log the rejected packet and send a rejection response
-			logMessage("UDP", "command", ipStr, "REJECTED (fw-reject mode) - IP not in allowed CIDR", true, http.StatusForbidden)
+		}
+		response := APIResponse{
+			Status:    http.StatusForbidden,
+			Message:   message,
+			TimeStamp: time.Now().Format(time.RFC3339),
+		}
+		jsonResponse, _ := json.Marshal(response)
+		return jsonResponse
+	}
+
+	// With a shared secret every datagram must be signed, fresh and not seen before
+	if ac.UDPVerifier != nil {
+		var err error
+		command, err = ac.UDPVerifier.Verify(command, time.Now())
+		if err != nil {
+			logMessage("UDP", "command", ipStr, err.Error(), true, http.StatusUnauthorized)
 			response := APIResponse{
-				Status:    http.StatusForbidden,
-				Message:   "Connection rejected by firewall: Your IP is not in the allowed range",
+				Status:    http.StatusUnauthorized,
+				Message:   err.Error(),
 				TimeStamp: time.Now().Format(time.RFC3339),
 			}
 			jsonResponse, _ := json.Marshal(response)
 			return jsonResponse
-		default: // "ACCEPT" or any other value
-			logMessage("UDP", "command", ipStr, "Access denied (IP not in allowed CIDR)", true, http.StatusForbidden)
+		}
+	}
+
+	// With authentication enabled every command carries its token as an AUTH prefix
+	if ac.Tokens != nil {
+		var err error
+		command, _, err = parseAuthCommand(ac.Tokens, command)
+		if err != nil {
+			status := authStatus(err)
+			logMessage("UDP", "command", ipStr, err.Error(), true, status)
 			response := APIResponse{
-				Status:    http.StatusForbidden,
-				Message:   "Access denied: Your IP is not in the allowed range",
+				Status:    status,
+				Message:   err.Error(),
 				TimeStamp: time.Now().Format(time.RFC3339),
 			}
 			jsonResponse, _ := json.Marshal(response)
@@ -512,10 +2130,16 @@ func handleUDPCommand(command string, addr net.Addr, kvs *KeyValueStore, ac *Acc
 		}
 	}
 
+	return executeCommand("UDP", command, ipStr, kvs)
+}
+
+// executeCommand runs a text command as sent over UDP or WebSocket and returns the JSON response
+// protocol is only used for logging
+func executeCommand(protocol, command, ipStr string, kvs *KeyValueStore) []byte {
 	// Split the command into parts
 	parts := strings.Fields(command)
 	if len(parts) == 0 {
-		logMessage("UDP", "command", ipStr, "Empty command", false, http.StatusBadRequest)
+		logMessage(protocol, "command", ipStr, "Empty command", false, http.StatusBadRequest)
 		response := APIResponse{
 			Status:    http.StatusBadRequest,
 			Message:   "Empty command",
@@ -530,7 +2154,7 @@ func handleUDPCommand(command string, addr net.Addr, kvs *KeyValueStore, ac *Acc
 	// Process command based on action
 	switch action {
 	case "PING":
-		logMessage("UDP", "PING", ipStr, "PONG", false, http.StatusOK)
+		logMessage(protocol, "PING", ipStr, "PONG", false, http.StatusOK)
 		response := APIResponse{
 			Status:    http.StatusOK,
 			Message:   "PONG",
@@ -543,7 +2167,7 @@ func handleUDPCommand(command string, addr net.Addr, kvs *KeyValueStore, ac *Acc
 
 	case "STATUS":
 		status := kvs.GetStatus()
-		logMessage("UDP", "STATUS", ipStr, fmt.Sprintf("Status: %d keys, %d bytes", status.KeyCount, status.MemoryUsage), false, http.StatusOK)
+		logMessage(protocol, "STATUS", ipStr, fmt.Sprintf("Status: %d keys, %d bytes", status.KeyCount, status.MemoryUsage), false, http.StatusOK)
 		response := APIResponse{
 			Status:    http.StatusOK,
 			Message:   "Status retrieved successfully",
@@ -556,7 +2180,7 @@ func handleUDPCommand(command string, addr net.Addr, kvs *KeyValueStore, ac *Acc
 
 	case "GET":
 		if len(parts) < 2 {
-			logMessage("UDP", "GET", ipStr, "Missing key parameter", false, http.StatusBadRequest)
+			logMessage(protocol, "GET", ipStr, "Missing key parameter", false, http.StatusBadRequest)
 			response := APIResponse{
 				Status:    http.StatusBadRequest,
 				Message:   "Missing key parameter",
@@ -567,10 +2191,10 @@ func handleUDPCommand(command string, addr net.Addr, kvs *KeyValueStore, ac *Acc
 		}
 
 		key := parts[1]
-		value, exists := kvs.Get(key)
+		item, exists := kvs.GetItem(key)
 
 		if !exists {
-			logMessage("UDP", "GET", ipStr, fmt.Sprintf("Key '%s' not found", key), false, http.StatusNotFound)
+			logMessage(protocol, "GET", ipStr, fmt.Sprintf("Key '%s' not found", key), false, http.StatusNotFound)
 			response := APIResponse{
 				Status:    http.StatusNotFound,
 				Message:   fmt.Sprintf("Key '%s' not found", key),
@@ -581,12 +2205,14 @@ func handleUDPCommand(command string, addr net.Addr, kvs *KeyValueStore, ac *Acc
 			return jsonResponse
 		}
 
-		logMessage("UDP", "GET", ipStr, fmt.Sprintf("Retrieved key '%s' with value '%s'", key, value), false, http.StatusOK)
+		logMessage(protocol, "GET", ipStr, fmt.Sprintf("Retrieved key '%s' with value '%s'", key, item.Value), false, http.StatusOK)
 		response := APIResponse{
 			Status:    http.StatusOK,
 			Message:   "Key retrieved successfully",
 			Key:       key,
-			Value:     value,
+			Value:     item.Value,
+			Version:   item.Version,
+			TTL:       ttlSeconds(item.TTL),
 			TimeStamp: time.Now().Format(time.RFC3339),
 		}
 		jsonResponse, _ := json.Marshal(response)
@@ -594,7 +2220,7 @@ func handleUDPCommand(command string, addr net.Addr, kvs *KeyValueStore, ac *Acc
 
 	case "SET":
 		if len(parts) < 2 {
-			logMessage("UDP", "SET", ipStr, "Missing key parameter", false, http.StatusBadRequest)
+			logMessage(protocol, "SET", ipStr, "Missing key parameter", false, http.StatusBadRequest)
 			response := APIResponse{
 				Status:    http.StatusBadRequest,
 				Message:   "Missing key parameter",
@@ -605,7 +2231,7 @@ func handleUDPCommand(command string, addr net.Addr, kvs *KeyValueStore, ac *Acc
 		}
 
 		if len(parts) < 3 {
-			logMessage("UDP", "SET", ipStr, "Missing value parameter", false, http.StatusBadRequest)
+			logMessage(protocol, "SET", ipStr, "Missing value parameter", false, http.StatusBadRequest)
 			response := APIResponse{
 				Status:    http.StatusBadRequest,
 				Message:   "Missing value parameter",
@@ -616,12 +2242,11 @@ func handleUDPCommand(command string, addr net.Addr, kvs *KeyValueStore, ac *Acc
 		}
 
 		key := parts[1]
-		// Join the rest of the parts as the value (in case it contains spaces)
-		value := strings.Join(parts[2:], " ")
 
-		err := kvs.Set(key, value)
+		// Optional "EX <seconds>", "VERSION <n>", "NX" and "XX" options, before the value or after a "--" separator
+		valueParts, ttl, cond, err := parseSetOptions(parts[2:])
 		if err != nil {
-			logMessage("UDP", "SET", ipStr, fmt.Sprintf("Error setting key '%s': %v", key, err), false, http.StatusBadRequest)
+			logMessage(protocol, "SET", ipStr, err.Error(), false, http.StatusBadRequest)
 			response := APIResponse{
 				Status:    http.StatusBadRequest,
 				Message:   err.Error(),
@@ -632,19 +2257,315 @@ func handleUDPCommand(command string, addr net.Addr, kvs *KeyValueStore, ac *Acc
 			return jsonResponse
 		}
 
-		logMessage("UDP", "SET", ipStr, fmt.Sprintf("Set key '%s' to value '%s'", key, value), false, http.StatusOK)
+		// Join the rest of the parts as the value (in case it contains spaces)
+		value := strings.Join(valueParts, " ")
+
+		version, err := kvs.SetIf(key, value, ttl, cond)
+		if err != nil {
+			status := writeErrorStatus(err)
+			logMessage(protocol, "SET", ipStr, fmt.Sprintf("Error setting key '%s': %v", key, err), false, status)
+			response := APIResponse{
+				Status:    status,
+				Message:   err.Error(),
+				Key:       key,
+				TimeStamp: time.Now().Format(time.RFC3339),
+			}
+			jsonResponse, _ := json.Marshal(response)
+			return jsonResponse
+		}
+
+		if ttl > 0 {
+			logMessage(protocol, "SET", ipStr, fmt.Sprintf("Set key '%s' to value '%s' with TTL %s", key, value, ttl), false, http.StatusOK)
+		} else {
+			logMessage(protocol, "SET", ipStr, fmt.Sprintf("Set key '%s' to value '%s'", key, value), false, http.StatusOK)
+		}
 		response := APIResponse{
 			Status:    http.StatusOK,
 			Message:   "Key set successfully",
 			Key:       key,
 			Value:     value,
+			Version:   version,
+			TTL:       ttlSeconds(ttl),
+			TimeStamp: time.Now().Format(time.RFC3339),
+		}
+		jsonResponse, _ := json.Marshal(response)
+		return jsonResponse
+
+	case "INCR", "DECR", "INCRBY", "DECRBY":
+		if len(parts) < 2 {
+			logMessage(protocol, action, ipStr, "Missing key parameter", false, http.StatusBadRequest)
+			response := APIResponse{
+				Status:    http.StatusBadRequest,
+				Message:   "Missing key parameter",
+				TimeStamp: time.Now().Format(time.RFC3339),
+			}
+			jsonResponse, _ := json.Marshal(response)
+			return jsonResponse
+		}
+
+		key := parts[1]
+
+		// INCR and DECR change the counter by one, INCRBY and DECRBY by the given amount
+		delta := int64(1)
+		if action == "INCRBY" || action == "DECRBY" {
+			if len(parts) < 3 {
+				logMessage(protocol, action, ipStr, "Missing increment parameter", false, http.StatusBadRequest)
+				response := APIResponse{
+					Status:    http.StatusBadRequest,
+					Message:   "Missing increment parameter",
+					Key:       key,
+					TimeStamp: time.Now().Format(time.RFC3339),
+				}
+				jsonResponse, _ := json.Marshal(response)
+				return jsonResponse
+			}
+
+			var err error
+			delta, err = parseIncrement(parts[2])
+			if err == nil && action == "DECRBY" && delta == math.MinInt64 {
+				err = fmt.Errorf("%w: cannot decrement by %d", ErrOverflow, delta)
+			}
+			if err != nil {
+				logMessage(protocol, action, ipStr, err.Error(), false, http.StatusBadRequest)
+				response := APIResponse{
+					Status:    http.StatusBadRequest,
+					Message:   err.Error(),
+					Key:       key,
+					TimeStamp: time.Now().Format(time.RFC3339),
+				}
+				jsonResponse, _ := json.Marshal(response)
+				return jsonResponse
+			}
+		}
+		if action == "DECR" || action == "DECRBY" {
+			delta = -delta
+		}
+
+		value, version, err := kvs.IncrBy(key, delta)
+		if err != nil {
+			logMessage(protocol, action, ipStr, fmt.Sprintf("Error incrementing key '%s': %v", key, err), false, http.StatusBadRequest)
+			response := APIResponse{
+				Status:    http.StatusBadRequest,
+				Message:   err.Error(),
+				Key:       key,
+				TimeStamp: time.Now().Format(time.RFC3339),
+			}
+			jsonResponse, _ := json.Marshal(response)
+			return jsonResponse
+		}
+
+		logMessage(protocol, action, ipStr, fmt.Sprintf("Incremented key '%s' by %d to %d", key, delta, value), false, http.StatusOK)
+		response := APIResponse{
+			Status:    http.StatusOK,
+			Message:   "Key incremented successfully",
+			Key:       key,
+			Value:     strconv.FormatInt(value, 10),
+			Version:   version,
+			TimeStamp: time.Now().Format(time.RFC3339),
+		}
+		jsonResponse, _ := json.Marshal(response)
+		return jsonResponse
+
+	case "MGET":
+		result, err := kvs.MGet(parts[1:])
+		if err != nil {
+			logMessage(protocol, "MGET", ipStr, err.Error(), false, http.StatusBadRequest)
+			response := APIResponse{
+				Status:    http.StatusBadRequest,
+				Message:   err.Error(),
+				TimeStamp: time.Now().Format(time.RFC3339),
+			}
+			jsonResponse, _ := json.Marshal(response)
+			return jsonResponse
+		}
+
+		response := APIResponse{
+			Status:    http.StatusOK,
+			Message:   "Keys retrieved successfully",
+			Key:       "mget",
+			Data:      result,
+			TimeStamp: time.Now().Format(time.RFC3339),
+		}
+		jsonResponse, _ := json.Marshal(response)
+
+		// A truncated datagram would be invalid JSON, so a reply too large for one is refused instead
+		if protocol == "UDP" && len(jsonResponse) > MaxUDPResponseSize {
+			message := fmt.Sprintf("response of %d bytes exceeds the UDP limit of %d bytes: request fewer keys or use /api/mget", len(jsonResponse), MaxUDPResponseSize)
+			logMessage(protocol, "MGET", ipStr, message, false, http.StatusRequestEntityTooLarge)
+			response := APIResponse{
+				Status:    http.StatusRequestEntityTooLarge,
+				Message:   message,
+				TimeStamp: time.Now().Format(time.RFC3339),
+			}
+			jsonResponse, _ := json.Marshal(response)
+			return jsonResponse
+		}
+
+		logMessage(protocol, "MGET", ipStr, fmt.Sprintf("Retrieved %d of %d keys", len(result.Items), len(result.Items)+len(result.Missing)), false, http.StatusOK)
+		return jsonResponse
+
+	case "MSET":
+		// Keys and values alternate, so values can't contain spaces
+		if len(parts) < 3 || len(parts)%2 == 0 {
+			logMessage(protocol, "MSET", ipStr, "MSET expects key value pairs", false, http.StatusBadRequest)
+			response := APIResponse{
+				Status:    http.StatusBadRequest,
+				Message:   "MSET expects key value pairs",
+				TimeStamp: time.Now().Format(time.RFC3339),
+			}
+			jsonResponse, _ := json.Marshal(response)
+			return jsonResponse
+		}
+
+		items := make([]BatchItem, 0, len(parts)/2)
+		for i := 1; i < len(parts); i += 2 {
+			items = append(items, BatchItem{Key: parts[i], Value: parts[i+1]})
+		}
+
+		result, err := kvs.MSet(items)
+		if err != nil {
+			logMessage(protocol, "MSET", ipStr, fmt.Sprintf("Error setting batch of %d keys: %v", len(items), err), false, http.StatusBadRequest)
+			response := APIResponse{
+				Status:    http.StatusBadRequest,
+				Message:   err.Error(),
+				TimeStamp: time.Now().Format(time.RFC3339),
+			}
+			jsonResponse, _ := json.Marshal(response)
+			return jsonResponse
+		}
+
+		logMessage(protocol, "MSET", ipStr, fmt.Sprintf("Set %d keys at version %d", result.Count, result.Version), false, http.StatusOK)
+		response := APIResponse{
+			Status:    http.StatusOK,
+			Message:   "Keys set successfully",
+			Key:       "mset",
+			Version:   result.Version,
+			Data:      result,
+			TimeStamp: time.Now().Format(time.RFC3339),
+		}
+		jsonResponse, _ := json.Marshal(response)
+		return jsonResponse
+
+	case "DEL", "DELETE":
+		if len(parts) < 2 {
+			logMessage(protocol, "DEL", ipStr, "Missing key parameter", false, http.StatusBadRequest)
+			response := APIResponse{
+				Status:    http.StatusBadRequest,
+				Message:   "Missing key parameter",
+				TimeStamp: time.Now().Format(time.RFC3339),
+			}
+			jsonResponse, _ := json.Marshal(response)
+			return jsonResponse
+		}
+
+		key := parts[1]
+		if !kvs.Delete(key) {
+			logMessage(protocol, "DEL", ipStr, fmt.Sprintf("Key '%s' not found", key), false, http.StatusNotFound)
+			response := APIResponse{
+				Status:    http.StatusNotFound,
+				Message:   fmt.Sprintf("Key '%s' not found", key),
+				Key:       key,
+				TimeStamp: time.Now().Format(time.RFC3339),
+			}
+			jsonResponse, _ := json.Marshal(response)
+			return jsonResponse
+		}
+
+		logMessage(protocol, "DEL", ipStr, fmt.Sprintf("Deleted key '%s'", key), false, http.StatusOK)
+		response := APIResponse{
+			Status:    http.StatusOK,
+			Message:   "Key deleted successfully",
+			Key:       key,
+			TimeStamp: time.Now().Format(time.RFC3339),
+		}
+		jsonResponse, _ := json.Marshal(response)
+		return jsonResponse
+
+	case "KEYS", "SCAN":
+		// KEYS [pattern] lists the first page of keys
+		// SCAN <cursor> [MATCH <pattern>] [PREFIX <prefix>] [COUNT <n>] pages through all keys
+		var q KeysQuery
+		options := parts[1:]
+		if action == "KEYS" {
+			if len(options) > 0 {
+				q.Match = options[0]
+			}
+		} else {
+			if len(options) < 1 {
+				logMessage(protocol, action, ipStr, "Missing cursor parameter", false, http.StatusBadRequest)
+				response := APIResponse{
+					Status:    http.StatusBadRequest,
+					Message:   "Missing cursor parameter",
+					TimeStamp: time.Now().Format(time.RFC3339),
+				}
+				jsonResponse, _ := json.Marshal(response)
+				return jsonResponse
+			}
+
+			// Cursor "0" starts a new scan
+			if options[0] != "0" {
+				q.Cursor = options[0]
+			}
+
+			var err error
+			for i := 1; i < len(options) && err == nil; i += 2 {
+				if i+1 >= len(options) {
+					err = fmt.Errorf("missing value for option %s", options[i])
+					break
+				}
+				switch strings.ToUpper(options[i]) {
+				case "MATCH":
+					q.Match = options[i+1]
+				case "PREFIX":
+					q.Prefix = options[i+1]
+				case "COUNT":
+					q.Limit, err = parseKeysLimit(options[i+1])
+				default:
+					err = fmt.Errorf("unknown option %s", options[i])
+				}
+			}
+			if err != nil {
+				logMessage(protocol, action, ipStr, err.Error(), false, http.StatusBadRequest)
+				response := APIResponse{
+					Status:    http.StatusBadRequest,
+					Message:   err.Error(),
+					TimeStamp: time.Now().Format(time.RFC3339),
+				}
+				jsonResponse, _ := json.Marshal(response)
+				return jsonResponse
+			}
+		}
+
+		// A UDP reply must fit in one datagram, so its pages are also limited by size
+		if protocol == "UDP" {
+			q.Bytes = udpKeysPageBytes
+		}
+
+		listing, err := kvs.Keys(q)
+		if err != nil {
+			logMessage(protocol, action, ipStr, err.Error(), false, http.StatusBadRequest)
+			response := APIResponse{
+				Status:    http.StatusBadRequest,
+				Message:   err.Error(),
+				TimeStamp: time.Now().Format(time.RFC3339),
+			}
+			jsonResponse, _ := json.Marshal(response)
+			return jsonResponse
+		}
+
+		logMessage(protocol, action, ipStr, fmt.Sprintf("Listed %d keys", listing.Count), false, http.StatusOK)
+		response := APIResponse{
+			Status:    http.StatusOK,
+			Message:   "Keys listed successfully",
+			Key:       "keys",
+			Data:      listing,
 			TimeStamp: time.Now().Format(time.RFC3339),
 		}
 		jsonResponse, _ := json.Marshal(response)
 		return jsonResponse
 
 	default:
-		logMessage("UDP", action, ipStr, "Unknown command", false, http.StatusBadRequest)
+		logMessage(protocol, action, ipStr, "Unknown command", false, http.StatusBadRequest)
 		response := APIResponse{
 			Status:    http.StatusBadRequest,
 			Message:   fmt.Sprintf("Unknown command: %s", action),
@@ -655,21 +2576,10 @@ func handleUDPCommand(command string, addr net.Addr, kvs *KeyValueStore, ac *Acc
 	}
 }
 
-// startUDPServer starts a UDP server on the given address
-func startUDPServer(listenAddr string, kvs *KeyValueStore, ac *AccessControl) {
-	addr, err := net.ResolveUDPAddr("udp", listenAddr)
-	if err != nil {
-		log.Fatalf("Failed to resolve UDP address: %v", err)
-	}
-
-	conn, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		log.Fatalf("Failed to start UDP server: %v", err)
-	}
+// serveUDP answers the commands received on conn
+func serveUDP(conn *net.UDPConn, kvs *KeyValueStore, ac *AccessControl) {
 	defer conn.Close()
 
-	log.Printf("UDP server listening on %s", listenAddr)
-
 	buffer := make([]byte, 8192) // 8KB buffer for UDP packets
 
 	for {
@@ -685,6 +2595,11 @@ func startUDPServer(listenAddr string, kvs *KeyValueStore, ac *AccessControl) {
 		// Handle the command
 		response := handleUDPCommand(command, clientAddr, kvs, ac)
 
+		// Dropped datagrams get no reply at all, not even an empty one
+		if response == nil {
+			continue
+		}
+
 		// Send the response back to the client
 		_, err = conn.WriteToUDP(response, clientAddr)
 		if err != nil {
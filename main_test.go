@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestHandleUDPCommandIPv6 checks that IPv6 and IPv4-mapped clients are allowed and refused by the access rules
+// in every firewall mode
+func TestHandleUDPCommandIPv6(t *testing.T) {
+	var rules []AccessRule
+	for _, line := range []string{"allow 2001:db8::/32", "allow 10.0.0.0/8", "deny 2001:db8:dead::/48"} {
+		rule, err := parseAccessLine(line)
+		if err != nil {
+			t.Fatalf("parseAccessLine(%q): %v", line, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	clients := []struct {
+		name    string
+		ip      string
+		allowed bool
+	}{
+		{"in-range IPv6", "2001:db8::1", true},
+		{"IPv4-mapped IPv6", "::ffff:10.1.2.3", true},
+		{"out-of-range IPv6", "2001:db9::1", false},
+		{"denied IPv6", "2001:db8:dead::1", false},
+		{"out-of-range IPv4-mapped IPv6", "::ffff:192.168.1.1", false},
+	}
+
+	modes := []struct {
+		mode    string
+		message string // Start of the refusal message, empty if nothing is sent back
+	}{
+		{FirewallDrop, ""},
+		{FirewallReject, "Connection rejected by firewall"},
+		{FirewallAccept, "Access denied"},
+	}
+
+	kvs := NewKeyValueStore(DefaultLimits())
+	for _, m := range modes {
+		ac := &AccessControl{Rules: rules, FirewallMode: m.mode}
+		for _, c := range clients {
+			t.Run(m.mode+"/"+c.name, func(t *testing.T) {
+				addr := &net.UDPAddr{IP: net.ParseIP(c.ip), Port: 40000}
+				response := handleUDPCommand("PING", addr, kvs, ac)
+
+				if !c.allowed && m.message == "" {
+					if response != nil {
+						t.Fatalf("expected no response, got %s", response)
+					}
+					return
+				}
+
+				var got APIResponse
+				if err := json.Unmarshal(response, &got); err != nil {
+					t.Fatalf("invalid response %q: %v", response, err)
+				}
+
+				if c.allowed {
+					if got.Status != http.StatusOK || got.Value != "PONG" {
+						t.Fatalf("expected PONG, got %d %q", got.Status, got.Message)
+					}
+					return
+				}
+				if got.Status != http.StatusForbidden || !strings.HasPrefix(got.Message, m.message) {
+					t.Fatalf("expected 403 %q, got %d %q", m.message, got.Status, got.Message)
+				}
+			})
+		}
+	}
+}
+
+// TestStartListenersBindFailure checks that a listener that can't be bound fails the startup and releases the others
+func TestStartListenersBindFailure(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpAddr := free.Addr().String()
+	free.Close()
+
+	lc := listenerConfig{HTTPAddr: httpAddr, RESPAddr: taken.Addr().String()}
+	err = startListeners(lc, http.NotFoundHandler(), NewKeyValueStore(DefaultLimits()), &AccessControl{FirewallMode: FirewallAccept})
+	if err == nil || !strings.Contains(err.Error(), "RESP") {
+		t.Fatalf("expected the RESP listener to fail, got %v", err)
+	}
+
+	ln, err := net.Listen("tcp", httpAddr)
+	if err != nil {
+		t.Fatalf("HTTP listener was not released: %v", err)
+	}
+	ln.Close()
+}
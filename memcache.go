@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Memcached protocol limits
+const (
+	MemcacheMaxLineSize       = 64 * 1024       // Maximum length of a command line in bytes
+	MemcacheIdleTimeout       = 5 * time.Minute // Connections idle for longer are closed
+	MemcacheMaxRelativeExpiry = 30 * 24 * 3600  // Larger exptimes are absolute Unix times, as in memcached
+)
+
+// memcacheConn is a client connection speaking the memcached ASCII protocol
+type memcacheConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	ip      net.IP
+	ipStr   string
+	kvs     *KeyValueStore
+	ac      *AccessControl
+	started time.Time // Start time of the listener, reported as uptime
+}
+
+// serveMemcache accepts memcached protocol connections on ln
+func serveMemcache(ln net.Listener, kvs *KeyValueStore, ac *AccessControl) {
+	defer ln.Close()
+
+	started := time.Now()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("Error accepting memcached connection: %v", err)
+			continue
+		}
+		go handleMemcacheConn(conn, kvs, ac, started)
+	}
+}
+
+// handleMemcacheConn checks the client IP and serves commands until the connection is closed
+func handleMemcacheConn(conn net.Conn, kvs *KeyValueStore, ac *AccessControl, started time.Time) {
+	defer conn.Close()
+
+	ipStr, refused, message := checkConnAccess("MEMCACHE", conn, ac)
+
+	c := &memcacheConn{
+		conn:    conn,
+		r:       bufio.NewReaderSize(conn, MemcacheMaxLineSize),
+		w:       bufio.NewWriter(conn),
+		ip:      net.ParseIP(ipStr),
+		ipStr:   ipStr,
+		kvs:     kvs,
+		ac:      ac,
+		started: started,
+	}
+
+	if refused {
+		// In DROP mode the connection is closed without a reply
+		if message != "" {
+			c.writeLine("SERVER_ERROR " + message)
+			c.w.Flush()
+		}
+		return
+	}
+
+	c.serve()
+}
+
+// serve reads and executes commands, flushing replies once no pipelined commands are pending
+func (c *memcacheConn) serve() {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(MemcacheIdleTimeout))
+		line, err := c.r.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			logMessage("MEMCACHE", "command", c.ipStr, "Line too long", false, http.StatusBadRequest)
+			c.writeLine("CLIENT_ERROR line too long")
+			c.w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		parts := strings.Fields(string(line))
+		closeConn := c.execute(parts)
+		if c.r.Buffered() == 0 || closeConn {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+		if closeConn {
+			return
+		}
+	}
+}
+
+// execute runs a single command and writes its reply
+// Returns true if the connection must be closed
+func (c *memcacheConn) execute(parts []string) bool {
+	if len(parts) == 0 {
+		c.writeLine("ERROR")
+		return false
+	}
+
+	// The access rules scoped to the command apply to every command, not only when connecting
+	// Storage commands are checked by store, which can skip their data block
+	switch parts[0] {
+	case "set", "add", "replace", "cas":
+	default:
+		if refused, message := c.ac.CheckCommand("MEMCACHE", c.ip, c.ipStr, parts[0]); refused {
+			if message == "" {
+				// In DROP mode the connection is closed without a reply
+				return true
+			}
+			c.writeLine("SERVER_ERROR " + message)
+			return false
+		}
+	}
+
+	switch cmd := parts[0]; cmd {
+	case "get", "gets":
+		if len(parts) < 2 {
+			c.writeLine("ERROR")
+			return false
+		}
+		found := 0
+		for _, key := range parts[1:] {
+			item, exists := c.kvs.GetItem(key)
+			if !exists {
+				continue
+			}
+			found++
+			if cmd == "gets" {
+				// The version of a key serves as its CAS unique value
+				c.writeLine(fmt.Sprintf("VALUE %s %d %d %d", key, item.Flags, len(item.Value), item.Version))
+			} else {
+				c.writeLine(fmt.Sprintf("VALUE %s %d %d", key, item.Flags, len(item.Value)))
+			}
+			c.writeLine(item.Value)
+		}
+		logMessage("MEMCACHE", cmd, c.ipStr, fmt.Sprintf("Retrieved %d of %d keys", found, len(parts)-1), false, http.StatusOK)
+		c.writeLine("END")
+
+	case "set", "add", "replace", "cas":
+		return c.store(cmd, parts)
+
+	case "delete":
+		// The legacy "delete <key> 0" form is accepted as well
+		args := parts[1:]
+		noreply := len(args) > 1 && args[len(args)-1] == "noreply"
+		if noreply {
+			args = args[:len(args)-1]
+		}
+		if len(args) < 1 || len(args) > 2 || (len(args) == 2 && args[1] != "0") {
+			c.writeLine("CLIENT_ERROR bad command line format")
+			return false
+		}
+
+		key := args[0]
+		if !c.kvs.Delete(key) {
+			logMessage("MEMCACHE", cmd, c.ipStr, fmt.Sprintf("Key '%s' not found", key), false, http.StatusNotFound)
+			c.reply(noreply, "NOT_FOUND")
+			return false
+		}
+		logMessage("MEMCACHE", cmd, c.ipStr, fmt.Sprintf("Deleted key '%s'", key), false, http.StatusOK)
+		c.reply(noreply, "DELETED")
+
+	case "incr", "decr":
+		if len(parts) < 3 || len(parts) > 4 {
+			c.writeLine("ERROR")
+			return false
+		}
+		noreply := len(parts) == 4 && parts[3] == "noreply"
+		key := parts[1]
+		delta, err := strconv.ParseUint(parts[2], 10, 64)
+		if err != nil {
+			logMessage("MEMCACHE", cmd, c.ipStr, fmt.Sprintf("Invalid delta '%s'", parts[2]), false, http.StatusBadRequest)
+			c.reply(noreply, "CLIENT_ERROR invalid numeric delta argument")
+			return false
+		}
+
+		value, exists, err := c.kvs.IncrUnsigned(key, delta, cmd == "decr")
+		switch {
+		case errors.Is(err, ErrNotInteger):
+			logMessage("MEMCACHE", cmd, c.ipStr, err.Error(), false, http.StatusBadRequest)
+			c.reply(noreply, "CLIENT_ERROR cannot increment or decrement non-numeric value")
+		case err != nil:
+			logMessage("MEMCACHE", cmd, c.ipStr, fmt.Sprintf("Failed to update key '%s': %v", key, err), false, http.StatusInternalServerError)
+			c.reply(noreply, "SERVER_ERROR "+err.Error())
+		case !exists:
+			logMessage("MEMCACHE", cmd, c.ipStr, fmt.Sprintf("Key '%s' not found", key), false, http.StatusNotFound)
+			c.reply(noreply, "NOT_FOUND")
+		default:
+			logMessage("MEMCACHE", cmd, c.ipStr, fmt.Sprintf("Key '%s' is now %d", key, value), false, http.StatusOK)
+			c.reply(noreply, strconv.FormatUint(value, 10))
+		}
+
+	case "stats":
+		if len(parts) > 1 {
+			c.writeLine("ERROR")
+			return false
+		}
+		status := c.kvs.GetStatus()
+		now := time.Now()
+		for _, stat := range []struct {
+			name  string
+			value interface{}
+		}{
+			{"pid", os.Getpid()},
+			{"uptime", int64(now.Sub(c.started).Seconds())},
+			{"time", now.Unix()},
+			{"version", Version},
+			{"curr_items", status.KeyCount},
+			{"bytes", status.MemoryUsage},
+			{"limit_maxbytes", status.Limits.MaxMemory},
+			{"evictions", status.EvictedKeys},
+		} {
+			c.writeLine(fmt.Sprintf("STAT %s %v", stat.name, stat.value))
+		}
+		logMessage("MEMCACHE", cmd, c.ipStr, fmt.Sprintf("Status: %d keys, %d bytes", status.KeyCount, status.MemoryUsage), false, http.StatusOK)
+		c.writeLine("END")
+
+	case "version":
+		logMessage("MEMCACHE", cmd, c.ipStr, Version, false, http.StatusOK)
+		c.writeLine("VERSION " + Version)
+
+	case "quit":
+		logMessage("MEMCACHE", cmd, c.ipStr, "Connection closed by client", false, http.StatusOK)
+		return true
+
+	default:
+		logMessage("MEMCACHE", cmd, c.ipStr, "Unknown command", false, http.StatusBadRequest)
+		c.writeLine("ERROR")
+	}
+
+	return false
+}
+
+// store runs a set, add, replace or cas command, reading its data block from the connection
+// Returns true if the connection must be closed because the data block could not be read
+func (c *memcacheConn) store(cmd string, parts []string) bool {
+	// <cmd> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply]
+	n := 5
+	if cmd == "cas" {
+		n = 6
+	}
+	if len(parts) < n || len(parts) > n+1 || (len(parts) == n+1 && parts[n] != "noreply") {
+		c.writeLine("CLIENT_ERROR bad command line format")
+		return false
+	}
+	noreply := len(parts) == n+1
+
+	key := parts[1]
+	flags, err1 := strconv.ParseUint(parts[2], 10, 32)
+	exptime, err2 := strconv.ParseInt(parts[3], 10, 64)
+	size, err3 := strconv.Atoi(parts[4])
+	var casUnique uint64
+	var err4 error
+	if cmd == "cas" {
+		casUnique, err4 = strconv.ParseUint(parts[5], 10, 64)
+	}
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || size < 0 {
+		c.writeLine("CLIENT_ERROR bad command line format")
+		return false
+	}
+
+	if refused, message := c.ac.CheckCommand("MEMCACHE", c.ip, c.ipStr, cmd); refused {
+		if message == "" {
+			// In DROP mode the connection is closed without a reply
+			return true
+		}
+		if _, err := io.CopyN(io.Discard, c.r, int64(size)+2); err != nil {
+			return true
+		}
+		c.reply(noreply, "SERVER_ERROR "+message)
+		return false
+	}
+
+	// Skip data blocks that can never be stored instead of buffering them
+	if limit := c.kvs.Limits().MaxValueSize; size > limit {
+		if _, err := io.CopyN(io.Discard, c.r, int64(size)+2); err != nil {
+			return true
+		}
+		logMessage("MEMCACHE", cmd, c.ipStr, fmt.Sprintf("Value of key '%s' exceeds maximum size of %d bytes", key, limit), false, http.StatusRequestEntityTooLarge)
+		c.reply(noreply, "SERVER_ERROR object too large for cache")
+		return false
+	}
+
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return true
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		logMessage("MEMCACHE", cmd, c.ipStr, "Bad data chunk", false, http.StatusBadRequest)
+		c.writeLine("CLIENT_ERROR bad data chunk")
+		return true
+	}
+	value := string(data[:size])
+
+	var cond SetCondition
+	switch cmd {
+	case "add":
+		cond.IfAbsent = true
+	case "replace":
+		cond.IfPresent = true
+	case "cas":
+		// Versions start at 1, so a CAS unique of 0 never matches
+		if casUnique == 0 {
+			c.casConflict(key, noreply)
+			return false
+		}
+		cond.IfPresent = true
+		cond.IfVersion = casUnique
+	}
+
+	if _, err := c.kvs.SetWithFlags(key, value, uint32(flags), memcacheTTL(exptime, time.Now()), cond); err != nil {
+		switch {
+		case errors.Is(err, ErrConflict) && cmd == "cas":
+			c.casConflict(key, noreply)
+		case errors.Is(err, ErrConflict):
+			logMessage("MEMCACHE", cmd, c.ipStr, err.Error(), false, http.StatusConflict)
+			c.reply(noreply, "NOT_STORED")
+		default:
+			logMessage("MEMCACHE", cmd, c.ipStr, fmt.Sprintf("Failed to store key '%s': %v", key, err), false, http.StatusBadRequest)
+			c.reply(noreply, "SERVER_ERROR "+err.Error())
+		}
+		return false
+	}
+
+	logMessage("MEMCACHE", cmd, c.ipStr, fmt.Sprintf("Stored key '%s' with value '%s'", key, value), false, http.StatusOK)
+	c.reply(noreply, "STORED")
+	return false
+}
+
+// casConflict replies to a cas command whose CAS unique value didn't match
+func (c *memcacheConn) casConflict(key string, noreply bool) {
+	if _, exists := c.kvs.Get(key); !exists {
+		logMessage("MEMCACHE", "cas", c.ipStr, fmt.Sprintf("Key '%s' not found", key), false, http.StatusNotFound)
+		c.reply(noreply, "NOT_FOUND")
+		return
+	}
+	logMessage("MEMCACHE", "cas", c.ipStr, fmt.Sprintf("Key '%s' was modified", key), false, http.StatusConflict)
+	c.reply(noreply, "EXISTS")
+}
+
+// memcacheTTL converts a memcached exptime into a time to live
+// 0 means the key never expires, values up to 30 days are relative seconds and larger
+// values an absolute Unix time; a negative or past exptime stores the key already expired
+func memcacheTTL(exptime int64, now time.Time) time.Duration {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime < 0:
+		return time.Nanosecond
+	case exptime <= MemcacheMaxRelativeExpiry:
+		return time.Duration(exptime) * time.Second
+	}
+
+	if ttl := time.Unix(exptime, 0).Sub(now); ttl > 0 {
+		return ttl
+	}
+	return time.Nanosecond
+}
+
+// IncrUnsigned applies memcached incr or decr semantics to the unsigned integer stored at key:
+// the key must exist, increments wrap around at 64 bits and decrements stop at 0
+// The key keeps its TTL and flags; returns the new value and whether the key exists
+func (kvs *KeyValueStore) IncrUnsigned(key string, delta uint64, decr bool) (uint64, bool, error) {
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+
+	now := time.Now()
+	entry, exists := kvs.store[key]
+	if !exists || entry.expired(now) {
+		return 0, false, nil
+	}
+
+	current, err := strconv.ParseUint(entry.value, 10, 64)
+	if err != nil {
+		return 0, true, fmt.Errorf("%w: key '%s' holds '%s'", ErrNotInteger, key, entry.value)
+	}
+
+	next := current + delta
+	if decr {
+		next = 0
+		if current > delta {
+			next = current - delta
+		}
+	}
+
+	if _, err := kvs.setLocked(key, strconv.FormatUint(next, 10), entry.flags, entry.ttlRemaining(now), SetCondition{}, now); err != nil {
+		return 0, true, err
+	}
+	return next, true, nil
+}
+
+// reply writes a response line unless the client asked for no reply
+func (c *memcacheConn) reply(noreply bool, line string) {
+	if !noreply {
+		c.writeLine(line)
+	}
+}
+
+// writeLine writes a CRLF terminated response line
+func (c *memcacheConn) writeLine(line string) {
+	c.w.WriteString(line + "\r\n")
+}
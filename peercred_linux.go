@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// unixPeerCredentials returns the credentials of the process connected to conn
+func unixPeerCredentials(conn *net.UnixConn) (peerCredentials, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return peerCredentials{}, err
+	}
+
+	var ucred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return peerCredentials{}, err
+	}
+	if credErr != nil {
+		return peerCredentials{}, credErr
+	}
+
+	return peerCredentials{PID: ucred.Pid, UID: ucred.Uid, GID: ucred.Gid}, nil
+}
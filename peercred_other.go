@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// unixPeerCredentials returns the credentials of the process connected to conn
+// Peer credentials are only supported on Linux
+func unixPeerCredentials(conn *net.UnixConn) (peerCredentials, error) {
+	return peerCredentials{}, errors.New("peer credentials are not supported on this platform")
+}
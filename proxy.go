@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol limits
+const (
+	ProxyHeaderTimeout = 5 * time.Second // Time a trusted proxy has to send the PROXY header
+	proxyV1MaxLength   = 107             // Maximum length of a v1 header line, including CRLF
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// errProxyHeader is returned when a trusted proxy sends a malformed PROXY header
+var errProxyHeader = errors.New("invalid PROXY protocol header")
+
+// parseTrustedProxies parses a comma-separated list of proxy networks or addresses
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var proxies []*net.IPNet
+	for _, item := range strings.Split(s, ",") {
+		network, err := parseNetwork(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %w", err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// isTrustedProxy reports whether ip belongs to one of the trusted proxies
+func (ac *AccessControl) isTrustedProxy(ip net.IP) bool {
+	for _, network := range ac.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClientIP returns the client IP reported by the Forwarded or X-Forwarded-For headers of a request
+// Hops are read from the right, skipping trusted proxies; the first untrusted hop is the client
+// Returns nil if the headers hold no usable address
+func (ac *AccessControl) forwardedClientIP(r *http.Request) net.IP {
+	hops := forwardedFor(r.Header.Values("Forwarded"))
+	if len(hops) == 0 {
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+	}
+
+	var client net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseForwardedIP(hops[i])
+		if ip == nil {
+			// The hop before a garbled entry can't be trusted, so the last valid one is used
+			break
+		}
+		client = ip
+		if !ac.isTrustedProxy(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// forwardedFor extracts the for= parameters from RFC 7239 Forwarded header values, in order
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(name, "for") {
+					hops = append(hops, v)
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// parseForwardedIP parses a single hop as found in X-Forwarded-For or a Forwarded for= parameter
+// Accepts bare addresses, quoted values, bracketed IPv6 addresses and addresses with a port
+func parseForwardedIP(s string) net.IP {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.Trim(s, "[]"))
+}
+
+// realIPMiddleware replaces the remote address of requests from trusted proxies with the forwarded client address
+// Requests from other peers keep their address, so their headers can't be used to spoof it
+func realIPMiddleware(ac *AccessControl, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(ac.TrustedProxies) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, unix := unixPeerFromRequest(r); unix {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		peer, err := getIPFromRequest(r)
+		if err != nil || !ac.isTrustedProxy(peer) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if client := ac.forwardedClientIP(r); client != nil {
+			r2 := r.Clone(r.Context())
+			r2.RemoteAddr = net.JoinHostPort(client.String(), "0")
+			r = r2
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// proxyListener accepts connections that may start with a PROXY protocol v1 or v2 header
+// The header is only honored on connections from trusted proxies; other peers keep their own address
+type proxyListener struct {
+	net.Listener
+	ac *AccessControl
+}
+
+// Accept wraps the next connection; its header is read lazily so a slow proxy doesn't block the accept loop
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, ac: l.ac, r: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn is a connection whose remote address may come from a PROXY protocol header
+type proxyConn struct {
+	net.Conn
+	ac *AccessControl
+	r  *bufio.Reader
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+// init reads the PROXY header, if the peer is a trusted proxy and sent one
+func (c *proxyConn) init() {
+	c.remoteAddr = c.Conn.RemoteAddr()
+
+	tcpAddr, ok := c.remoteAddr.(*net.TCPAddr)
+	if !ok || !c.ac.isTrustedProxy(tcpAddr.IP) {
+		return
+	}
+
+	c.Conn.SetReadDeadline(time.Now().Add(ProxyHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	addr, err := readProxyHeader(c.r)
+	if err != nil {
+		c.err = err
+		logMessage("PROXY", "header", tcpAddr.IP.String(), err.Error(), true, http.StatusBadRequest)
+		return
+	}
+	if addr != nil {
+		c.remoteAddr = addr
+	}
+}
+
+// RemoteAddr returns the client address from the PROXY header, or the peer address without one
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.init)
+	return c.remoteAddr
+}
+
+// Read reads from the connection after the PROXY header
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.init)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header, if the connection starts with one
+// Returns the source address it announces, or nil if there is no header or it carries no address (LOCAL, UNKNOWN)
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(proxyV2Signature))
+	if err != nil && len(start) == 0 {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readProxyV1(r)
+	case bytes.Equal(start, proxyV2Signature):
+		return readProxyV2(r)
+	default:
+		return nil, nil
+	}
+}
+
+// readProxyV1 reads a text header such as "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 header not terminated by CRLF", errProxyHeader)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: malformed v1 header", errProxyHeader)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("%w: invalid v1 source address", errProxyHeader)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", errProxyHeader, header[12]>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	// LOCAL connections, such as health checks from the proxy itself, keep the proxy address
+	if header[12]&0x0F == 0 {
+		return nil, nil
+	}
+
+	switch header[13] >> 4 {
+	case 1: // AF_INET: source address, destination address, source port, destination port
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("%w: truncated IPv4 addresses", errProxyHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("%w: truncated IPv6 addresses", errProxyHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default: // AF_UNSPEC or AF_UNIX carry no usable client IP
+		return nil, nil
+	}
+}
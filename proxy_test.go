@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// proxyV2Header builds a PROXY protocol v2 header with the given version/command and family bytes and payload
+func proxyV2Header(versionCommand, family byte, payload []byte) string {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, versionCommand, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(payload)))
+	return string(append(header, payload...))
+}
+
+// TestReadProxyHeader checks the addresses read from v1 and v2 headers and that malformed or truncated headers are refused
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	ipv6 := make([]byte, 36)
+	copy(ipv6, net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(ipv6[32:34], 56324)
+
+	tests := []struct {
+		name   string
+		input  string
+		addr   string // Expected source address, empty if the header carries none
+		failed bool
+	}{
+		{"no header", "GET / HTTP/1.1\r\n", "", false},
+		{"v1 TCP4", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324", false},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", false},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", "", false},
+		{"v1 without CRLF", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n", "", true},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLength) + "\r\n", "", true},
+		{"v1 missing fields", "PROXY TCP4 192.0.2.1 198.51.100.1\r\n", "", true},
+		{"v1 unknown protocol", "PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n", "", true},
+		{"v1 invalid address", "PROXY TCP4 192.0.2.300 198.51.100.1 56324 443\r\n", "", true},
+		{"v1 invalid port", "PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n", "", true},
+		{"v1 truncated", "PROXY TCP4 192.0.2.1", "", true},
+		{"v2 IPv4", proxyV2Header(0x21, 0x11, ipv4), "192.0.2.1:56324", false},
+		{"v2 IPv6", proxyV2Header(0x21, 0x21, ipv6), "[2001:db8::1]:56324", false},
+		{"v2 LOCAL", proxyV2Header(0x20, 0x00, nil), "", false},
+		{"v2 unsupported version", proxyV2Header(0x11, 0x11, ipv4), "", true},
+		{"v2 truncated IPv4 addresses", proxyV2Header(0x21, 0x11, ipv4[:8]), "", true},
+		{"v2 truncated IPv6 addresses", proxyV2Header(0x21, 0x21, ipv6[:16]), "", true},
+		{"v2 truncated payload", proxyV2Header(0x21, 0x11, ipv4)[:20], "", true},
+		{"v2 truncated header", proxyV2Header(0x21, 0x11, ipv4)[:14], "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input + "DATA"))
+			addr, err := readProxyHeader(r)
+
+			if tt.failed {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readProxyHeader: %v", err)
+			}
+			if got := ""; addr != nil {
+				got = addr.String()
+				if got != tt.addr {
+					t.Fatalf("source address = %s, want %s", got, tt.addr)
+				}
+			} else if tt.addr != "" {
+				t.Fatalf("no source address, want %s", tt.addr)
+			}
+
+			// The data after the header must be left for the application
+			rest, _ := io.ReadAll(r)
+			want := "DATA"
+			if tt.name == "no header" {
+				want = tt.input + "DATA"
+			}
+			if string(rest) != want {
+				t.Fatalf("data after the header = %q, want %q", rest, want)
+			}
+		})
+	}
+}
+
+// TestProxyListener checks that a PROXY header is only honored from a trusted proxy
+func TestProxyListener(t *testing.T) {
+	header := "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+
+	tests := []struct {
+		name    string
+		trusted string
+		sent    string
+		addr    string // Expected remote address host
+		data    string // Expected data read from the connection, empty if reading fails
+	}{
+		{"trusted proxy", "127.0.0.1", header + "PING\r\n", "192.0.2.1", "PING\r\n"},
+		{"trusted proxy without header", "127.0.0.1", "PING\r\n", "127.0.0.1", "PING\r\n"},
+		{"untrusted source", "10.0.0.0/8", header + "PING\r\n", "127.0.0.1", header + "PING\r\n"},
+		{"malformed header from a trusted proxy", "127.0.0.1", "PROXY TCP4 nonsense\r\nPING\r\n", "127.0.0.1", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trusted, err := parseTrustedProxies(tt.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			l := &proxyListener{Listener: inner, ac: &AccessControl{TrustedProxies: trusted}}
+			defer l.Close()
+
+			go func() {
+				client, err := net.Dial("tcp", inner.Addr().String())
+				if err != nil {
+					return
+				}
+				defer client.Close()
+				client.Write([]byte(tt.sent))
+			}()
+
+			conn, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if host, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); host != tt.addr {
+				t.Errorf("remote address = %s, want %s", conn.RemoteAddr(), tt.addr)
+			}
+			data, err := io.ReadAll(conn)
+			if tt.data == "" {
+				if !errors.Is(err, errProxyHeader) {
+					t.Errorf("expected errProxyHeader, got %q, %v", data, err)
+				}
+				return
+			}
+			if string(data) != tt.data {
+				t.Errorf("data = %q, want %q", data, tt.data)
+			}
+		})
+	}
+}
+
+// TestForwardedClientIP checks which hop of a forwarding chain is taken as the client
+func TestForwardedClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.0/8,2001:db8:ffff::/48")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac := &AccessControl{TrustedProxies: trusted}
+
+	tests := []struct {
+		name      string
+		xff       []string
+		forwarded []string
+		client    string // Empty if no address is usable
+	}{
+		{"single hop", []string{"203.0.113.5"}, nil, "203.0.113.5"},
+		{"client behind a trusted hop", []string{"203.0.113.5, 10.0.0.1"}, nil, "203.0.113.5"},
+		{"spoofed hop before an untrusted one", []string{"198.51.100.7, 203.0.113.5, 10.0.0.2, 10.0.0.1"}, nil, "203.0.113.5"},
+		{"untrusted hop between trusted ones", []string{"10.0.0.3, 203.0.113.5, 10.0.0.1"}, nil, "203.0.113.5"},
+		{"only trusted hops", []string{"10.0.0.3, 10.0.0.1"}, nil, "10.0.0.3"},
+		{"chain split over headers", []string{"198.51.100.7", "203.0.113.5, 10.0.0.1"}, nil, "203.0.113.5"},
+		{"garbled hop", []string{"198.51.100.7, garbage, 10.0.0.1"}, nil, "10.0.0.1"},
+		{"IPv6 hops", []string{"2001:db8::1, 2001:db8:ffff::1"}, nil, "2001:db8::1"},
+		{"Forwarded header", nil, []string{`for=198.51.100.7, for="[2001:db8::1]:4711";proto=https, for=10.0.0.1`}, "2001:db8::1"},
+		{"Forwarded header wins", []string{"198.51.100.9"}, []string{"for=203.0.113.5;by=10.0.0.1"}, "203.0.113.5"},
+		{"no headers", nil, nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/ping", nil)
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			for _, v := range tt.forwarded {
+				r.Header.Add("Forwarded", v)
+			}
+
+			got := ac.forwardedClientIP(r)
+			if tt.client == "" {
+				if got != nil {
+					t.Fatalf("client = %s, want none", got)
+				}
+				return
+			}
+			if !got.Equal(net.ParseIP(tt.client)) {
+				t.Fatalf("client = %s, want %s", got, tt.client)
+			}
+		})
+	}
+}
+
+// TestRealIPMiddleware checks that only requests from trusted proxies get the forwarded address
+func TestRealIPMiddleware(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac := &AccessControl{TrustedProxies: trusted}
+
+	tests := []struct {
+		name   string
+		peer   string
+		client string
+	}{
+		{"trusted proxy", "10.0.0.1:4000", "203.0.113.5"},
+		{"untrusted peer", "198.51.100.7:4000", "198.51.100.7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := realIPMiddleware(ac, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ip, _ := getIPFromRequest(r)
+				got = ip.String()
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/api/ping", nil)
+			r.RemoteAddr = tt.peer
+			r.Header.Set("X-Forwarded-For", "203.0.113.5")
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			if got != tt.client {
+				t.Fatalf("client = %s, want %s", got, tt.client)
+			}
+		})
+	}
+}
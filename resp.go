@@ -0,0 +1,646 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RESP protocol limits
+const (
+	RESPMaxArgs       = 1024            // Maximum number of arguments in a single command
+	RESPMaxUnauthArgs = 10              // Maximum number of arguments before a client has authenticated
+	RESPMaxInlineSize = 64 * 1024       // Maximum length of an inline command or protocol line in bytes
+	RESPIdleTimeout   = 5 * time.Minute // Connections idle for longer are closed
+)
+
+// errRESPProtocol is returned when a client sends malformed RESP
+var errRESPProtocol = errors.New("Protocol error")
+
+// respConn is a client connection speaking the Redis RESP2 protocol
+type respConn struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	w     *bufio.Writer
+	ip    net.IP
+	ipStr string
+	kvs   *KeyValueStore
+	ac    *AccessControl
+	auth  *Authenticator // Validates AUTH tokens, nil if authentication is disabled
+	token *Token         // Token the client authenticated with, nil until AUTH succeeds
+	name  string         // Name set with CLIENT SETNAME
+}
+
+// serveRESP accepts Redis protocol connections on ln
+func serveRESP(ln net.Listener, kvs *KeyValueStore, ac *AccessControl) {
+	defer ln.Close()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("Error accepting RESP connection: %v", err)
+			continue
+		}
+		go handleRESPConn(conn, kvs, ac)
+	}
+}
+
+// handleRESPConn checks the client IP and serves commands until the connection is closed
+func handleRESPConn(conn net.Conn, kvs *KeyValueStore, ac *AccessControl) {
+	defer conn.Close()
+
+	ipStr, refused, message := checkConnAccess("RESP", conn, ac)
+
+	c := &respConn{
+		conn:  conn,
+		r:     bufio.NewReaderSize(conn, RESPMaxInlineSize),
+		w:     bufio.NewWriter(conn),
+		ip:    net.ParseIP(ipStr),
+		ipStr: ipStr,
+		kvs:   kvs,
+		ac:    ac,
+		auth:  ac.Tokens,
+	}
+
+	if refused {
+		// In DROP mode the connection is closed without a reply
+		if message != "" {
+			c.writeError("ERR " + message)
+			c.w.Flush()
+		}
+		return
+	}
+
+	c.serve()
+}
+
+// serve reads and executes commands, flushing replies once no pipelined commands are pending
+func (c *respConn) serve() {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(RESPIdleTimeout))
+		args, err := c.readCommand()
+		if err != nil {
+			if errors.Is(err, errRESPProtocol) {
+				logMessage("RESP", "command", c.ipStr, err.Error(), false, http.StatusBadRequest)
+				c.writeError("ERR " + err.Error())
+				c.w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := c.execute(args)
+		if c.r.Buffered() == 0 || quit {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// readCommand reads a command sent either as an array of bulk strings or inline
+func (c *respConn) readCommand() ([]string, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	// Bulk strings hold keys or values, so none may be larger than the largest value,
+	// and a command holds at most one value plus its keys and options
+	maxArgs := RESPMaxArgs
+	maxBulk := c.kvs.Limits().MaxValueSize
+	if keySize := c.kvs.Limits().MaxKeySize; keySize > maxBulk {
+		maxBulk = keySize
+	}
+	maxTotal := maxBulk + RESPMaxInlineSize
+
+	// Until it authenticates, a client can only send AUTH, PING and QUIT, so it gets far less room
+	if c.auth != nil && c.token == nil {
+		maxArgs, maxBulk, maxTotal = RESPMaxUnauthArgs, RESPMaxInlineSize, RESPMaxInlineSize
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errRESPProtocol)
+	}
+
+	args := make([]string, 0, max(n, 0))
+	total := 0
+	for i := 0; i < n; i++ {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("%w: expected '$', got '%.1s'", errRESPProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("%w: invalid bulk length", errRESPProtocol)
+		}
+		if size > maxBulk {
+			return nil, fmt.Errorf("%w: bulk string exceeds maximum size of %d bytes", errRESPProtocol, maxBulk)
+		}
+		total += size
+		if total > maxTotal {
+			return nil, fmt.Errorf("%w: command exceeds maximum size of %d bytes", errRESPProtocol, maxTotal)
+		}
+
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string not terminated by CRLF", errRESPProtocol)
+		}
+		args = append(args, string(buf[:size]))
+	}
+
+	return args, nil
+}
+
+// readLine reads a single CRLF or LF terminated line without its terminator
+func (c *respConn) readLine() (string, error) {
+	line, err := c.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", fmt.Errorf("%w: line exceeds maximum size of %d bytes", errRESPProtocol, RESPMaxInlineSize)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
+
+// execute runs a single command and writes its reply
+// Returns true if the client asked to close the connection
+func (c *respConn) execute(args []string) bool {
+	action := strings.ToUpper(args[0])
+	argc := len(args) - 1
+
+	// The access rules scoped to the command apply to every command, not only when connecting
+	if refused, message := c.ac.CheckCommand("RESP", c.ip, c.ipStr, action); refused {
+		if message == "" {
+			// In DROP mode the connection is closed without a reply
+			return true
+		}
+		c.writeError("ERR " + message)
+		return false
+	}
+
+	// With authentication enabled, commands other than AUTH, PING and QUIT need an authorized token
+	if c.auth != nil && action != "AUTH" {
+		if p := commandPermission(args); p.role != "" {
+			if c.token == nil {
+				logMessage("RESP", action, c.ipStr, "Authentication required", true, http.StatusUnauthorized)
+				c.writeError("NOAUTH Authentication required.")
+				return false
+			}
+			if err := c.token.Authorize(p); err != nil {
+				logMessage("RESP", action, c.ipStr, err.Error(), true, http.StatusForbidden)
+				c.writeError("NOPERM " + err.Error())
+				return false
+			}
+		}
+	}
+
+	switch action {
+	case "AUTH":
+		// AUTH <token>, or AUTH <username> <token> as sent by Redis 6 clients; the username is ignored
+		if argc < 1 || argc > 2 {
+			c.wrongArgs(action)
+			return false
+		}
+		if c.authenticate(action, args[argc]) {
+			c.writeSimple("OK")
+		}
+
+	case "HELLO":
+		// HELLO [protover [AUTH username token] [SETNAME name]]; only RESP2 is spoken
+		if argc >= 1 {
+			protover, err := strconv.Atoi(args[1])
+			if err != nil {
+				logMessage("RESP", "HELLO", c.ipStr, fmt.Sprintf("Invalid protocol version '%s'", args[1]), false, http.StatusBadRequest)
+				c.writeError("ERR Protocol version is not an integer or out of range")
+				return false
+			}
+			if protover != 2 {
+				logMessage("RESP", "HELLO", c.ipStr, fmt.Sprintf("Unsupported protocol version %d", protover), false, http.StatusBadRequest)
+				c.writeError("NOPROTO unsupported protocol version")
+				return false
+			}
+		}
+		name := c.name
+		for i := 2; i <= argc; i++ {
+			switch option := strings.ToUpper(args[i]); {
+			case option == "AUTH" && i+2 <= argc:
+				if !c.authenticate(action, args[i+2]) {
+					return false
+				}
+				i += 2
+			case option == "SETNAME" && i+1 <= argc:
+				name = args[i+1]
+				i++
+			default:
+				logMessage("RESP", "HELLO", c.ipStr, fmt.Sprintf("Invalid option '%s'", args[i]), false, http.StatusBadRequest)
+				c.writeError("ERR syntax error in HELLO option '" + args[i] + "'")
+				return false
+			}
+		}
+		c.name = name
+		logMessage("RESP", "HELLO", c.ipStr, "Handshake with protocol version 2", false, http.StatusOK)
+		c.writeHello()
+
+	case "CLIENT":
+		if argc < 1 {
+			c.wrongArgs(action)
+			return false
+		}
+		switch sub := strings.ToUpper(args[1]); {
+		case sub == "SETNAME" && argc == 2:
+			c.name = args[2]
+			c.writeSimple("OK")
+		case sub == "GETNAME" && argc == 1:
+			if c.name == "" {
+				c.writeNull()
+			} else {
+				c.writeBulk(c.name)
+			}
+		case sub == "SETINFO" && argc == 3:
+			// Sent by clients to report their library name and version
+			c.writeSimple("OK")
+		default:
+			logMessage("RESP", "CLIENT", c.ipStr, fmt.Sprintf("Unsupported subcommand '%s'", args[1]), false, http.StatusBadRequest)
+			c.writeError(fmt.Sprintf("ERR unknown subcommand '%s'", sanitizeRESPError(args[1])))
+		}
+
+	case "SELECT":
+		// There is a single keyspace, which is database 0
+		if argc != 1 {
+			c.wrongArgs(action)
+			return false
+		}
+		if args[1] != "0" {
+			logMessage("RESP", "SELECT", c.ipStr, fmt.Sprintf("Invalid database '%s'", args[1]), false, http.StatusBadRequest)
+			c.writeError("ERR DB index is out of range")
+			return false
+		}
+		c.writeSimple("OK")
+
+	case "COMMAND":
+		// Clients probe the command table on connect; an empty one makes them fall back to their defaults
+		c.w.WriteString("*0\r\n")
+
+	case "PING":
+		if argc > 1 {
+			c.wrongArgs(action)
+			return false
+		}
+		logMessage("RESP", "PING", c.ipStr, "PONG", false, http.StatusOK)
+		if argc == 1 {
+			c.writeBulk(args[1])
+		} else {
+			c.writeSimple("PONG")
+		}
+
+	case "QUIT":
+		logMessage("RESP", "QUIT", c.ipStr, "Connection closed by client", false, http.StatusOK)
+		c.writeSimple("OK")
+		return true
+
+	case "GET":
+		if argc != 1 {
+			c.wrongArgs(action)
+			return false
+		}
+		key := args[1]
+		value, exists := c.kvs.Get(key)
+		if !exists {
+			logMessage("RESP", "GET", c.ipStr, fmt.Sprintf("Key '%s' not found", key), false, http.StatusNotFound)
+			c.writeNull()
+			return false
+		}
+		logMessage("RESP", "GET", c.ipStr, fmt.Sprintf("Retrieved key '%s' with value '%s'", key, value), false, http.StatusOK)
+		c.writeBulk(value)
+
+	case "SET":
+		if argc < 2 {
+			c.wrongArgs(action)
+			return false
+		}
+		key, value := args[1], args[2]
+		ttl, cond, err := parseRESPSetOptions(args[3:])
+		if err != nil {
+			logMessage("RESP", "SET", c.ipStr, err.Error(), false, http.StatusBadRequest)
+			c.writeError("ERR " + err.Error())
+			return false
+		}
+
+		if _, err := c.kvs.SetIf(key, value, ttl, cond); err != nil {
+			// Like Redis, a SET whose NX or XX condition isn't met replies with a null bulk string
+			if errors.Is(err, ErrConflict) {
+				logMessage("RESP", "SET", c.ipStr, err.Error(), false, http.StatusConflict)
+				c.writeNull()
+				return false
+			}
+			logMessage("RESP", "SET", c.ipStr, fmt.Sprintf("Failed to store key '%s': %v", key, err), false, http.StatusBadRequest)
+			c.writeError("ERR " + err.Error())
+			return false
+		}
+		logMessage("RESP", "SET", c.ipStr, fmt.Sprintf("Stored key '%s' with value '%s'", key, value), false, http.StatusOK)
+		c.writeSimple("OK")
+
+	case "DEL":
+		if argc < 1 {
+			c.wrongArgs(action)
+			return false
+		}
+		var deleted int64
+		for _, key := range args[1:] {
+			if c.kvs.Delete(key) {
+				deleted++
+			}
+		}
+		logMessage("RESP", "DEL", c.ipStr, fmt.Sprintf("Deleted %d of %d keys", deleted, argc), false, http.StatusOK)
+		c.writeInteger(deleted)
+
+	case "EXISTS":
+		if argc < 1 {
+			c.wrongArgs(action)
+			return false
+		}
+		// Like Redis, a key given several times is counted several times
+		var found int64
+		for _, key := range args[1:] {
+			if _, exists := c.kvs.Get(key); exists {
+				found++
+			}
+		}
+		logMessage("RESP", "EXISTS", c.ipStr, fmt.Sprintf("%d of %d keys exist", found, argc), false, http.StatusOK)
+		c.writeInteger(found)
+
+	case "INCR", "DECR", "INCRBY", "DECRBY":
+		withAmount := action == "INCRBY" || action == "DECRBY"
+		if (withAmount && argc != 2) || (!withAmount && argc != 1) {
+			c.wrongArgs(action)
+			return false
+		}
+		key := args[1]
+		delta := int64(1)
+		if withAmount {
+			n, err := strconv.ParseInt(args[2], 10, 64)
+			if err != nil || (action == "DECRBY" && n == math.MinInt64) {
+				logMessage("RESP", action, c.ipStr, fmt.Sprintf("Invalid amount '%s'", args[2]), false, http.StatusBadRequest)
+				c.writeError("ERR value is not an integer or out of range")
+				return false
+			}
+			delta = n
+		}
+		if action == "DECR" || action == "DECRBY" {
+			delta = -delta
+		}
+
+		value, _, err := c.kvs.IncrBy(key, delta)
+		if err != nil {
+			logMessage("RESP", action, c.ipStr, fmt.Sprintf("Failed to update key '%s': %v", key, err), false, http.StatusBadRequest)
+			switch {
+			case errors.Is(err, ErrNotInteger):
+				c.writeError("ERR value is not an integer or out of range")
+			case errors.Is(err, ErrOverflow):
+				c.writeError("ERR increment or decrement would overflow")
+			default:
+				c.writeError("ERR " + err.Error())
+			}
+			return false
+		}
+		logMessage("RESP", action, c.ipStr, fmt.Sprintf("Key '%s' is now %d", key, value), false, http.StatusOK)
+		c.writeInteger(value)
+
+	case "KEYS":
+		if argc != 1 {
+			c.wrongArgs(action)
+			return false
+		}
+		// KEYS returns every matching key, so page through the whole listing
+		keys := []string{}
+		q := KeysQuery{Match: args[1], Limit: MaxKeysLimit}
+		for {
+			listing, err := c.kvs.Keys(q)
+			if err != nil {
+				logMessage("RESP", "KEYS", c.ipStr, err.Error(), false, http.StatusBadRequest)
+				c.writeError("ERR " + err.Error())
+				return false
+			}
+			keys = append(keys, listing.Keys...)
+			if listing.NextCursor == "" {
+				break
+			}
+			q.Cursor = listing.NextCursor
+		}
+		logMessage("RESP", "KEYS", c.ipStr, fmt.Sprintf("Listed %d keys matching '%s'", len(keys), args[1]), false, http.StatusOK)
+		c.writeArray(keys)
+
+	case "INFO":
+		if argc > 1 {
+			c.wrongArgs(action)
+			return false
+		}
+		section := ""
+		if argc == 1 {
+			section = args[1]
+		}
+		logMessage("RESP", "INFO", c.ipStr, "Status retrieved successfully", false, http.StatusOK)
+		c.writeBulk(respInfo(c.kvs, section))
+
+	default:
+		logMessage("RESP", action, c.ipStr, "Unknown command", false, http.StatusBadRequest)
+		c.writeError(fmt.Sprintf("ERR unknown command '%s'", sanitizeRESPError(args[0])))
+	}
+
+	return false
+}
+
+// authenticate checks the token sent with AUTH or HELLO and, if it is valid, authenticates the connection with it
+// Writes an error reply and returns false otherwise
+func (c *respConn) authenticate(action, secret string) bool {
+	if c.auth == nil {
+		logMessage("RESP", action, c.ipStr, "Authentication is not enabled", false, http.StatusBadRequest)
+		c.writeError("ERR AUTH called without any token file configured on the server")
+		return false
+	}
+	token, err := c.auth.Authenticate(secret)
+	if err != nil {
+		logMessage("RESP", action, c.ipStr, err.Error(), true, http.StatusUnauthorized)
+		c.writeError("WRONGPASS invalid token")
+		return false
+	}
+	c.token = token
+	logMessage("RESP", action, c.ipStr, fmt.Sprintf("Authenticated with token '%s'", token.Name), false, http.StatusOK)
+	return true
+}
+
+// parseRESPSetOptions parses the EX, PX, NX and XX options of a SET command
+func parseRESPSetOptions(opts []string) (time.Duration, SetCondition, error) {
+	var ttl time.Duration
+	var cond SetCondition
+	hasExpire := false
+
+	for i := 0; i < len(opts); i++ {
+		switch opt := strings.ToUpper(opts[i]); opt {
+		case "NX":
+			cond.IfAbsent = true
+		case "XX":
+			cond.IfPresent = true
+		case "EX", "PX":
+			if hasExpire || i+1 >= len(opts) {
+				return 0, SetCondition{}, fmt.Errorf("syntax error")
+			}
+			i++
+			n, err := strconv.ParseInt(opts[i], 10, 64)
+			if err != nil || n <= 0 {
+				return 0, SetCondition{}, fmt.Errorf("invalid expire time in 'set' command")
+			}
+			unit := time.Second
+			if opt == "PX" {
+				unit = time.Millisecond
+			}
+			if n > int64(math.MaxInt64/unit) {
+				return 0, SetCondition{}, fmt.Errorf("invalid expire time in 'set' command")
+			}
+			ttl = time.Duration(n) * unit
+			hasExpire = true
+		default:
+			return 0, SetCondition{}, fmt.Errorf("syntax error")
+		}
+	}
+
+	if cond.IfAbsent && cond.IfPresent {
+		return 0, SetCondition{}, fmt.Errorf("syntax error")
+	}
+	return ttl, cond, nil
+}
+
+// respInfo renders the INFO reply, limited to section unless it is empty, "all", "default" or "everything"
+func respInfo(kvs *KeyValueStore, section string) string {
+	status := kvs.GetStatus()
+
+	sections := []struct {
+		name  string
+		lines []string
+	}{
+		{"Server", []string{
+			"kvapi_version:" + Version,
+			"kvapi_git_commit:" + GitCommit,
+			"redis_mode:standalone",
+		}},
+		{"Memory", []string{
+			fmt.Sprintf("used_memory:%d", status.MemoryUsage),
+			fmt.Sprintf("maxmemory:%d", status.Limits.MaxMemory),
+			"maxmemory_policy:" + status.EvictionPolicy,
+		}},
+		{"Stats", []string{
+			fmt.Sprintf("evicted_keys:%d", status.EvictedKeys),
+		}},
+		{"Keyspace", []string{
+			fmt.Sprintf("db0:keys=%d", status.KeyCount),
+		}},
+	}
+
+	all := false
+	switch strings.ToLower(section) {
+	case "", "all", "default", "everything":
+		all = true
+	}
+
+	var b strings.Builder
+	for _, s := range sections {
+		if !all && !strings.EqualFold(s.name, section) {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# " + s.name + "\r\n")
+		for _, line := range s.lines {
+			b.WriteString(line + "\r\n")
+		}
+	}
+	return b.String()
+}
+
+// wrongArgs replies with the Redis error for a wrong number of arguments
+func (c *respConn) wrongArgs(action string) {
+	logMessage("RESP", action, c.ipStr, "Wrong number of arguments", false, http.StatusBadRequest)
+	c.writeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(action)))
+}
+
+// sanitizeRESPError removes line breaks, which would end an error reply early
+func sanitizeRESPError(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+// writeSimple writes a simple string reply
+func (c *respConn) writeSimple(s string) {
+	c.w.WriteString("+" + s + "\r\n")
+}
+
+// writeError writes an error reply
+func (c *respConn) writeError(msg string) {
+	c.w.WriteString("-" + sanitizeRESPError(msg) + "\r\n")
+}
+
+// writeInteger writes an integer reply
+func (c *respConn) writeInteger(n int64) {
+	c.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+// writeBulk writes a bulk string reply
+func (c *respConn) writeBulk(s string) {
+	c.w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+// writeNull writes a null bulk string reply
+func (c *respConn) writeNull() {
+	c.w.WriteString("$-1\r\n")
+}
+
+// writeHello writes the HELLO reply, a map sent as a flat array of field names and values in RESP2
+func (c *respConn) writeHello() {
+	c.w.WriteString("*12\r\n")
+	c.writeBulk("server")
+	c.writeBulk("kvapi")
+	c.writeBulk("version")
+	c.writeBulk(Version)
+	c.writeBulk("proto")
+	c.writeInteger(2)
+	c.writeBulk("mode")
+	c.writeBulk("standalone")
+	c.writeBulk("role")
+	c.writeBulk("master")
+	c.writeBulk("modules")
+	c.w.WriteString("*0\r\n")
+}
+
+// writeArray writes an array of bulk strings
+func (c *respConn) writeArray(items []string) {
+	c.w.WriteString("*" + strconv.Itoa(len(items)) + "\r\n")
+	for _, item := range items {
+		c.writeBulk(item)
+	}
+}
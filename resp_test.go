@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// newTestRESPConn creates a connection reading input, with authentication enabled if auth is not nil
+// Replies are written to the returned buffer
+func newTestRESPConn(input io.Reader, auth *Authenticator) (*respConn, *bytes.Buffer) {
+	var out bytes.Buffer
+	return &respConn{
+		r:     bufio.NewReaderSize(input, RESPMaxInlineSize),
+		w:     bufio.NewWriter(&out),
+		ipStr: "127.0.0.1",
+		kvs:   NewKeyValueStore(DefaultLimits()),
+		ac:    &AccessControl{},
+		auth:  auth,
+	}, &out
+}
+
+// testAuthenticator returns an authenticator with a single write token
+func testAuthenticator() *Authenticator {
+	token := &Token{Name: "writer", Token: "secret", Role: RoleWrite}
+	return &Authenticator{tokens: map[[sha256.Size]byte]*Token{sha256.Sum256([]byte("secret")): token}}
+}
+
+// TestRESPReadCommand checks the parsing of inline and multibulk commands and their size limits
+func TestRESPReadCommand(t *testing.T) {
+	large := strings.Repeat("x", RESPMaxInlineSize+1)
+
+	tests := []struct {
+		name          string
+		input         string
+		authenticated bool // With authentication enabled, whether AUTH was sent
+		args          []string
+		failed        bool // A protocol error is expected
+	}{
+		{"inline", "SET key value\r\n", true, []string{"SET", "key", "value"}, false},
+		{"inline without CR", "GET key\n", true, []string{"GET", "key"}, false},
+		{"inline with extra spaces", "  GET   key  \r\n", true, []string{"GET", "key"}, false},
+		{"empty inline", "\r\n", true, []string{}, false},
+		{"inline too long", large + "\r\n", true, nil, true},
+		{"multibulk", "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nva ue\r\n", true, []string{"SET", "key", "va ue"}, false},
+		{"multibulk with empty string", "*2\r\n$4\r\nECHO\r\n$0\r\n\r\n", true, []string{"ECHO", ""}, false},
+		{"multibulk with binary data", "*2\r\n$4\r\nECHO\r\n$4\r\na\r\nb\r\n", true, []string{"ECHO", "a\r\nb"}, false},
+		{"invalid multibulk length", "*x\r\n", true, nil, true},
+		{"too many arguments", "*1025\r\n", true, nil, true},
+		{"missing bulk marker", "*1\r\n:3\r\n", true, nil, true},
+		{"negative bulk length", "*1\r\n$-1\r\n", true, nil, true},
+		{"bulk not terminated by CRLF", "*1\r\n$3\r\nGETX\r\n", true, nil, true},
+		{"large bulk after AUTH", "*2\r\n$4\r\nECHO\r\n$65537\r\n" + large + "\r\n", true, []string{"ECHO", large}, false},
+		{"bulk over the value size after AUTH", "*2\r\n$4\r\nECHO\r\n$1048577\r\n", true, nil, true},
+		{"large bulk before AUTH", "*2\r\n$4\r\nECHO\r\n$65537\r\n", false, nil, true},
+		{"too many arguments before AUTH", "*11\r\n", false, nil, true},
+		{"AUTH before AUTH", "*2\r\n$4\r\nAUTH\r\n$6\r\nsecret\r\n", false, []string{"AUTH", "secret"}, false},
+	}
+
+	for _, tt := range tests {
+		for _, split := range []bool{false, true} {
+			name := tt.name
+			if split {
+				name += " split"
+			}
+			t.Run(name, func(t *testing.T) {
+				// Split reads deliver one byte at a time, as a slow client would
+				var input io.Reader = strings.NewReader(tt.input)
+				if split {
+					input = iotest.OneByteReader(input)
+				}
+				c, _ := newTestRESPConn(input, testAuthenticator())
+				if tt.authenticated {
+					c.token = &Token{Name: "writer", Role: RoleWrite}
+				}
+
+				args, err := c.readCommand()
+				if tt.failed {
+					if !errors.Is(err, errRESPProtocol) {
+						t.Fatalf("expected a protocol error, got %q, %v", args, err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("readCommand: %v", err)
+				}
+				if strings.Join(args, "|") != strings.Join(tt.args, "|") || len(args) != len(tt.args) {
+					t.Fatalf("args = %q, want %q", args, tt.args)
+				}
+			})
+		}
+	}
+}
+
+// TestRESPHandshake checks the replies to the commands clients send when connecting
+func TestRESPHandshake(t *testing.T) {
+	hello := "*12\r\n$6\r\nserver\r\n$5\r\nkvapi\r\n$7\r\nversion\r\n$" + strconv.Itoa(len(Version)) + "\r\n" + Version + "\r\n" +
+		"$5\r\nproto\r\n:2\r\n$4\r\nmode\r\n$10\r\nstandalone\r\n$4\r\nrole\r\n$6\r\nmaster\r\n$7\r\nmodules\r\n*0\r\n"
+
+	tests := []struct {
+		name  string
+		auth  bool
+		input string
+		reply string
+	}{
+		{"HELLO", false, "HELLO\r\n", hello},
+		{"HELLO 2", false, "HELLO 2\r\n", hello},
+		{"HELLO 3", false, "HELLO 3\r\n", "-NOPROTO unsupported protocol version\r\n"},
+		{"HELLO with an invalid version", false, "HELLO x\r\n", "-ERR Protocol version is not an integer or out of range\r\n"},
+		{"HELLO with AUTH", true, "HELLO 2 AUTH default secret SETNAME app\r\nCLIENT GETNAME\r\nGET missing\r\n", hello + "$3\r\napp\r\n$-1\r\n"},
+		{"HELLO with a wrong token", true, "HELLO 2 AUTH default wrong\r\nGET missing\r\n", "-WRONGPASS invalid token\r\n-NOAUTH Authentication required.\r\n"},
+		{"handshake before AUTH", true, "CLIENT SETNAME app\r\nSELECT 0\r\nCOMMAND DOCS\r\n", "+OK\r\n+OK\r\n*0\r\n"},
+		{"CLIENT SETNAME", false, "CLIENT SETNAME app\r\nCLIENT GETNAME\r\n", "+OK\r\n$3\r\napp\r\n"},
+		{"CLIENT GETNAME without a name", false, "CLIENT GETNAME\r\n", "$-1\r\n"},
+		{"CLIENT SETINFO", false, "CLIENT SETINFO LIB-NAME redis-py\r\n", "+OK\r\n"},
+		{"CLIENT unknown subcommand", false, "CLIENT KILL x\r\n", "-ERR unknown subcommand 'KILL'\r\n"},
+		{"SELECT 0", false, "SELECT 0\r\n", "+OK\r\n"},
+		{"SELECT 1", false, "SELECT 1\r\n", "-ERR DB index is out of range\r\n"},
+		{"COMMAND", false, "COMMAND\r\n", "*0\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var auth *Authenticator
+			if tt.auth {
+				auth = testAuthenticator()
+			}
+			client, server := net.Pipe()
+			go func() {
+				client.Write([]byte(tt.input))
+				client.Close()
+			}()
+
+			c, out := newTestRESPConn(server, auth)
+			c.conn = server
+			c.serve()
+
+			if out.String() != tt.reply {
+				t.Fatalf("reply = %q, want %q", out.String(), tt.reply)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SnapshotFormatVersion is the version of the on-disk snapshot format
+const SnapshotFormatVersion = 1
+
+// snapshotFile is the on-disk representation of a snapshot
+// Entries holds the raw JSON of the stored keys so that the checksum can be
+// verified against exactly the bytes that were written
+type snapshotFile struct {
+	FormatVersion int             `json:"format_version"`
+	CreatedAt     time.Time       `json:"created_at"`
+	Checksum      string          `json:"checksum"` // Hex encoded SHA-256 of Entries
+	Revision      uint64          `json:"revision"`
+	Entries       json.RawMessage `json:"entries"`
+}
+
+// snapshotEntry is a single key-value pair as stored in a snapshot
+type snapshotEntry struct {
+	Key       string     `json:"key"`
+	Value     string     `json:"value"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Version   uint64     `json:"version,omitempty"`
+	Flags     uint32     `json:"flags,omitempty"`
+}
+
+// Snapshot returns a point-in-time copy of all live keys in the store and the current store revision
+func (kvs *KeyValueStore) Snapshot() ([]snapshotEntry, uint64) {
+	kvs.mu.RLock()
+	defer kvs.mu.RUnlock()
+	return kvs.snapshotLocked(time.Now()), kvs.revision
+}
+
+// snapshotLocked returns a copy of all keys that are live at now
+// The caller must hold at least the read lock
+func (kvs *KeyValueStore) snapshotLocked(now time.Time) []snapshotEntry {
+	entries := make([]snapshotEntry, 0, len(kvs.store))
+	for k, entry := range kvs.store {
+		if entry.expired(now) {
+			continue
+		}
+
+		se := snapshotEntry{Key: k, Value: entry.value, Version: entry.version, Flags: entry.flags}
+		if !entry.expiresAt.IsZero() {
+			expiresAt := entry.expiresAt
+			se.ExpiresAt = &expiresAt
+		}
+		entries = append(entries, se)
+	}
+
+	return entries
+}
+
+// Restore replaces the contents of the store with the given snapshot entries
+// Entries that have expired in the meantime are skipped
+// Returns the number of keys restored
+func (kvs *KeyValueStore) Restore(entries []snapshotEntry, revision uint64) int {
+	now := time.Now()
+	store := make(map[string]storeEntry, len(entries))
+	for _, se := range entries {
+		if se.Version > revision {
+			revision = se.Version
+		}
+
+		entry := storeEntry{value: se.Value, version: se.Version, flags: se.Flags}
+		if se.ExpiresAt != nil {
+			entry.expiresAt = *se.ExpiresAt
+		}
+		if entry.expired(now) {
+			continue
+		}
+		store[se.Key] = entry
+	}
+
+	kvs.mu.Lock()
+	kvs.replaceAllLocked(store)
+	kvs.revision = revision
+	kvs.mu.Unlock()
+
+	return len(store)
+}
+
+// saveSnapshot atomically writes a snapshot of the store to path
+// The snapshot is written to a temporary file in the same directory which is
+// then renamed over the target, so a crash never leaves a partial snapshot behind
+func saveSnapshot(path string, kvs *KeyValueStore) (int, error) {
+	entries, revision := kvs.Snapshot()
+
+	rawEntries, err := json.Marshal(entries)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode snapshot entries: %w", err)
+	}
+
+	sum := sha256.Sum256(rawEntries)
+	data, err := json.Marshal(snapshotFile{
+		FormatVersion: SnapshotFormatVersion,
+		CreatedAt:     time.Now(),
+		Checksum:      hex.EncodeToString(sum[:]),
+		Revision:      revision,
+		Entries:       rawEntries,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create temporary snapshot file: %w", err)
+	}
+	tmpName := tmp.Name()
+
+	// Remove the temporary file if anything goes wrong before the rename
+	success := false
+	defer func() {
+		if !success {
+			os.Remove(tmpName)
+		}
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("failed to sync snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, fmt.Errorf("failed to close snapshot: %w", err)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return 0, fmt.Errorf("failed to replace snapshot: %w", err)
+	}
+	success = true
+
+	// Sync the directory so the rename itself is durable
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return len(entries), nil
+}
+
+// loadSnapshot reads a snapshot from path and restores it into the store
+// A missing file is not an error and leaves the store empty
+// Returns the number of keys restored
+func loadSnapshot(path string, kvs *KeyValueStore) (int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	var file snapshotFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return 0, fmt.Errorf("snapshot is corrupted: %w", err)
+	}
+
+	if file.FormatVersion != SnapshotFormatVersion {
+		return 0, fmt.Errorf("unsupported snapshot format version %d", file.FormatVersion)
+	}
+
+	sum := sha256.Sum256(file.Entries)
+	if hex.EncodeToString(sum[:]) != file.Checksum {
+		return 0, fmt.Errorf("snapshot is corrupted: checksum mismatch")
+	}
+
+	var entries []snapshotEntry
+	if err := json.Unmarshal(file.Entries, &entries); err != nil {
+		return 0, fmt.Errorf("snapshot is corrupted: %w", err)
+	}
+
+	return kvs.Restore(entries, file.Revision), nil
+}
+
+// startSnapshotter periodically writes snapshots of the store to path
+func startSnapshotter(path string, interval time.Duration, kvs *KeyValueStore) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			count, err := saveSnapshot(path, kvs)
+			if err != nil {
+				logMessage("SYSTEM", "snapshot", "local", fmt.Sprintf("Error writing snapshot: %v", err), false, http.StatusInternalServerError)
+				continue
+			}
+			logMessage("SYSTEM", "snapshot", "local", fmt.Sprintf("Wrote snapshot with %d keys to %s", count, path), false, http.StatusOK)
+		}
+	}()
+}
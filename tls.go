@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// tlsReloader holds the server certificate and client CA pool, which can be reloaded without a restart
+type tlsReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string // Empty if client certificates are not required
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// newTLSReloader loads the server certificate and, if clientCAFile is set, the client CA bundle
+func newTLSReloader(certFile, keyFile, clientCAFile string) (*tlsReloader, error) {
+	t := &tlsReloader{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// reload reads the certificate files again
+// On error the previously loaded files stay in use
+func (t *tlsReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if t.clientCAFile != "" {
+		pem, err := os.ReadFile(t.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA file: %v", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client CA file %s", t.clientCAFile)
+		}
+	}
+
+	t.mu.Lock()
+	t.cert = &cert
+	t.clientCAs = clientCAs
+	t.mu.Unlock()
+	return nil
+}
+
+// config returns a TLS config that always uses the most recently loaded files
+func (t *tlsReloader) config() *tls.Config {
+	getCertificate := func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		t.mu.RLock()
+		defer t.mu.RUnlock()
+		return t.cert, nil
+	}
+
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: getCertificate,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			t.mu.RLock()
+			defer t.mu.RUnlock()
+
+			cfg := &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				GetCertificate: getCertificate,
+				NextProtos:     []string{"http/1.1"}, // WebSocket and SSE need HTTP/1.1
+			}
+			if t.clientCAs != nil {
+				cfg.ClientCAs = t.clientCAs
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// reloadOnSIGHUP reloads the certificate files whenever the process receives SIGHUP
+func (t *tlsReloader) reloadOnSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			if err := t.reload(); err != nil {
+				log.Printf("TLS reload failed, keeping the previous certificates: %v", err)
+				continue
+			}
+			log.Printf("TLS certificates reloaded from %s", t.certFile)
+		}
+	}()
+}
+
+// clientCertSubject returns the subject of the verified client certificate of a request, if any
+func clientCertSubject(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return r.TLS.PeerCertificates[0].Subject.String()
+}
+
+// clientCertCommonName returns the common name of the verified client certificate of a request, if any
+func clientCertCommonName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return r.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+// parseAllowedClients parses a comma-separated list of client certificate common names
+// An empty list returns nil, which allows every client with a valid certificate
+func parseAllowedClients(s string) map[string]bool {
+	if s == "" {
+		return nil
+	}
+
+	names := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names[name] = true
+		}
+	}
+	return names
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Transaction compare targets
+const (
+	TxnTargetVersion = "version" // Compare the version of the key (0 if it doesn't exist)
+	TxnTargetValue   = "value"   // Compare the value of the key (fails if it doesn't exist)
+)
+
+// Transaction operations
+const (
+	TxnOpGet    = "get"
+	TxnOpSet    = "set"
+	TxnOpDelete = "delete"
+)
+
+// TxnCompare is a condition evaluated against the current state of a key
+type TxnCompare struct {
+	Key     string `json:"key"`
+	Target  string `json:"target"`            // "version" or "value"
+	Result  string `json:"result,omitempty"`  // "=", "!=", "<" or ">" (default "=")
+	Version uint64 `json:"version,omitempty"` // Expected version when target is "version"
+	Value   string `json:"value,omitempty"`   // Expected value when target is "value"
+}
+
+// TxnOp is an operation executed by a transaction
+type TxnOp struct {
+	Op    string `json:"op"` // "get", "set" or "delete"
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	TTL   int64  `json:"ttl,omitempty"` // Time to live in seconds for "set" (0 means the key never expires)
+}
+
+// TxnRequest is an etcd-style transaction: if every compare holds the success
+// operations are executed, otherwise the failure operations are
+type TxnRequest struct {
+	Compare []TxnCompare `json:"compare"`
+	Success []TxnOp      `json:"success"`
+	Failure []TxnOp      `json:"failure"`
+}
+
+// TxnOpResult is the result of a single transaction operation
+type TxnOpResult struct {
+	Op      string `json:"op"`
+	Key     string `json:"key"`
+	Found   bool   `json:"found,omitempty"`   // "get": the key exists; "delete": the key was deleted
+	Value   string `json:"value,omitempty"`   // "get": the value of the key
+	Version uint64 `json:"version,omitempty"` // "get": the version of the key; "set": the new version
+	TTL     int64  `json:"ttl_remaining,omitempty"`
+}
+
+// TxnResult is the result of a transaction
+type TxnResult struct {
+	Succeeded bool          `json:"succeeded"` // Whether every compare held and the success operations were executed
+	Revision  uint64        `json:"revision"`  // Store revision after the transaction
+	Results   []TxnOpResult `json:"results"`
+}
+
+// Validate checks that the transaction is well-formed
+func (t TxnRequest) Validate() error {
+	if len(t.Compare) > MaxBatchSize || len(t.Success) > MaxBatchSize || len(t.Failure) > MaxBatchSize {
+		return fmt.Errorf("too many compares or operations: a transaction may hold at most %d of each", MaxBatchSize)
+	}
+
+	for i, c := range t.Compare {
+		if c.Key == "" {
+			return fmt.Errorf("compare %d: missing key", i)
+		}
+		if c.Target != TxnTargetVersion && c.Target != TxnTargetValue {
+			return fmt.Errorf("compare %d: invalid target '%s': must be version or value", i, c.Target)
+		}
+		switch c.Result {
+		case "", "=", "==", "!=", "<", ">":
+		default:
+			return fmt.Errorf("compare %d: invalid result '%s': must be one of =, !=, <, >", i, c.Result)
+		}
+	}
+
+	for _, ops := range [][]TxnOp{t.Success, t.Failure} {
+		for i, op := range ops {
+			if op.Key == "" {
+				return fmt.Errorf("operation %d: missing key", i)
+			}
+			switch op.Op {
+			case TxnOpGet, TxnOpSet, TxnOpDelete:
+			default:
+				return fmt.Errorf("operation %d: invalid op '%s': must be get, set or delete", i, op.Op)
+			}
+			if op.TTL < 0 || op.TTL > MaxTTLSeconds {
+				return fmt.Errorf("operation %d: invalid ttl %d: must be between 0 and %d seconds", i, op.TTL, MaxTTLSeconds)
+			}
+		}
+	}
+
+	return nil
+}
+
+// commands returns the commands the transaction may run, for the access rules scoped to them
+// Compares read their keys like GET, and the operations of both branches are included
+func (t TxnRequest) commands() []string {
+	names := map[string]string{TxnOpGet: "GET", TxnOpSet: "SET", TxnOpDelete: "DEL"}
+
+	var commands []string
+	seen := make(map[string]bool)
+	add := func(command string) {
+		if !seen[command] {
+			seen[command] = true
+			commands = append(commands, command)
+		}
+	}
+	if len(t.Compare) > 0 {
+		add("GET")
+	}
+	for _, ops := range [][]TxnOp{t.Success, t.Failure} {
+		for _, op := range ops {
+			add(names[op.Op])
+		}
+	}
+	return commands
+}
+
+// compareOrdered applies a compare result operator to the outcome of a three-way comparison
+func compareOrdered(result string, cmp int) bool {
+	switch result {
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp == 0
+	}
+}
+
+// Txn atomically evaluates the compares of a transaction and executes its success or failure operations
+// Writes are all or nothing: if any of them is invalid or doesn't fit the limits, none is applied
+// Every key written by the transaction gets the same version
+func (kvs *KeyValueStore) Txn(t TxnRequest) (TxnResult, error) {
+	if err := t.Validate(); err != nil {
+		return TxnResult{}, err
+	}
+
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+
+	now := time.Now()
+
+	// lookup returns the live entry for key as seen before the transaction
+	lookup := func(key string) (storeEntry, bool) {
+		entry, exists := kvs.store[key]
+		if !exists || entry.expired(now) {
+			return storeEntry{}, false
+		}
+		return entry, true
+	}
+
+	succeeded := true
+	for _, c := range t.Compare {
+		entry, exists := lookup(c.Key)
+		var holds bool
+		switch c.Target {
+		case TxnTargetVersion:
+			// A missing key has version 0, so {"target":"version","version":0} checks that it doesn't exist
+			var version uint64
+			if exists {
+				version = entry.version
+			}
+			cmp := 0
+			if version < c.Version {
+				cmp = -1
+			} else if version > c.Version {
+				cmp = 1
+			}
+			holds = compareOrdered(c.Result, cmp)
+		case TxnTargetValue:
+			holds = exists && compareOrdered(c.Result, strings.Compare(entry.value, c.Value))
+		}
+		if !holds {
+			succeeded = false
+			break
+		}
+	}
+
+	ops := t.Success
+	if !succeeded {
+		ops = t.Failure
+	}
+
+	// Stage every write so later operations see earlier ones and the limits can be
+	// checked for the final state before anything is applied
+	staged := make(map[string]storeEntry)
+	deleted := make(map[string]bool)
+	var order []string
+	var pendingVersions []int // Results that report the version of a staged write
+	view := func(key string) (storeEntry, bool) {
+		if deleted[key] {
+			return storeEntry{}, false
+		}
+		if entry, ok := staged[key]; ok {
+			return entry, true
+		}
+		return lookup(key)
+	}
+	touch := func(key string) {
+		if _, ok := staged[key]; !ok && !deleted[key] {
+			order = append(order, key)
+		}
+	}
+
+	results := make([]TxnOpResult, 0, len(ops))
+	for _, op := range ops {
+		res := TxnOpResult{Op: op.Op, Key: op.Key}
+
+		switch op.Op {
+		case TxnOpGet:
+			if entry, exists := view(op.Key); exists {
+				res.Found = true
+				res.Value = entry.value
+				res.Version = entry.version
+				res.TTL = ttlSeconds(entry.ttlRemaining(now))
+				if _, ok := staged[op.Key]; ok {
+					pendingVersions = append(pendingVersions, len(results))
+				}
+			}
+		case TxnOpSet:
+			if err := kvs.validateItemLocked(BatchItem{Key: op.Key, Value: op.Value, TTL: op.TTL}); err != nil {
+				return TxnResult{}, err
+			}
+			entry := storeEntry{value: op.Value, lastAccess: now, hits: 1}
+			if op.TTL > 0 {
+				entry.expiresAt = now.Add(time.Duration(op.TTL) * time.Second)
+			}
+			if current, exists := view(op.Key); exists {
+				entry.hits = current.hits + 1
+			}
+			touch(op.Key)
+			staged[op.Key] = entry
+			delete(deleted, op.Key)
+			pendingVersions = append(pendingVersions, len(results))
+		case TxnOpDelete:
+			if _, exists := view(op.Key); exists {
+				touch(op.Key)
+				delete(staged, op.Key)
+				deleted[op.Key] = true
+				res.Found = true
+			}
+		}
+
+		results = append(results, res)
+	}
+
+	if len(order) == 0 {
+		return TxnResult{Succeeded: succeeded, Revision: kvs.revision, Results: results}, nil
+	}
+
+	// Keys deleted by the transaction that don't exist in the store need no removal
+	without := make(map[string]bool)
+	for key := range deleted {
+		if _, exists := kvs.store[key]; exists {
+			without[key] = true
+		}
+	}
+
+	if err := kvs.batchLimitErrorLocked(staged, without); err != nil {
+		kvs.removeExpiredLocked(now)
+		for key := range without {
+			if _, exists := kvs.store[key]; !exists {
+				delete(without, key)
+			}
+		}
+		if kvs.eviction == EvictionNone {
+			err = kvs.batchLimitErrorLocked(staged, without)
+		} else {
+			err = kvs.evictBatchLocked(staged, without)
+		}
+		if err != nil {
+			return TxnResult{}, err
+		}
+	}
+
+	// Deleting a key that isn't in the store, such as one the transaction set and then
+	// deleted again, changes nothing and is neither logged nor published
+	changed := order[:0]
+	for _, key := range order {
+		if _, exists := kvs.store[key]; deleted[key] && !exists {
+			continue
+		}
+		changed = append(changed, key)
+	}
+	order = changed
+	if len(order) == 0 {
+		return TxnResult{Succeeded: succeeded, Revision: kvs.revision, Results: results}, nil
+	}
+
+	// The version is only assigned now because evictions advance the revision
+	version := kvs.revision + 1
+	for _, i := range pendingVersions {
+		results[i].Version = version
+	}
+
+	// The writes are logged as a single record so they are replayed all or nothing
+	records := make([]logRecord, 0, len(order))
+	for _, key := range order {
+		if deleted[key] {
+			records = append(records, logRecord{Op: OpDelete, Key: key, Version: version})
+			continue
+		}
+		entry := staged[key]
+		entry.version = version
+		staged[key] = entry
+		records = append(records, setRecord(key, entry))
+	}
+	if err := kvs.logMutationLocked(logRecord{Op: OpBatch, Version: version, Records: records}); err != nil {
+		return TxnResult{}, err
+	}
+
+	kvs.revision = version
+	events := make([]WatchEvent, 0, len(order))
+	for _, key := range order {
+		if deleted[key] {
+			kvs.removeLocked(key)
+			events = append(events, WatchEvent{Type: EventDelete, Key: key, Revision: version})
+		} else {
+			kvs.putLocked(key, staged[key])
+			events = append(events, setEvent(key, staged[key], now))
+		}
+	}
+	kvs.publishLocked(events...)
+
+	return TxnResult{Succeeded: succeeded, Revision: version, Results: results}, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestTxn checks which branch a transaction runs and what its operations see and change
+func TestTxn(t *testing.T) {
+	tests := []struct {
+		name      string
+		txn       TxnRequest
+		succeeded bool
+		results   []TxnOpResult // Version 0 stands for the version of the transaction, if it wrote anything
+		keys      map[string]string
+		events    []string // Keys of the published events, in order
+	}{
+		{
+			name: "failed compare runs the failure branch",
+			txn: TxnRequest{
+				Compare: []TxnCompare{{Key: "existing", Target: TxnTargetVersion, Version: 5}},
+				Success: []TxnOp{{Op: TxnOpSet, Key: "existing", Value: "changed"}},
+				Failure: []TxnOp{{Op: TxnOpGet, Key: "existing"}, {Op: TxnOpSet, Key: "fallback", Value: "1"}},
+			},
+			succeeded: false,
+			results: []TxnOpResult{
+				{Op: TxnOpGet, Key: "existing", Found: true, Value: "old", Version: 1},
+				{Op: TxnOpSet, Key: "fallback"},
+			},
+			keys:   map[string]string{"existing": "old", "fallback": "1"},
+			events: []string{"fallback"},
+		},
+		{
+			name: "staged reads see earlier writes",
+			txn: TxnRequest{
+				Compare: []TxnCompare{{Key: "existing", Target: TxnTargetValue, Value: "old"}},
+				Success: []TxnOp{
+					{Op: TxnOpSet, Key: "a", Value: "1"},
+					{Op: TxnOpGet, Key: "a"},
+					{Op: TxnOpDelete, Key: "existing"},
+					{Op: TxnOpGet, Key: "existing"},
+				},
+			},
+			succeeded: true,
+			results: []TxnOpResult{
+				{Op: TxnOpSet, Key: "a"},
+				{Op: TxnOpGet, Key: "a", Found: true, Value: "1"},
+				{Op: TxnOpDelete, Key: "existing", Found: true},
+				{Op: TxnOpGet, Key: "existing"},
+			},
+			keys:   map[string]string{"a": "1"},
+			events: []string{"a", "existing"},
+		},
+		{
+			name: "deleting a key set by the transaction is skipped",
+			txn: TxnRequest{
+				Success: []TxnOp{
+					{Op: TxnOpSet, Key: "a", Value: "1"},
+					{Op: TxnOpSet, Key: "tmp", Value: "1"},
+					{Op: TxnOpDelete, Key: "tmp"},
+				},
+			},
+			succeeded: true,
+			results: []TxnOpResult{
+				{Op: TxnOpSet, Key: "a"},
+				{Op: TxnOpSet, Key: "tmp"},
+				{Op: TxnOpDelete, Key: "tmp", Found: true},
+			},
+			keys:   map[string]string{"existing": "old", "a": "1"},
+			events: []string{"a"},
+		},
+		{
+			name: "transaction that only deletes missing keys changes nothing",
+			txn: TxnRequest{
+				Success: []TxnOp{{Op: TxnOpSet, Key: "tmp", Value: "1"}, {Op: TxnOpDelete, Key: "tmp"}, {Op: TxnOpDelete, Key: "missing"}},
+			},
+			succeeded: true,
+			results: []TxnOpResult{
+				{Op: TxnOpSet, Key: "tmp"},
+				{Op: TxnOpDelete, Key: "tmp", Found: true},
+				{Op: TxnOpDelete, Key: "missing"},
+			},
+			keys: map[string]string{"existing": "old"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kvs := NewKeyValueStore(DefaultLimits())
+			if err := kvs.Set("existing", "old", 0); err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := kvs.Txn(tt.txn)
+			if err != nil {
+				t.Fatalf("Txn: %v", err)
+			}
+			if result.Succeeded != tt.succeeded {
+				t.Errorf("succeeded = %v, want %v", result.Succeeded, tt.succeeded)
+			}
+
+			wantRevision := uint64(1)
+			if len(tt.events) > 0 {
+				wantRevision = 2
+			}
+			if result.Revision != wantRevision {
+				t.Errorf("revision = %d, want %d", result.Revision, wantRevision)
+			}
+
+			if len(result.Results) != len(tt.results) {
+				t.Fatalf("results = %+v, want %+v", result.Results, tt.results)
+			}
+			for i, want := range tt.results {
+				if want.Version == 0 && len(tt.events) > 0 && (want.Op == TxnOpSet || want.Found && want.Op == TxnOpGet) {
+					want.Version = result.Revision
+				}
+				if got := result.Results[i]; got != want {
+					t.Errorf("result %d = %+v, want %+v", i, got, want)
+				}
+			}
+
+			for _, key := range []string{"existing", "a", "tmp", "fallback", "missing"} {
+				value, exists := kvs.Get(key)
+				want, wantExists := tt.keys[key]
+				if exists != wantExists || value != want {
+					t.Errorf("key '%s' = %q, %v; want %q, %v", key, value, exists, want, wantExists)
+				}
+			}
+
+			w, backlog, _, err := kvs.Watch(WatchFilter{}, WatchPosition{Revision: 1, Index: -1})
+			if err != nil {
+				t.Fatalf("Watch: %v", err)
+			}
+			defer w.Cancel()
+			var events []string
+			for _, ev := range backlog {
+				events = append(events, ev.Key)
+			}
+			if len(events) != len(tt.events) {
+				t.Fatalf("published events for %v, want %v", events, tt.events)
+			}
+			for i := range events {
+				if events[i] != tt.events[i] {
+					t.Errorf("published events for %v, want %v", events, tt.events)
+					break
+				}
+			}
+		})
+	}
+}
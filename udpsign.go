@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signed UDP datagram limits
+const (
+	UDPSignatureMaxSkew = 30 * time.Second // Maximum difference between the datagram timestamp and the server clock
+	UDPNonceMaxLength   = 64               // Maximum length of a nonce in bytes
+)
+
+// ErrBadSignature is returned when a datagram is unsigned, wrongly signed, stale or replayed
+var ErrBadSignature = errors.New("signature rejected")
+
+// udpVerifier checks signed UDP datagrams and remembers their nonces to reject replays
+// A signed datagram has the form "SIG <unix timestamp> <nonce> <hex HMAC-SHA256> <command>"
+type udpVerifier struct {
+	secret  []byte
+	maxSkew time.Duration
+
+	mu        sync.Mutex
+	nonces    map[string]time.Time // Nonces seen recently and when they may be forgotten
+	lastPrune time.Time
+}
+
+// newUDPVerifier creates a verifier for datagrams signed with secret
+func newUDPVerifier(secret string) *udpVerifier {
+	return &udpVerifier{
+		secret:  []byte(secret),
+		maxSkew: UDPSignatureMaxSkew,
+		nonces:  make(map[string]time.Time),
+	}
+}
+
+// signUDPCommand returns the hex HMAC-SHA256 of a command sent with the given timestamp and nonce
+func signUDPCommand(secret []byte, timestamp int64, nonce, command string) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d %s %s", timestamp, nonce, command)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature, timestamp and nonce of a datagram received at now
+// Returns the command without the signature
+func (v *udpVerifier) Verify(datagram string, now time.Time) (string, error) {
+	parts := strings.SplitN(strings.TrimSpace(datagram), " ", 5)
+	if len(parts) < 5 || parts[0] != "SIG" {
+		return "", fmt.Errorf("%w: send datagrams as SIG <timestamp> <nonce> <signature> <command>", ErrBadSignature)
+	}
+	tsParam, nonce, signature, command := parts[1], parts[2], parts[3], parts[4]
+
+	timestamp, err := strconv.ParseInt(tsParam, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid timestamp '%s'", ErrBadSignature, tsParam)
+	}
+	if nonce == "" || len(nonce) > UDPNonceMaxLength {
+		return "", fmt.Errorf("%w: nonce must be 1 to %d bytes long", ErrBadSignature, UDPNonceMaxLength)
+	}
+
+	expected := signUDPCommand(v.secret, timestamp, nonce, command)
+	if !hmac.Equal([]byte(strings.ToLower(signature)), []byte(expected)) {
+		return "", fmt.Errorf("%w: invalid signature", ErrBadSignature)
+	}
+
+	// Only a correctly signed datagram is checked for freshness, so forged ones can't fill the nonce cache
+	sent := time.Unix(timestamp, 0)
+	if skew := now.Sub(sent); skew > v.maxSkew || skew < -v.maxSkew {
+		return "", fmt.Errorf("%w: timestamp is %s away from the server clock (at most %s allowed)", ErrBadSignature, skew.Round(time.Second), v.maxSkew)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.pruneLocked(now)
+	if _, seen := v.nonces[nonce]; seen {
+		return "", fmt.Errorf("%w: nonce '%s' was already used", ErrBadSignature, nonce)
+	}
+	// Once the timestamp is too old to pass the skew check, the nonce no longer needs to be remembered
+	v.nonces[nonce] = sent.Add(v.maxSkew)
+
+	return command, nil
+}
+
+// pruneLocked forgets nonces whose datagrams would be rejected as stale anyway
+// The caller must hold the lock
+func (v *udpVerifier) pruneLocked(now time.Time) {
+	if now.Sub(v.lastPrune) < v.maxSkew {
+		return
+	}
+	for nonce, forgetAt := range v.nonces {
+		if now.After(forgetAt) {
+			delete(v.nonces, nonce)
+		}
+	}
+	v.lastPrune = now
+}
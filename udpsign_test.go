@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// signedDatagram builds a datagram signed with secret
+func signedDatagram(secret string, sent time.Time, nonce, command string) string {
+	return fmt.Sprintf("SIG %d %s %s %s", sent.Unix(), nonce, signUDPCommand([]byte(secret), sent.Unix(), nonce, command), command)
+}
+
+// TestUDPVerifierVerify checks the signature and timestamp checks of signed datagrams
+func TestUDPVerifierVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name     string
+		datagram string
+		valid    bool
+	}{
+		{"valid signature", signedDatagram("secret", now, "n1", "GET key"), true},
+		{"wrong secret", signedDatagram("other", now, "n1", "GET key"), false},
+		{"altered command", signedDatagram("secret", now, "n1", "GET key") + "s", false},
+		{"unsigned", "GET key", false},
+		{"invalid timestamp", "SIG soon n1 00 GET key", false},
+		{"30s in the past", signedDatagram("secret", now.Add(-30*time.Second), "n1", "GET key"), true},
+		{"31s in the past", signedDatagram("secret", now.Add(-31*time.Second), "n1", "GET key"), false},
+		{"30s in the future", signedDatagram("secret", now.Add(30*time.Second), "n1", "GET key"), true},
+		{"31s in the future", signedDatagram("secret", now.Add(31*time.Second), "n1", "GET key"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command, err := newUDPVerifier("secret").Verify(tt.datagram, now)
+			if !tt.valid {
+				if !errors.Is(err, ErrBadSignature) {
+					t.Fatalf("expected ErrBadSignature, got %q, %v", command, err)
+				}
+				return
+			}
+			if err != nil || command != "GET key" {
+				t.Fatalf("Verify = %q, %v; want GET key", command, err)
+			}
+		})
+	}
+}
+
+// TestUDPVerifierNonces checks that a replayed nonce is rejected and that stale nonces are forgotten
+func TestUDPVerifierNonces(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	v := newUDPVerifier("secret")
+
+	datagram := signedDatagram("secret", now, "n1", "PING")
+	if _, err := v.Verify(datagram, now); err != nil {
+		t.Fatalf("first datagram rejected: %v", err)
+	}
+	if _, err := v.Verify(datagram, now.Add(time.Second)); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("replayed datagram accepted: %v", err)
+	}
+	if _, err := v.Verify(signedDatagram("secret", now, "n2", "PING"), now); err != nil {
+		t.Fatalf("datagram with a new nonce rejected: %v", err)
+	}
+
+	// Once the first datagrams are too old to pass the skew check their nonces are pruned
+	later := now.Add(2 * UDPSignatureMaxSkew)
+	if _, err := v.Verify(signedDatagram("secret", later, "n3", "PING"), later); err != nil {
+		t.Fatalf("later datagram rejected: %v", err)
+	}
+	if len(v.nonces) != 1 {
+		t.Fatalf("verifier remembers %d nonces, want only the latest", len(v.nonces))
+	}
+	if _, err := v.Verify(datagram, later); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("stale datagram with a pruned nonce accepted: %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// peerCredentials identifies the local process on the other end of a Unix socket
+type peerCredentials struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// unixPeerKey is the context key under which connections accepted on the Unix socket
+// store the credentials of their peer (nil if they could not be determined)
+type unixPeerKey struct{}
+
+// unixPeerFromRequest returns the peer credentials of a request received over the Unix socket
+// The second result reports whether the request came over the Unix socket at all
+func unixPeerFromRequest(r *http.Request) (*peerCredentials, bool) {
+	cred, ok := r.Context().Value(unixPeerKey{}).(*peerCredentials)
+	return cred, ok
+}
+
+// clientIdentity returns the identity of the client used for logging
+// Requests over the Unix socket are identified by the peer uid, all others by their IP
+// and, with mutual TLS, the subject of their client certificate
+func clientIdentity(r *http.Request) string {
+	if cred, unix := unixPeerFromRequest(r); unix {
+		if cred == nil {
+			return "unix:unknown"
+		}
+		return fmt.Sprintf("uid:%d", cred.UID)
+	}
+
+	ip, err := getIPFromRequest(r)
+	if err != nil {
+		return "unknown"
+	}
+
+	// Clients authenticated with a certificate are logged with its subject
+	if subject := clientCertSubject(r); subject != "" {
+		return fmt.Sprintf("%s (%s)", ip, subject)
+	}
+	return ip.String()
+}
+
+// parseSocketMode parses the octal file mode of the Unix socket
+func parseSocketMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid socket mode '%s': must be an octal permission like 0660", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// parseSocketOwner parses a "user[:group]" owner of the Unix socket, by name or numeric id
+// Returns -1 for the parts that are not given, as expected by os.Chown
+func parseSocketOwner(s string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if s == "" {
+		return uid, gid, nil
+	}
+
+	userPart, groupPart, hasGroup := strings.Cut(s, ":")
+	if userPart != "" {
+		if uid, err = lookupUID(userPart); err != nil {
+			return -1, -1, err
+		}
+	}
+	if hasGroup && groupPart != "" {
+		gid, err = strconv.Atoi(groupPart)
+		if err != nil {
+			g, lookupErr := user.LookupGroup(groupPart)
+			if lookupErr != nil {
+				return -1, -1, fmt.Errorf("invalid socket group '%s': %v", groupPart, lookupErr)
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return -1, -1, fmt.Errorf("invalid socket group '%s': %v", groupPart, err)
+			}
+		}
+	}
+	return uid, gid, nil
+}
+
+// parseAllowedUIDs parses a comma-separated list of users, by name or numeric uid
+// An empty list returns nil, which allows every peer
+func parseAllowedUIDs(s string) (map[uint32]bool, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	uids := make(map[uint32]bool)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		uid, err := lookupUID(part)
+		if err != nil {
+			return nil, err
+		}
+		uids[uint32(uid)] = true
+	}
+	return uids, nil
+}
+
+// lookupUID resolves a user name or numeric uid
+func lookupUID(s string) (int, error) {
+	if uid, err := strconv.Atoi(s); err == nil {
+		if uid < 0 {
+			return 0, fmt.Errorf("invalid uid '%s'", s)
+		}
+		return uid, nil
+	}
+
+	u, err := user.Lookup(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid user '%s': %v", s, err)
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// formatUIDs returns the allowed uids as a sorted, comma-separated list
+func formatUIDs(uids map[uint32]bool) string {
+	list := make([]int, 0, len(uids))
+	for uid := range uids {
+		list = append(list, int(uid))
+	}
+	sort.Ints(list)
+
+	parts := make([]string, len(list))
+	for i, uid := range list {
+		parts[i] = strconv.Itoa(uid)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// listenUnixSocket creates the Unix socket at path with the given file mode and owner
+// A stale socket left behind by a previous run is removed; any other existing file is an error
+func listenUnixSocket(path string, mode os.FileMode, uid, gid int) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %v", path, err)
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to set mode of socket %s: %v", path, err)
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(path, uid, gid); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("failed to set owner of socket %s: %v", path, err)
+		}
+	}
+	return ln, nil
+}
+
+// serveUnixSocket serves handler on a Unix socket listener
+// The credentials of each peer are attached to the context of its requests
+func serveUnixSocket(ln net.Listener, handler http.Handler) error {
+	server := &http.Server{
+		Handler: handler,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			var cred *peerCredentials
+			if uc, ok := c.(*net.UnixConn); ok {
+				if pc, err := unixPeerCredentials(uc); err == nil {
+					cred = &pc
+				}
+			}
+			return context.WithValue(ctx, unixPeerKey{}, cred)
+		},
+	}
+	return server.Serve(ln)
+}
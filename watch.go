@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Watch event types
+const (
+	EventSet    = "set"
+	EventDelete = "delete" // The key was deleted explicitly or evicted
+	EventExpire = "expire" // The key expired
+)
+
+// Watch limits
+const (
+	WatchHistorySize       = 1000             // Number of recent events kept so reconnecting watchers can resume
+	WatchBufferSize        = 256              // Number of events buffered per watcher before it is dropped as too slow
+	WatchHeartbeatInterval = 15 * time.Second // Interval between keepalive comments on an idle stream
+)
+
+// ErrCompacted is returned when a watch asks to resume from a revision whose events are no longer kept
+var ErrCompacted = errors.New("revision compacted")
+
+// WatchEvent is a change to a single key
+type WatchEvent struct {
+	Type     string `json:"type"`
+	Key      string `json:"key"`
+	Value    string `json:"value,omitempty"`         // New value for set events
+	TTL      int64  `json:"ttl_remaining,omitempty"` // Time to live in seconds for set events (0 if the key never expires)
+	Revision uint64 `json:"revision"`                // Store revision of the change; all changes of a batch share it
+	Index    int    `json:"index,omitempty"`         // Position of the change among those of its revision
+}
+
+// ID identifies the event in the stream, as "<revision>.<index>"
+func (ev WatchEvent) ID() string {
+	return fmt.Sprintf("%d.%d", ev.Revision, ev.Index)
+}
+
+// WatchPosition is the point in the event stream a watch resumes after
+// Index is the last event received within Revision, or -1 if every event of Revision was received
+type WatchPosition struct {
+	Revision uint64
+	Index    int
+}
+
+// parseWatchPosition parses a position given as a revision or as the "<revision>.<index>" id of an event
+func parseWatchPosition(s string) (WatchPosition, error) {
+	revisionStr, indexStr, hasIndex := strings.Cut(s, ".")
+	revision, err := strconv.ParseUint(revisionStr, 10, 64)
+	if err != nil {
+		return WatchPosition{}, fmt.Errorf("invalid revision '%s': must be a non-negative integer or an event id", s)
+	}
+	if !hasIndex {
+		return WatchPosition{Revision: revision, Index: -1}, nil
+	}
+	index, err := strconv.Atoi(indexStr)
+	if err != nil || index < 0 {
+		return WatchPosition{}, fmt.Errorf("invalid revision '%s': must be a non-negative integer or an event id", s)
+	}
+	return WatchPosition{Revision: revision, Index: index}, nil
+}
+
+// after reports whether ev comes after the position
+func (p WatchPosition) after(ev WatchEvent) bool {
+	return ev.Revision > p.Revision || ev.Revision == p.Revision && p.Index >= 0 && ev.Index > p.Index
+}
+
+// WatchFilter selects the keys a watcher is interested in
+type WatchFilter struct {
+	Key    string // Exact key to watch
+	Prefix string // Watch all keys with this prefix; ignored if Key is set
+}
+
+// matches reports whether key is selected by the filter
+func (f WatchFilter) matches(key string) bool {
+	if f.Key != "" {
+		return key == f.Key
+	}
+	return strings.HasPrefix(key, f.Prefix)
+}
+
+// Watcher receives the events matching its filter
+type Watcher struct {
+	Events <-chan WatchEvent // Closed when the watcher is cancelled or falls too far behind
+
+	filter WatchFilter
+	ch     chan WatchEvent
+	hub    *watchHub
+}
+
+// Cancel stops the watcher and closes its event channel
+func (w *Watcher) Cancel() {
+	w.hub.unsubscribe(w)
+}
+
+// watchHub distributes change events to watchers and keeps a short history for resuming
+type watchHub struct {
+	mu           sync.Mutex
+	history      []WatchEvent // Most recent events, oldest first
+	watchers     map[*Watcher]struct{}
+	lastRevision uint64 // Revision of the last published event
+	nextIndex    int    // Index of the next event of lastRevision
+}
+
+// newWatchHub creates an empty event hub
+func newWatchHub() *watchHub {
+	return &watchHub{watchers: make(map[*Watcher]struct{})}
+}
+
+// publish records events and delivers them to matching watchers without blocking
+// Watchers whose buffer is full are dropped; they can reconnect and resume from their last revision
+func (h *watchHub) publish(events []WatchEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i := range events {
+		if events[i].Revision != h.lastRevision {
+			h.lastRevision = events[i].Revision
+			h.nextIndex = 0
+		}
+		events[i].Index = h.nextIndex
+		h.nextIndex++
+	}
+
+	h.history = append(h.history, events...)
+	if excess := len(h.history) - WatchHistorySize; excess > 0 {
+		h.history = append(h.history[:0:0], h.history[excess:]...)
+	}
+
+	for w := range h.watchers {
+		for _, ev := range events {
+			if w.filter.matches(ev.Key) && !h.deliver(w, ev) {
+				break
+			}
+		}
+	}
+}
+
+// deliver sends ev to w, dropping the watcher if its buffer is full
+// Returns false if the watcher was dropped
+// The caller must hold h.mu
+func (h *watchHub) deliver(w *Watcher, ev WatchEvent) bool {
+	select {
+	case w.ch <- ev:
+		return true
+	default:
+		delete(h.watchers, w)
+		close(w.ch)
+		return false
+	}
+}
+
+// subscribe registers a watcher and returns the kept events after from that match filter
+// current is the store revision, which must not change while subscribing
+func (h *watchHub) subscribe(filter WatchFilter, from WatchPosition, current uint64) (*Watcher, []WatchEvent, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var backlog []WatchEvent
+	if from.Revision > 0 && (from.Revision < current || from.Revision == current && from.Index >= 0) {
+		// Every revision produces at least one event, so the history covers everything after
+		// from only if its oldest event is no later than the first event that may follow it
+		next := WatchEvent{Revision: from.Revision + 1}
+		if from.Index >= 0 {
+			next = WatchEvent{Revision: from.Revision, Index: from.Index + 1}
+		}
+		oldest := WatchEvent{Revision: current + 1}
+		if len(h.history) > 0 {
+			oldest = h.history[0]
+		}
+		if oldest.Revision > next.Revision || oldest.Revision == next.Revision && oldest.Index > next.Index {
+			return nil, nil, fmt.Errorf("%w: events after %s are no longer available, oldest available event is %s", ErrCompacted, next.ID(), oldest.ID())
+		}
+
+		for _, ev := range h.history {
+			if from.after(ev) && filter.matches(ev.Key) {
+				backlog = append(backlog, ev)
+			}
+		}
+	}
+
+	ch := make(chan WatchEvent, WatchBufferSize)
+	w := &Watcher{Events: ch, filter: filter, ch: ch, hub: h}
+	h.watchers[w] = struct{}{}
+	return w, backlog, nil
+}
+
+// unsubscribe removes a watcher and closes its channel if it is still registered
+func (h *watchHub) unsubscribe(w *Watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.watchers[w]; ok {
+		delete(h.watchers, w)
+		close(w.ch)
+	}
+}
+
+// Watch starts watching the keys selected by filter
+// If from has a revision, events after it that are still kept are returned as the backlog;
+// ErrCompacted is returned if some of them are no longer available
+// Returns the watcher, the backlog and the current store revision
+func (kvs *KeyValueStore) Watch(filter WatchFilter, from WatchPosition) (*Watcher, []WatchEvent, uint64, error) {
+	// Holding the read lock keeps writers, and therefore new events, out while subscribing
+	kvs.mu.RLock()
+	defer kvs.mu.RUnlock()
+
+	w, backlog, err := kvs.watchers.subscribe(filter, from, kvs.revision)
+	return w, backlog, kvs.revision, err
+}
+
+// publishLocked sends change events to watchers
+// The caller must hold the write lock
+func (kvs *KeyValueStore) publishLocked(events ...WatchEvent) {
+	if len(events) > 0 {
+		kvs.watchers.publish(events)
+	}
+}
+
+// setEvent returns the watch event for setting key to entry
+func setEvent(key string, entry storeEntry, now time.Time) WatchEvent {
+	return WatchEvent{Type: EventSet, Key: key, Value: entry.value, TTL: ttlSeconds(entry.ttlRemaining(now)), Revision: entry.version}
+}
+
+// writeSSEEvent writes a watch event in Server-Sent Events format
+// The event id is used so EventSource clients resume with Last-Event-ID, even in the middle of a batch
+func writeSSEEvent(w io.Writer, ev WatchEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", ev.ID(), ev.Type, data)
+	return err
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestWatchResume checks that a watch resumes after a revision or after an event in the middle of a batch
+func TestWatchResume(t *testing.T) {
+	kvs := NewKeyValueStore(DefaultLimits())
+	if err := kvs.Set("other", "x", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kvs.MSet([]BatchItem{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}, {Key: "c", Value: "3"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvs.Set("d", "4", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		from string
+		keys string // Keys of the backlog, in order
+	}{
+		{"1", "a b c d"},
+		{"1.0", "a b c d"},
+		{"2.0", "b c d"},
+		{"2.1", "c d"},
+		{"2.2", "d"},
+		{"2", "d"},
+		{"3.0", ""},
+		{"3", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.from, func(t *testing.T) {
+			from, err := parseWatchPosition(tt.from)
+			if err != nil {
+				t.Fatalf("parseWatchPosition: %v", err)
+			}
+			w, backlog, _, err := kvs.Watch(WatchFilter{}, from)
+			if err != nil {
+				t.Fatalf("Watch: %v", err)
+			}
+			defer w.Cancel()
+
+			var keys []string
+			for _, ev := range backlog {
+				keys = append(keys, ev.Key)
+			}
+			if got := strings.Join(keys, " "); got != tt.keys {
+				t.Fatalf("backlog = %q, want %q", got, tt.keys)
+			}
+		})
+	}
+
+	t.Run("event ids", func(t *testing.T) {
+		_, backlog, _, _ := kvs.Watch(WatchFilter{Key: "b"}, WatchPosition{Revision: 1, Index: -1})
+		if len(backlog) != 1 {
+			t.Fatalf("backlog = %+v, want the event of 'b'", backlog)
+		}
+		var buf bytes.Buffer
+		if err := writeSSEEvent(&buf, backlog[0]); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(buf.String(), "id: 2.1\n") {
+			t.Fatalf("SSE event = %q, want id 2.1", buf.String())
+		}
+	})
+}
+
+// TestWatchResumeCompacted checks that a resume is refused once events it needs were dropped from the history
+func TestWatchResumeCompacted(t *testing.T) {
+	// The history was trimmed in the middle of revision 5, whose first two events are gone
+	h := newWatchHub()
+	h.history = []WatchEvent{{Key: "c", Revision: 5, Index: 2}, {Key: "d", Revision: 5, Index: 3}}
+
+	tests := []struct {
+		from      string
+		compacted bool
+	}{
+		{"4", true},
+		{"5.0", true},
+		{"5.1", false},
+		{"5.2", false},
+		{"5", false},
+	}
+
+	for _, tt := range tests {
+		from, err := parseWatchPosition(tt.from)
+		if err != nil {
+			t.Fatalf("parseWatchPosition(%s): %v", tt.from, err)
+		}
+		w, _, err := h.subscribe(WatchFilter{}, from, 5)
+		if compacted := errors.Is(err, ErrCompacted); compacted != tt.compacted {
+			t.Errorf("resume after %s: compacted = %v (%v), want %v", tt.from, compacted, err, tt.compacted)
+		}
+		if w != nil {
+			w.Cancel()
+		}
+	}
+
+	for _, s := range []string{"x", "2.", "2.-1", "-1"} {
+		if _, err := parseWatchPosition(s); err == nil {
+			t.Errorf("parseWatchPosition(%q) succeeded", s)
+		}
+	}
+}
@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// WebSocket opcodes (RFC 6455 section 5.2)
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// WebSocket close codes (RFC 6455 section 7.4.1)
+const (
+	wsCloseNormal          = 1000
+	wsCloseProtocolError   = 1002
+	wsCloseUnsupportedData = 1003
+	wsCloseInvalidPayload  = 1007
+	wsCloseTooBig          = 1009
+)
+
+// wsGUID is appended to the client key to compute Sec-WebSocket-Accept
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket settings
+const (
+	WebSocketPingInterval     = 30 * time.Second // Interval between pings that keep idle connections open
+	WebSocketMaxSubscriptions = 16               // Maximum number of subscriptions per connection
+)
+
+// errWebSocketClosed is returned by readMessage once the peer has closed the connection
+var errWebSocketClosed = errors.New("websocket closed")
+
+// wsError is a protocol violation that closes the connection with the given code
+type wsError struct {
+	code    int
+	message string
+}
+
+func (e *wsError) Error() string {
+	return e.message
+}
+
+// wsConn is a server side WebSocket connection
+type wsConn struct {
+	conn       net.Conn
+	reader     *bufio.Reader
+	maxMessage int64 // Largest message accepted from the client in bytes
+
+	writeMu sync.Mutex
+}
+
+// headerContainsToken reports whether a comma separated header contains token, ignoring case
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseAllowedOrigins parses a comma-separated list of origins such as https://app.example.com, or * for any
+func parseAllowedOrigins(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var origins []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "*" {
+			origins = append(origins, item)
+			continue
+		}
+		u, err := url.Parse(item)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return nil, fmt.Errorf("invalid WebSocket origin '%s': must be scheme://host[:port] or *", item)
+		}
+		origins = append(origins, strings.ToLower(u.Scheme+"://"+u.Host))
+	}
+	return origins, nil
+}
+
+// checkWebSocketOrigin refuses upgrades that a browser sends on behalf of a page from another site
+// Requests without an Origin, as from non-browser clients, pass, as do requests from the server's own
+// origin or an allowed one, and requests carrying a token, which browsers don't add by themselves
+func checkWebSocketOrigin(r *http.Request, allowed []string) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" || tokenFromRequest(r) != nil {
+		return nil
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("origin '%s' is not allowed to open WebSockets", origin)
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return nil
+	}
+	normalized := strings.ToLower(u.Scheme + "://" + u.Host)
+	for _, a := range allowed {
+		if a == "*" || a == normalized {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin '%s' is not allowed to open WebSockets", origin)
+}
+
+// upgradeWebSocket performs the opening handshake and takes over the connection
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request, maxMessage int64) (*wsConn, error) {
+	if r.Method != http.MethodGet {
+		return nil, fmt.Errorf("websocket upgrade requires GET")
+	}
+	if !headerContainsToken(r.Header, "Connection", "upgrade") || !headerContainsToken(r.Header, "Upgrade", "websocket") {
+		return nil, fmt.Errorf("missing websocket upgrade headers")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, fmt.Errorf("unsupported websocket version '%s'", r.Header.Get("Sec-WebSocket-Version"))
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, fmt.Errorf("invalid Sec-WebSocket-Key")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, fmt.Errorf("connection does not support hijacking")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to take over connection: %w", err)
+	}
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	accept := base64.StdEncoding.EncodeToString(sum[:])
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n\r\n"
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to complete handshake: %w", err)
+	}
+
+	return &wsConn{conn: conn, reader: rw.Reader, maxMessage: maxMessage}, nil
+}
+
+// readFrame reads a single frame and unmasks its payload
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin = header[0]&0x80 != 0
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, &wsError{wsCloseProtocolError, "reserved bits set without a negotiated extension"}
+	}
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := int64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+		if length < 0 {
+			return false, 0, nil, &wsError{wsCloseProtocolError, "invalid frame length"}
+		}
+	}
+
+	if !masked {
+		return false, 0, nil, &wsError{wsCloseProtocolError, "client frames must be masked"}
+	}
+	if opcode >= wsOpClose && (!fin || length > 125) {
+		return false, 0, nil, &wsError{wsCloseProtocolError, "invalid control frame"}
+	}
+	if length > c.maxMessage {
+		return false, 0, nil, &wsError{wsCloseTooBig, "message too big"}
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	// Read incrementally so a large announced length doesn't allocate memory up front
+	payload, err = io.ReadAll(io.LimitReader(c.reader, length))
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if int64(len(payload)) < length {
+		return false, 0, nil, io.ErrUnexpectedEOF
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// readMessage returns the next text message, answering pings and reassembling fragments
+// Returns errWebSocketClosed once the client has sent a close frame
+func (c *wsConn) readMessage() (string, error) {
+	var message []byte
+	fragmented := false
+
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return "", err
+		}
+
+		switch opcode {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return "", err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			// Echo the status code back to complete the closing handshake
+			code := wsCloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload[:2]))
+			}
+			c.writeClose(code, "")
+			return "", errWebSocketClosed
+		case wsOpText, wsOpBinary:
+			if fragmented {
+				return "", &wsError{wsCloseProtocolError, "new message started before the previous one finished"}
+			}
+			if opcode == wsOpBinary {
+				return "", &wsError{wsCloseUnsupportedData, "only text messages are supported"}
+			}
+			message = payload
+		case wsOpContinuation:
+			if !fragmented {
+				return "", &wsError{wsCloseProtocolError, "continuation frame without a message"}
+			}
+			if int64(len(message)+len(payload)) > c.maxMessage {
+				return "", &wsError{wsCloseTooBig, "message too big"}
+			}
+			message = append(message, payload...)
+		default:
+			return "", &wsError{wsCloseProtocolError, fmt.Sprintf("unknown opcode %d", opcode)}
+		}
+
+		if !fin {
+			fragmented = true
+			continue
+		}
+
+		if !utf8.Valid(message) {
+			return "", &wsError{wsCloseInvalidPayload, "text message is not valid UTF-8"}
+		}
+		return string(message), nil
+	}
+}
+
+// writeFrame writes a single unmasked frame with the FIN bit set
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch length := len(payload); {
+	case length <= 125:
+		header[1] = byte(length)
+	case length <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(length))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// writeText sends a text message
+func (c *wsConn) writeText(data []byte) error {
+	return c.writeFrame(wsOpText, data)
+}
+
+// writeClose sends a close frame with the given status code and reason
+func (c *wsConn) writeClose(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	return c.writeFrame(wsOpClose, append(payload, reason...))
+}
+
+// close closes the underlying connection
+func (c *wsConn) close() error {
+	return c.conn.Close()
+}
+
+// wsEvent is the Data of a change event pushed to a WebSocket subscription
+type wsEvent struct {
+	Subscription int        `json:"subscription"`
+	Event        WatchEvent `json:"event"`
+}
+
+// wsSession runs the commands of one WebSocket connection and forwards its subscriptions
+type wsSession struct {
+	conn  *wsConn
+	ip    net.IP // Client IP the access rules are applied to, nil for Unix socket clients
+	ipStr string
+	kvs   *KeyValueStore
+	ac    *AccessControl
+	token *Token // Token the connection was opened with, nil if authentication is disabled
+
+	mu     sync.Mutex
+	subs   map[int]*Watcher
+	nextID int
+}
+
+// serveWebSocket runs a WebSocket session until the client disconnects
+// Every command is checked against the access rules for it and authorized against token, unless it is nil
+func serveWebSocket(conn *wsConn, ip net.IP, ipStr string, kvs *KeyValueStore, ac *AccessControl, token *Token) {
+	s := &wsSession{conn: conn, ip: ip, ipStr: ipStr, kvs: kvs, ac: ac, token: token, subs: make(map[int]*Watcher)}
+
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		s.unsubscribeAll()
+		conn.close()
+	}()
+
+	// Ping idle clients so proxies don't drop the connection
+	go func() {
+		ticker := time.NewTicker(WebSocketPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if conn.writeFrame(wsOpPing, nil) != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		command, err := conn.readMessage()
+		if err != nil {
+			var protoErr *wsError
+			if errors.As(err, &protoErr) {
+				logMessage("WS", "connection", ipStr, fmt.Sprintf("Closing connection: %s", protoErr.message), false, http.StatusBadRequest)
+				conn.writeClose(protoErr.code, protoErr.message)
+			}
+			logMessage("WS", "connection", ipStr, "WebSocket connection closed", false, http.StatusOK)
+			return
+		}
+
+		// SUBSCRIBE writes its own response, so there may be nothing left to send
+		response := s.handle(strings.TrimSpace(command))
+		if response == nil {
+			continue
+		}
+		if err := conn.writeText(response); err != nil {
+			return
+		}
+	}
+}
+
+// handle runs a single command and returns the JSON response, if it hasn't been sent already
+func (s *wsSession) handle(command string) []byte {
+	parts := strings.Fields(command)
+	if len(parts) > 0 {
+		if refused, message := s.ac.CheckCommand("WS", s.ip, s.ipStr, parts[0]); refused {
+			if message == "" {
+				// In DROP mode the connection is closed without a reply
+				s.conn.close()
+				return nil
+			}
+			jsonResponse, _ := json.Marshal(APIResponse{
+				Status:    http.StatusForbidden,
+				Message:   message,
+				TimeStamp: time.Now().Format(time.RFC3339),
+			})
+			return jsonResponse
+		}
+
+		switch strings.ToUpper(parts[0]) {
+		case "SUBSCRIBE":
+			return s.subscribe(parts[1:])
+		case "UNSUBSCRIBE":
+			return s.unsubscribe(parts[1:])
+		}
+	}
+	if s.token != nil {
+		if err := s.token.Authorize(commandPermission(parts)); err != nil {
+			return s.errorResponse(strings.ToUpper(parts[0]), http.StatusForbidden, err.Error())
+		}
+	}
+	return executeCommand("WS", command, s.ipStr, s.kvs)
+}
+
+// subscribe handles SUBSCRIBE [KEY <key>|PREFIX <prefix>] [REVISION <n>]
+func (s *wsSession) subscribe(args []string) []byte {
+	var filter WatchFilter
+	var from WatchPosition
+	var fromValue string
+
+	for i := 0; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return s.errorResponse("SUBSCRIBE", http.StatusBadRequest, fmt.Sprintf("Missing value for %s", args[i]))
+		}
+		switch option, value := strings.ToUpper(args[i]), args[i+1]; option {
+		case "KEY":
+			filter.Key = value
+		case "PREFIX":
+			filter.Prefix = value
+		case "REVISION":
+			position, err := parseWatchPosition(value)
+			if err != nil {
+				return s.errorResponse("SUBSCRIBE", http.StatusBadRequest, err.Error())
+			}
+			from, fromValue = position, value
+		default:
+			return s.errorResponse("SUBSCRIBE", http.StatusBadRequest, fmt.Sprintf("Unknown SUBSCRIBE option: %s", args[i]))
+		}
+	}
+
+	if s.token != nil {
+		if err := s.token.Authorize(watchPermission(filter)); err != nil {
+			return s.errorResponse("SUBSCRIBE", http.StatusForbidden, err.Error())
+		}
+	}
+
+	s.mu.Lock()
+	if len(s.subs) >= WebSocketMaxSubscriptions {
+		s.mu.Unlock()
+		return s.errorResponse("SUBSCRIBE", http.StatusBadRequest, fmt.Sprintf("Too many subscriptions: a connection may hold at most %d", WebSocketMaxSubscriptions))
+	}
+
+	watcher, backlog, revision, err := s.kvs.Watch(filter, from)
+	if err != nil {
+		s.mu.Unlock()
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrCompacted) {
+			status = http.StatusGone
+		}
+		return s.errorResponse("SUBSCRIBE", status, err.Error())
+	}
+
+	s.nextID++
+	id := s.nextID
+	s.subs[id] = watcher
+	s.mu.Unlock()
+
+	logMessage("WS", "SUBSCRIBE", s.ipStr, fmt.Sprintf("Subscription %d started at revision %d (key: '%s', prefix: '%s')", id, revision, filter.Key, filter.Prefix), false, http.StatusOK)
+	response := APIResponse{
+		Status:    http.StatusOK,
+		Message:   "Subscribed successfully",
+		Key:       "subscribe",
+		Version:   revision,
+		Data:      map[string]interface{}{"subscription": id, "revision": revision},
+		TimeStamp: time.Now().Format(time.RFC3339),
+	}
+	jsonResponse, _ := json.Marshal(response)
+
+	// The confirmation is written before the forwarder starts so it precedes every event
+	if err := s.conn.writeText(jsonResponse); err != nil {
+		return nil
+	}
+	// Until the first event is sent, a client that falls behind resumes where it asked to start
+	resume := strconv.FormatUint(revision, 10)
+	if len(backlog) > 0 {
+		resume = fromValue
+	}
+	go s.forward(id, watcher, backlog, resume)
+	return nil
+}
+
+// forward pushes the events of a subscription to the client
+// resume is the position to resubscribe from if the client falls behind, updated with every event sent
+func (s *wsSession) forward(id int, watcher *Watcher, backlog []WatchEvent, resume string) {
+	send := func(ev WatchEvent) error {
+		resume = ev.ID()
+		response := APIResponse{
+			Status:    http.StatusOK,
+			Message:   "Key changed",
+			Key:       ev.Key,
+			Value:     ev.Value,
+			Version:   ev.Revision,
+			TTL:       ev.TTL,
+			Data:      wsEvent{Subscription: id, Event: ev},
+			TimeStamp: time.Now().Format(time.RFC3339),
+		}
+		jsonResponse, _ := json.Marshal(response)
+		return s.conn.writeText(jsonResponse)
+	}
+
+	for _, ev := range backlog {
+		if send(ev) != nil {
+			return
+		}
+	}
+	for ev := range watcher.Events {
+		if send(ev) != nil {
+			return
+		}
+	}
+
+	// The channel was closed either by UNSUBSCRIBE or because the client fell behind
+	s.mu.Lock()
+	dropped := s.subs[id] == watcher
+	if dropped {
+		delete(s.subs, id)
+	}
+	s.mu.Unlock()
+
+	if dropped {
+		message := fmt.Sprintf("Subscription %d dropped for falling behind, resubscribe with REVISION %s to resume", id, resume)
+		logMessage("WS", "SUBSCRIBE", s.ipStr, message, false, http.StatusServiceUnavailable)
+		s.conn.writeText(s.errorResponse("SUBSCRIBE", http.StatusServiceUnavailable, message))
+	}
+}
+
+// unsubscribe handles UNSUBSCRIBE [<id>]; without an id every subscription is cancelled
+func (s *wsSession) unsubscribe(args []string) []byte {
+	if len(args) == 0 {
+		count := s.unsubscribeAll()
+		logMessage("WS", "UNSUBSCRIBE", s.ipStr, fmt.Sprintf("Cancelled %d subscriptions", count), false, http.StatusOK)
+		return s.response("UNSUBSCRIBE", http.StatusOK, fmt.Sprintf("Cancelled %d subscriptions", count))
+	}
+
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return s.errorResponse("UNSUBSCRIBE", http.StatusBadRequest, fmt.Sprintf("Invalid subscription id '%s'", args[0]))
+	}
+
+	s.mu.Lock()
+	watcher, ok := s.subs[id]
+	delete(s.subs, id)
+	s.mu.Unlock()
+
+	if !ok {
+		return s.errorResponse("UNSUBSCRIBE", http.StatusNotFound, fmt.Sprintf("Subscription %d not found", id))
+	}
+
+	watcher.Cancel()
+	logMessage("WS", "UNSUBSCRIBE", s.ipStr, fmt.Sprintf("Cancelled subscription %d", id), false, http.StatusOK)
+	return s.response("UNSUBSCRIBE", http.StatusOK, fmt.Sprintf("Cancelled subscription %d", id))
+}
+
+// unsubscribeAll cancels every subscription and returns how many there were
+func (s *wsSession) unsubscribeAll() int {
+	s.mu.Lock()
+	subs := s.subs
+	s.subs = make(map[int]*Watcher)
+	s.mu.Unlock()
+
+	for _, watcher := range subs {
+		watcher.Cancel()
+	}
+	return len(subs)
+}
+
+// response builds a JSON response for a session command
+func (s *wsSession) response(action string, status int, message string) []byte {
+	jsonResponse, _ := json.Marshal(APIResponse{
+		Status:    status,
+		Message:   message,
+		Key:       strings.ToLower(action),
+		TimeStamp: time.Now().Format(time.RFC3339),
+	})
+	return jsonResponse
+}
+
+// errorResponse logs a failed session command and builds its JSON response
+func (s *wsSession) errorResponse(action string, status int, message string) []byte {
+	logMessage("WS", action, s.ipStr, message, false, status)
+	jsonResponse, _ := json.Marshal(APIResponse{
+		Status:    status,
+		Message:   message,
+		TimeStamp: time.Now().Format(time.RFC3339),
+	})
+	return jsonResponse
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// clientFrame builds a frame as sent by a client, masked unless masked is false
+func clientFrame(fin bool, opcode byte, payload string, masked bool) []byte {
+	frame := []byte{opcode, 0}
+	if fin {
+		frame[0] |= 0x80
+	}
+	switch length := len(payload); {
+	case length <= 125:
+		frame[1] = byte(length)
+	case length <= 0xFFFF:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+	if !masked {
+		return append(frame, payload...)
+	}
+
+	frame[1] |= 0x80
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask...)
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	return frame
+}
+
+// frameRecorder is a connection that records the frames written to it
+type frameRecorder struct {
+	net.Conn
+	out bytes.Buffer
+}
+
+func (f *frameRecorder) Write(b []byte) (int, error) {
+	return f.out.Write(b)
+}
+
+// TestWebSocketReadMessage checks how masked, fragmented, control and oversized frames are read
+func TestWebSocketReadMessage(t *testing.T) {
+	const maxMessage = 300
+
+	frames := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	pong := func(payload string) []byte {
+		return append([]byte{0x80 | wsOpPong, byte(len(payload))}, payload...)
+	}
+	closeFrame := func(code int) []byte {
+		return append([]byte{0x80 | wsOpClose, 2}, binary.BigEndian.AppendUint16(nil, uint16(code))...)
+	}
+	tooLong := make([]byte, 10)
+	tooLong[0], tooLong[1] = 0x80|wsOpText, 0x80|127
+	binary.BigEndian.PutUint64(tooLong[2:], 1<<63)
+
+	tests := []struct {
+		name    string
+		input   []byte
+		message string
+		code    int    // Close code of the expected protocol error, 0 if none
+		closed  bool   // The client closed the connection
+		written []byte // Frames the server is expected to answer with
+	}{
+		{name: "masked text", input: clientFrame(true, wsOpText, "GET key", true), message: "GET key"},
+		{name: "16-bit length", input: clientFrame(true, wsOpText, strings.Repeat("a", 200), true), message: strings.Repeat("a", 200)},
+		{name: "unmasked frame", input: clientFrame(true, wsOpText, "GET key", false), code: wsCloseProtocolError},
+		{name: "reserved bits", input: append([]byte{0xC1}, clientFrame(true, wsOpText, "x", true)[1:]...), code: wsCloseProtocolError},
+		{name: "fragmented message", input: frames(
+			clientFrame(false, wsOpText, "GET ", true),
+			clientFrame(false, wsOpContinuation, "k", true),
+			clientFrame(true, wsOpContinuation, "ey", true),
+		), message: "GET key"},
+		{name: "ping in the middle of a message", input: frames(
+			clientFrame(false, wsOpText, "GET ", true),
+			clientFrame(true, wsOpPing, "hi", true),
+			clientFrame(true, wsOpContinuation, "key", true),
+		), message: "GET key", written: pong("hi")},
+		{name: "pong in the middle of a message", input: frames(
+			clientFrame(false, wsOpText, "GET ", true),
+			clientFrame(true, wsOpPong, "", true),
+			clientFrame(true, wsOpContinuation, "key", true),
+		), message: "GET key"},
+		{name: "close in the middle of a message", input: frames(
+			clientFrame(false, wsOpText, "GET ", true),
+			clientFrame(true, wsOpClose, string(binary.BigEndian.AppendUint16(nil, 1001)), true),
+		), closed: true, written: closeFrame(1001)},
+		{name: "fragmented control frame", input: clientFrame(false, wsOpPing, "hi", true), code: wsCloseProtocolError},
+		{name: "control frame over 125 bytes", input: clientFrame(true, wsOpPing, strings.Repeat("a", 126), true), code: wsCloseProtocolError},
+		{name: "continuation without a message", input: clientFrame(true, wsOpContinuation, "key", true), code: wsCloseProtocolError},
+		{name: "new message before the last one finished", input: frames(
+			clientFrame(false, wsOpText, "GET ", true),
+			clientFrame(true, wsOpText, "key", true),
+		), code: wsCloseProtocolError},
+		{name: "unknown opcode", input: clientFrame(true, 0x3, "x", true), code: wsCloseProtocolError},
+		{name: "binary message", input: clientFrame(true, wsOpBinary, "x", true), code: wsCloseUnsupportedData},
+		{name: "invalid UTF-8", input: clientFrame(true, wsOpText, "\xff\xfe", true), code: wsCloseInvalidPayload},
+		{name: "oversized frame", input: clientFrame(true, wsOpText, strings.Repeat("a", maxMessage+1), true), code: wsCloseTooBig},
+		{name: "oversized fragmented message", input: frames(
+			clientFrame(false, wsOpText, strings.Repeat("a", 200), true),
+			clientFrame(true, wsOpContinuation, strings.Repeat("a", 101), true),
+		), code: wsCloseTooBig},
+		{name: "negative 64-bit length", input: tooLong, code: wsCloseProtocolError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &frameRecorder{}
+			c := &wsConn{conn: rec, reader: bufio.NewReader(bytes.NewReader(tt.input)), maxMessage: maxMessage}
+
+			message, err := c.readMessage()
+			var protoErr *wsError
+			switch {
+			case tt.closed:
+				if !errors.Is(err, errWebSocketClosed) {
+					t.Fatalf("expected errWebSocketClosed, got %q, %v", message, err)
+				}
+			case tt.code != 0:
+				if !errors.As(err, &protoErr) || protoErr.code != tt.code {
+					t.Fatalf("expected close code %d, got %q, %v", tt.code, message, err)
+				}
+			case err != nil:
+				t.Fatalf("readMessage: %v", err)
+			case message != tt.message:
+				t.Fatalf("message = %q, want %q", message, tt.message)
+			}
+			if !bytes.Equal(rec.out.Bytes(), tt.written) {
+				t.Fatalf("written = %x, want %x", rec.out.Bytes(), tt.written)
+			}
+		})
+	}
+
+	t.Run("truncated payload", func(t *testing.T) {
+		frame := clientFrame(true, wsOpText, "GET key", true)
+		c := &wsConn{conn: &frameRecorder{}, reader: bufio.NewReader(bytes.NewReader(frame[:len(frame)-2])), maxMessage: maxMessage}
+		if _, err := c.readMessage(); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+		}
+	})
+}
+
+// TestCheckWebSocketOrigin checks which cross-origin upgrade requests are refused
+func TestCheckWebSocketOrigin(t *testing.T) {
+	allowed, err := parseAllowedOrigins("https://app.example.com, HTTP://Localhost:3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		origin  string
+		allowed []string
+		token   bool
+		ok      bool
+	}{
+		{"no origin", "", allowed, false, true},
+		{"own origin", "http://kv.internal:8080", nil, false, true},
+		{"allowed origin", "https://app.example.com", allowed, false, true},
+		{"allowed origin in another case", "http://localhost:3000", allowed, false, true},
+		{"other scheme of an allowed origin", "http://app.example.com", allowed, false, false},
+		{"other origin", "https://evil.example", allowed, false, false},
+		{"other origin with a token", "https://evil.example", allowed, true, true},
+		{"null origin", "null", allowed, false, false},
+		{"any origin", "https://evil.example", []string{"*"}, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://kv.internal:8080/api/ws", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.token {
+				r = r.WithContext(context.WithValue(r.Context(), tokenKey{}, &Token{Name: "reader", Role: RoleRead}))
+			}
+
+			if err := checkWebSocketOrigin(r, tt.allowed); (err == nil) != tt.ok {
+				t.Fatalf("checkWebSocketOrigin = %v, want allowed %v", err, tt.ok)
+			}
+		})
+	}
+
+	for _, s := range []string{"app.example.com", "https://app.example.com/path", "https://"} {
+		if _, err := parseAllowedOrigins(s); err == nil {
+			t.Errorf("parseAllowedOrigins(%q) succeeded", s)
+		}
+	}
+}